@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/stratospark/torro/bencoding"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const bencodeUsage = `Usage: torro bencode decode [-base64] [file]
+       torro bencode encode [file]
+
+decode converts a bencoded file to JSON, encode converts JSON back to
+bencoding. Both read from stdin when no file is given.
+`
+
+/*
+bencodeCommand implements "torro bencode", converting between
+bencoding and JSON. It returns the exit status.
+*/
+func bencodeCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, bencodeUsage)
+		return 2
+	}
+
+	flags := flag.NewFlagSet("bencode "+args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pBase64 := flags.Bool("base64", false, "write binary strings as base64 instead of hex")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	in := stdin
+	if flags.NArg() > 0 {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var out []byte
+	var err error
+	switch args[0] {
+	case "decode":
+		binary := bencoding.BinaryHex
+		if *pBase64 {
+			binary = bencoding.BinaryBase64
+		}
+		out, err = bencodeToJSON(in, binary)
+	case "encode":
+		out, err = jsonToBencode(in)
+	default:
+		fmt.Fprint(stderr, bencodeUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	if _, err := stdout.Write(out); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func bencodeToJSON(r io.Reader, binary bencoding.BinaryEncoding) ([]byte, error) {
+	c, err := bencoding.NewDecoder(r).DecodeContainer()
+	if err != nil {
+		return nil, err
+	}
+	return bencoding.ToJSON(c, binary)
+}
+
+func jsonToBencode(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	c, err := bencoding.FromJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	return bencoding.Marshal(*c)
+}
@@ -0,0 +1,393 @@
+package bencoding
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+const (
+	// MaxNestingDepth limits how deeply lists and dictionaries may be
+	// nested before the Decoder or parser gives up, so that hostile
+	// input cannot exhaust the stack.
+	MaxNestingDepth = 1000
+
+	// readChunkSize bounds how much memory is allocated up front when
+	// reading a byte string, so that a bogus length prefix cannot make
+	// the Decoder allocate more than the stream actually contains.
+	readChunkSize = 64 * 1024
+
+	// maxDigits is long enough for any 64-bit integer or string length.
+	maxDigits = 20
+)
+
+/*
+Decoder reads bencoded values one at a time from an input stream,
+without buffering the whole input in memory first. It is suitable for
+tracker HTTP bodies, peer extension messages or large .torrent files.
+Setting Strict rejects non-canonical integers and string lengths,
+and unsorted or duplicate dictionary keys. Since values are read one
+at a time, data following a value is left for the next call, even in
+strict mode; unlike ParseStrict and UnmarshalStrict, a caller that
+expects a single value must check that the next call returns io.EOF.
+*/
+type Decoder struct {
+	Strict bool
+
+	r      *bufio.Reader
+	offset int64
+	depth  int
+
+	// path locates the value currently being decoded, and is only
+	// turned into a string when reporting an error
+	path []pathSegment
+
+	// raw holds the bytes of the value currently being decoded
+	raw []byte
+}
+
+/*
+pathSegment is a dictionary key, or an index into a list.
+*/
+type pathSegment struct {
+	key    string
+	index  int
+	inList bool
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br}
+}
+
+/*
+InputOffset returns the number of bytes consumed from the stream so far.
+*/
+func (d *Decoder) InputOffset() int64 {
+	return d.offset
+}
+
+/*
+Decode reads the next bencoded value from the stream and stores it in
+the value pointed to by v, following the same rules as Unmarshal.
+It returns io.EOF if the stream ends before a new value begins.
+*/
+func (d *Decoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &InvalidUnmarshalError{reflect.TypeOf(v)}
+	}
+
+	c, err := d.DecodeContainer()
+	if err != nil {
+		return err
+	}
+	return unmarshalContainer(c, rv, "")
+}
+
+/*
+DecodeContainer reads the next bencoded value from the stream and
+returns it as a Container.
+*/
+func (d *Decoder) DecodeContainer() (*Container, error) {
+	if _, err := d.peekByte(); err != nil {
+		return nil, err
+	}
+
+	d.depth = 0
+	d.path = d.path[:0]
+	d.raw = nil
+	base := d.offset
+	c, err := d.readValue()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.setRaw(d.raw, base)
+	c.setBStrings()
+	d.raw = nil
+	return c, nil
+}
+
+/*
+setBStrings points the byte strings of c and its children at their
+bytes within Raw, so that the Decoder holds each string only once.
+*/
+func (c *Container) setBStrings() {
+	switch c.Type {
+	case ContainerBString:
+		i := bytes.IndexByte(c.Raw, COLON[0]) + 1
+		c.BString = c.Raw[i:len(c.Raw):len(c.Raw)]
+	case ContainerList:
+		for i := range *c.List {
+			(*c.List)[i].setBStrings()
+		}
+	case ContainerDict:
+		for key, val := range c.Dict {
+			val.setBStrings()
+			c.Dict[key] = val
+		}
+	}
+}
+
+func (d *Decoder) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{
+		Msg:    fmt.Sprintf(format, args...),
+		Offset: d.offset,
+		Token:  -1,
+		Path:   d.currentPath(),
+	}
+}
+
+/*
+currentPath returns the location of the value currently being decoded,
+e.g. "info.files[2]".
+*/
+func (d *Decoder) currentPath() string {
+	path := ""
+	for _, segment := range d.path {
+		if segment.inList {
+			path = fmt.Sprintf("%s[%d]", path, segment.index)
+		} else {
+			path = joinPath(path, segment.key)
+		}
+	}
+	return path
+}
+
+/*
+peekByte returns the next byte without consuming it.
+*/
+func (d *Decoder) peekByte() (byte, error) {
+	b, err := d.r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	d.offset++
+	d.raw = append(d.raw, b)
+	return b, nil
+}
+
+func (d *Decoder) readValue() (*Container, error) {
+	next, err := d.peekByte()
+	if err != nil {
+		return nil, err
+	}
+
+	start := d.offset
+	var c *Container
+	switch {
+	case next == INTEGER_START[0]:
+		c, err = d.readInteger()
+	case next >= '0' && next <= '9':
+		_, err = d.readBString()
+		c = &Container{Type: ContainerBString}
+	case next == LIST_START[0]:
+		c, err = d.readList()
+	case next == DICT_START[0]:
+		c, err = d.readDict()
+	default:
+		return nil, d.errorf("%s %q", LexErrInvalidCharacter, next)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.Start, c.End = start, d.offset
+	return c, nil
+}
+
+/*
+readDigits consumes an optionally negative decimal number up to and
+including the given terminator byte.
+*/
+func (d *Decoder) readDigits(terminator byte) (string, error) {
+	digits := make([]byte, 0, maxDigits)
+	for {
+		b, err := d.peekByte()
+		if err != nil {
+			return "", err
+		}
+		if !(b >= '0' && b <= '9') && !(b == '-' && len(digits) == 0) && b != terminator {
+			return "", d.errorf("%s %q", LexErrInvalidCharacter, b)
+		}
+		if len(digits) >= maxDigits && b != terminator {
+			return "", d.errorf("Number Too Long")
+		}
+		d.readByte()
+		if b == terminator {
+			return string(digits), nil
+		}
+		digits = append(digits, b)
+	}
+}
+
+func (d *Decoder) readInteger() (*Container, error) {
+	// "i"
+	if _, err := d.readByte(); err != nil {
+		return nil, err
+	}
+
+	digits, err := d.readDigits(INTEGER_END[0])
+	if err != nil {
+		return nil, err
+	}
+	num, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return nil, d.errorf("%s %q", ParseErrInvalidInteger, digits)
+	}
+	if d.Strict && !isCanonicalNumber(digits) {
+		return nil, d.errorf("%s %q", ParseErrNonCanonicalInteger, digits)
+	}
+	return &Container{Type: ContainerInteger, Integer: num}, nil
+}
+
+/*
+readBString reads a byte string into raw and returns its bytes, which
+are only valid until raw grows again.
+*/
+func (d *Decoder) readBString() ([]byte, error) {
+	digits, err := d.readDigits(COLON[0])
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 {
+		return nil, d.errorf("%s %q", LexErrInvalidStringLength, digits)
+	}
+	if d.Strict && !isCanonicalNumber(digits) {
+		return nil, d.errorf("%s %q", ParseErrNonCanonicalLength, digits)
+	}
+
+	// The bytes are only kept in raw, and the Container's BString is
+	// pointed at them once the whole value has been read. Grow the
+	// buffer as data arrives instead of trusting the length.
+	start := len(d.raw)
+	for int64(len(d.raw)-start) < n {
+		from := len(d.raw)
+		chunk := int(minInt64(n-int64(from-start), readChunkSize))
+		if cap(d.raw)-from < chunk {
+			grown := make([]byte, from, 2*cap(d.raw)+chunk)
+			copy(grown, d.raw)
+			d.raw = grown
+		}
+		read, err := io.ReadFull(d.r, d.raw[from:from+chunk])
+		d.offset += int64(read)
+		d.raw = d.raw[:from+read]
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d.raw[start:], nil
+}
+
+func (d *Decoder) enter() error {
+	d.depth++
+	if d.depth > MaxNestingDepth {
+		return d.errorf("%s %d", ParseErrNestingDepth, MaxNestingDepth)
+	}
+	return nil
+}
+
+func (d *Decoder) readList() (*Container, error) {
+	// "l"
+	if _, err := d.readByte(); err != nil {
+		return nil, err
+	}
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+
+	list := make([]Container, 0)
+	for {
+		next, err := d.peekByte()
+		if err != nil {
+			return nil, err
+		}
+		if next == LIST_END[0] {
+			d.readByte()
+			d.depth--
+			return &Container{Type: ContainerList, List: &list}, nil
+		}
+
+		d.path = append(d.path, pathSegment{index: len(list), inList: true})
+		item, err := d.readValue()
+		if err != nil {
+			return nil, err
+		}
+		d.path = d.path[:len(d.path)-1]
+		list = append(list, *item)
+	}
+}
+
+func (d *Decoder) readDict() (*Container, error) {
+	// "d"
+	if _, err := d.readByte(); err != nil {
+		return nil, err
+	}
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+
+	dict := make(map[string]Container)
+	lastKey, hasLastKey := "", false
+	for {
+		next, err := d.peekByte()
+		if err != nil {
+			return nil, err
+		}
+		if next == DICT_END[0] {
+			d.readByte()
+			d.depth--
+			return &Container{Type: ContainerDict, Dict: dict}, nil
+		}
+
+		if !(next >= '0' && next <= '9') {
+			return nil, d.errorf(ParseErrDictKeyNotString)
+		}
+		b, err := d.readBString()
+		if err != nil {
+			return nil, err
+		}
+		key := string(b)
+		d.path = append(d.path, pathSegment{key: key})
+		if d.Strict {
+			if msg := checkKeyOrder(lastKey, hasLastKey, key); msg != "" {
+				return nil, d.errorf(msg)
+			}
+		}
+		lastKey, hasLastKey = key, true
+
+		val, err := d.readValue()
+		if err != nil {
+			return nil, err
+		}
+		d.path = d.path[:len(d.path)-1]
+		dict[key] = *val
+	}
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,140 @@
+package bencoding
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDecoder(t *testing.T) {
+	Convey("Decoding consecutive values from a stream", t, func() {
+		dec := NewDecoder(strings.NewReader("4:spami-3eli1ei2eed3:cow3:mooe"))
+
+		var s string
+		So(dec.Decode(&s), ShouldBeNil)
+		So(s, ShouldEqual, "spam")
+		So(dec.InputOffset(), ShouldEqual, 6)
+
+		var n int
+		So(dec.Decode(&n), ShouldBeNil)
+		So(n, ShouldEqual, -3)
+
+		var list []int
+		So(dec.Decode(&list), ShouldBeNil)
+		So(list, ShouldResemble, []int{1, 2})
+
+		var dict map[string]string
+		So(dec.Decode(&dict), ShouldBeNil)
+		So(dict, ShouldResemble, map[string]string{"cow": "moo"})
+
+		So(dec.Decode(&s), ShouldEqual, io.EOF)
+	})
+
+	Convey("Decoding from a reader that returns one byte at a time", t, func() {
+		input := "d4:dictd1:ali10e1:bee3:inti99ee"
+		dec := NewDecoder(iotest.OneByteReader(strings.NewReader(input)))
+
+		var result interface{}
+		So(dec.Decode(&result), ShouldBeNil)
+		So(result, ShouldResemble, map[string]interface{}{"dict": map[string]interface{}{"a": makeResultList(10, "b")}, "int": int64(99)})
+	})
+
+	Convey("Decoding a torrent file straight from disk", t, func() {
+		f, err := os.Open("../testfiles/ubuntu.torrent")
+		So(err, ShouldBeNil)
+		defer f.Close()
+
+		torrent := &unmarshalTorrent{}
+		So(NewDecoder(f).Decode(torrent), ShouldBeNil)
+		So(torrent.Info.Name, ShouldEqual, "ubuntu-14.04.1-desktop-amd64.iso")
+		So(len(torrent.Info.Pieces), ShouldEqual, 39240)
+	})
+
+	Convey("Decoded values keep their original bytes", t, func() {
+		dec := NewDecoder(iotest.OneByteReader(strings.NewReader("i1ed4:infod3:keyi02ee5:otherleee")))
+
+		var n int
+		So(dec.Decode(&n), ShouldBeNil)
+
+		c, err := dec.DecodeContainer()
+		So(err, ShouldBeNil)
+		So(c.Raw, ShouldResemble, []byte("d4:infod3:keyi02ee5:otherlee"))
+		So(c.Start, ShouldEqual, 3)
+		So(c.Dict["info"].Raw, ShouldResemble, []byte("d3:keyi02ee"))
+		So(c.Dict["info"].Start, ShouldEqual, 10)
+		So(c.Dict["other"].Raw, ShouldResemble, []byte("le"))
+	})
+
+	Convey("Decoded byte strings share the memory of their original bytes", t, func() {
+		c, err := NewDecoder(strings.NewReader("l4:spam0:e")).DecodeContainer()
+		So(err, ShouldBeNil)
+		spam := (*c.List)[0]
+		So(spam.BString, ShouldResemble, []byte("spam"))
+		So(&spam.BString[0], ShouldEqual, &c.Raw[3])
+		So((*c.List)[1].BString, ShouldResemble, []byte{})
+
+		spam.BString = append(spam.BString, 'x')
+		So(c.Raw, ShouldResemble, []byte("l4:spam0:e"))
+	})
+
+	Convey("Decoding truncated input", t, func() {
+		for _, input := range []string{"5:spam", "i10", "l4:spam", "d3:cow", "d3:cow3:moo", "l"} {
+			var result interface{}
+			err := NewDecoder(strings.NewReader(input)).Decode(&result)
+			So(err, ShouldEqual, io.ErrUnexpectedEOF)
+		}
+	})
+
+	Convey("Decoding malformed input", t, func() {
+		for _, input := range []string{"x", "i1.1e", "i--1e", "ie", "1x:a", "-1:a", "di1e3:mooe", "i123456789012345678901234e"} {
+			var result interface{}
+			err := NewDecoder(strings.NewReader(input)).Decode(&result)
+			So(err, ShouldNotBeNil)
+			So(err, ShouldNotEqual, io.ErrUnexpectedEOF)
+		}
+	})
+
+	Convey("Decoding errors report the path of the bad value", t, func() {
+		var result interface{}
+		err := NewDecoder(strings.NewReader("d4:infod5:filesld4:pathl1:ai1.5eeeeee")).Decode(&result)
+		syntaxErr, ok := err.(*SyntaxError)
+		So(ok, ShouldBeTrue)
+		So(syntaxErr.Path, ShouldEqual, "info.files[0].path[1]")
+		So(syntaxErr.Offset, ShouldEqual, 29)
+
+		dec := NewDecoder(strings.NewReader("ld1:xi1eeed1:bi1e1:ai2ee"))
+		dec.Strict = true
+		So(dec.Decode(&result), ShouldBeNil)
+		err = dec.Decode(&result)
+		So(err, ShouldNotBeNil)
+		So(err.(*SyntaxError).Path, ShouldEqual, "a")
+	})
+
+	Convey("Decoding in strict mode rejects non-canonical input", t, func() {
+		for _, input := range []string{"i03e", "i-0e", "01:a", "li1ei02ee", "d1:bi1e1:ai2ee", "d1:ai1e1:ai2ee"} {
+			var result interface{}
+			So(NewDecoder(strings.NewReader(input)).Decode(&result), ShouldBeNil)
+
+			dec := NewDecoder(strings.NewReader(input))
+			dec.Strict = true
+			_, ok := dec.Decode(&result).(*SyntaxError)
+			So(ok, ShouldBeTrue)
+		}
+	})
+
+	Convey("Decoding a huge length prefix does not allocate it", t, func() {
+		var result []byte
+		err := NewDecoder(strings.NewReader("999999999999:abc")).Decode(&result)
+		So(err, ShouldEqual, io.ErrUnexpectedEOF)
+	})
+
+	Convey("Decoding deeply nested lists", t, func() {
+		input := strings.Repeat("l", MaxNestingDepth+1) + strings.Repeat("e", MaxNestingDepth+1)
+		var result interface{}
+		err := NewDecoder(strings.NewReader(input)).Decode(&result)
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,445 @@
+package bencoding
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNilValue error = errors.New("Cannot encode nil value")
+)
+
+/*
+Marshaler is implemented by types that know how to produce their
+own bencoded representation.
+*/
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+/*
+UnsupportedTypeError is returned when Marshal encounters a Go type
+that has no bencoded equivalent, e.g. floats, channels or functions.
+*/
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return "Unsupported Type: " + e.Type.String()
+}
+
+/*
+Encoder writes bencoded values to an output stream.
+*/
+type Encoder struct {
+	w io.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+/*
+Encode writes the bencoded representation of v to the stream.
+Nothing is written if v cannot be fully encoded.
+*/
+func (e *Encoder) Encode(v interface{}) error {
+	buf := &bytes.Buffer{}
+	if err := encodeValue(buf, reflect.ValueOf(v)); err != nil {
+		return err
+	}
+	_, err := e.w.Write(buf.Bytes())
+	return err
+}
+
+/*
+Marshal returns the bencoded representation of v.
+
+Strings, []byte and byte arrays become byte strings; signed and
+unsigned integers and bools become integers; slices and arrays
+become lists; maps with string keys and structs become dictionaries
+whose keys are emitted in sorted order, as required by the spec.
+
+Struct fields are named by the "bencode" tag, e.g.
+
+	PieceLength int `bencode:"piece length"`
+
+The "omitempty" option skips a field holding its zero value and a
+tag of "-" skips the field entirely. Untagged exported fields use
+the Go field name.
+*/
+func Marshal(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := encodeValue(buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var (
+	marshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	containerType = reflect.TypeOf(Container{})
+)
+
+func encodeValue(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		return ErrNilValue
+	}
+
+	if v.Type().Implements(marshalerType) {
+		if v.Kind() == reflect.Ptr && v.IsNil() {
+			return ErrNilValue
+		}
+		b, err := v.Interface().(Marshaler).MarshalBencode()
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		return nil
+	}
+
+	if v.Type() == containerType {
+		c := v.Interface().(Container)
+		return encodeContainer(buf, &c)
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return ErrNilValue
+		}
+		return encodeValue(buf, v.Elem())
+	case reflect.String:
+		encodeBString(buf, []byte(v.String()))
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteString("i1e")
+		} else {
+			buf.WriteString("i0e")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		encodeInteger(buf, strconv.FormatInt(v.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		encodeInteger(buf, strconv.FormatUint(v.Uint(), 10))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			encodeBString(buf, v.Bytes())
+			return nil
+		}
+		return encodeList(buf, v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			encodeBString(buf, b)
+			return nil
+		}
+		return encodeList(buf, v)
+	case reflect.Map:
+		return encodeMap(buf, v)
+	case reflect.Struct:
+		return encodeStruct(buf, v)
+	default:
+		return &UnsupportedTypeError{v.Type()}
+	}
+	return nil
+}
+
+func encodeBString(buf *bytes.Buffer, b []byte) {
+	buf.WriteString(strconv.Itoa(len(b)))
+	buf.WriteString(COLON)
+	buf.Write(b)
+}
+
+func encodeInteger(buf *bytes.Buffer, num string) {
+	buf.WriteString(INTEGER_START)
+	buf.WriteString(num)
+	buf.WriteString(INTEGER_END)
+}
+
+func encodeList(buf *bytes.Buffer, v reflect.Value) error {
+	buf.WriteString(LIST_START)
+	for i := 0; i < v.Len(); i++ {
+		if err := encodeValue(buf, v.Index(i)); err != nil {
+			return err
+		}
+	}
+	buf.WriteString(LIST_END)
+	return nil
+}
+
+/*
+dictEntry is a single key/value pair of a dictionary waiting to be
+sorted before it is written out.
+*/
+type dictEntry struct {
+	key string
+	val reflect.Value
+}
+
+func encodeDict(buf *bytes.Buffer, entries []dictEntry) error {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+
+	buf.WriteString(DICT_START)
+	for _, entry := range entries {
+		encodeBString(buf, []byte(entry.key))
+		if err := encodeValue(buf, entry.val); err != nil {
+			return err
+		}
+	}
+	buf.WriteString(DICT_END)
+	return nil
+}
+
+func encodeMap(buf *bytes.Buffer, v reflect.Value) error {
+	if v.Type().Key().Kind() != reflect.String {
+		return &UnsupportedTypeError{v.Type()}
+	}
+
+	entries := make([]dictEntry, 0, v.Len())
+	for _, key := range v.MapKeys() {
+		entries = append(entries, dictEntry{key.String(), v.MapIndex(key)})
+	}
+	return encodeDict(buf, entries)
+}
+
+func encodeStruct(buf *bytes.Buffer, v reflect.Value) error {
+	entries := make([]dictEntry, 0, v.NumField())
+	for _, field := range structFields(v.Type()) {
+		if field.alias {
+			continue
+		}
+		val, ok := fieldByIndex(v, field.index)
+		if !ok || (field.omitEmpty && isEmptyValue(val)) {
+			continue
+		}
+		entries = append(entries, dictEntry{field.name, val})
+	}
+	return encodeDict(buf, entries)
+}
+
+func encodeContainer(buf *bytes.Buffer, c *Container) error {
+	switch c.Type {
+	case ContainerBString:
+		encodeBString(buf, c.BString)
+	case ContainerInteger:
+		encodeInteger(buf, strconv.FormatInt(c.Integer, 10))
+	case ContainerList:
+		buf.WriteString(LIST_START)
+		if c.List != nil {
+			for i := range *c.List {
+				if err := encodeContainer(buf, &(*c.List)[i]); err != nil {
+					return err
+				}
+			}
+		}
+		buf.WriteString(LIST_END)
+	case ContainerDict:
+		entries := make([]dictEntry, 0, len(c.Dict))
+		for key, val := range c.Dict {
+			entries = append(entries, dictEntry{key, reflect.ValueOf(val)})
+		}
+		return encodeDict(buf, entries)
+	default:
+		return errors.New(fmt.Sprint("Unknown Container Type: ", c.Type))
+	}
+	return nil
+}
+
+/*
+field describes how a single struct field maps onto a dictionary key.
+*/
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+	tagged    bool
+
+	// alias is set on all but the first of several tagged fields of
+	// the same struct with the same key. They are all decoded into,
+	// but only the first is encoded.
+	alias bool
+}
+
+/*
+parseTag splits a "bencode" struct tag into the key name and
+whether the omitempty option is present.
+*/
+func parseTag(tag string) (name string, omitEmpty bool) {
+	parts := strings.Split(tag, ",")
+	for _, opt := range parts[1:] {
+		if opt == "omitempty" {
+			omitEmpty = true
+		}
+	}
+	return parts[0], omitEmpty
+}
+
+/*
+structFields returns the dictionary fields of a struct type. Fields
+of embedded structs without a tag are promoted into the parent,
+following Go's rules for promoted fields: of the fields with the same
+key, the shallowest wins, then the one with a tag, and if that leaves
+more than one they are all dropped, unless they are tagged fields of
+the same struct. Each struct type is only walked once, so that a
+struct embedding a pointer to itself terminates.
+*/
+func structFields(t reflect.Type) []field {
+	type embedded struct {
+		typ   reflect.Type
+		index []int
+	}
+
+	candidates := make([]field, 0, t.NumField())
+	visited := make(map[reflect.Type]bool)
+	next := []embedded{{typ: t}}
+	for len(next) > 0 {
+		current := next
+		next = nil
+		for _, e := range current {
+			if visited[e.typ] {
+				continue
+			}
+			visited[e.typ] = true
+
+			for i := 0; i < e.typ.NumField(); i++ {
+				sf := e.typ.Field(i)
+				tag := sf.Tag.Get("bencode")
+				if tag == "-" {
+					continue
+				}
+				index := append(append(make([]int, 0, len(e.index)+1), e.index...), i)
+
+				if sf.Anonymous && tag == "" {
+					ft := sf.Type
+					if ft.Kind() == reflect.Ptr {
+						ft = ft.Elem()
+					}
+					if ft.Kind() == reflect.Struct {
+						next = append(next, embedded{typ: ft, index: index})
+						continue
+					}
+				}
+
+				if sf.PkgPath != "" {
+					// Unexported field
+					continue
+				}
+
+				name, omitEmpty := parseTag(tag)
+				tagged := name != ""
+				if !tagged {
+					name = sf.Name
+				}
+				candidates = append(candidates, field{name: name, index: index, omitEmpty: omitEmpty, tagged: tagged})
+			}
+		}
+	}
+
+	byName := make(map[string][]int)
+	for i, f := range candidates {
+		byName[f.name] = append(byName[f.name], i)
+	}
+	fields := make([]field, 0, len(candidates))
+	for i, f := range candidates {
+		dominant := dominantFields(candidates, byName[f.name])
+		for j, d := range dominant {
+			if d == i {
+				f.alias = j > 0
+				fields = append(fields, f)
+			}
+		}
+	}
+	return fields
+}
+
+/*
+dominantFields returns which of the candidates with the same key are
+used, in the order they were declared.
+*/
+func dominantFields(candidates []field, same []int) []int {
+	depth := len(candidates[same[0]].index)
+	for _, i := range same {
+		if len(candidates[i].index) < depth {
+			depth = len(candidates[i].index)
+		}
+	}
+
+	shallowest := make([]int, 0, len(same))
+	tagged := make([]int, 0, len(same))
+	for _, i := range same {
+		if len(candidates[i].index) != depth {
+			continue
+		}
+		shallowest = append(shallowest, i)
+		if candidates[i].tagged {
+			tagged = append(tagged, i)
+		}
+	}
+	switch {
+	case len(shallowest) == 1:
+		return shallowest
+	case len(tagged) == 1:
+		return tagged
+	case len(tagged) == len(shallowest) && sameStruct(candidates, tagged):
+		return tagged
+	}
+	return nil
+}
+
+/*
+sameStruct reports whether the candidates are all fields of the same
+struct.
+*/
+func sameStruct(candidates []field, same []int) bool {
+	first := candidates[same[0]].index
+	for _, i := range same[1:] {
+		index := candidates[i].index
+		if !reflect.DeepEqual(index[:len(index)-1], first[:len(first)-1]) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+fieldByIndex is like reflect.Value.FieldByIndex, but reports false
+instead of panicking when it walks through a nil embedded pointer.
+*/
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package bencoding
+
+import (
+	"bytes"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+type MarshalTest struct {
+	Input  interface{}
+	Result string
+}
+
+func checkMarshalTests(tests []MarshalTest) {
+	for _, test := range tests {
+		Convey(fmt.Sprintf("%#v", test.Input), func() {
+			result, err := Marshal(test.Input)
+			So(err, ShouldBeNil)
+			So(string(result), ShouldEqual, test.Result)
+		})
+	}
+}
+
+type encodeFile struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+	MD5Sum string   `bencode:"md5sum,omitempty"`
+}
+
+type encodeInfo struct {
+	Name        string       `bencode:"name"`
+	PieceLength int          `bencode:"piece length"`
+	Pieces      []byte       `bencode:"pieces"`
+	Private     bool         `bencode:"private,omitempty"`
+	Files       []encodeFile `bencode:"files,omitempty"`
+	Ignored     string       `bencode:"-"`
+	unexported  int
+}
+
+func TestMarshal(t *testing.T) {
+	Convey("Marshaling basic values", t, func() {
+		checkMarshalTests([]MarshalTest{
+			MarshalTest{"spam", "4:spam"},
+			MarshalTest{"", "0:"},
+			MarshalTest{[]byte("eggs"), "4:eggs"},
+			MarshalTest{[4]byte{'a', 'b', 'c', 'd'}, "4:abcd"},
+			MarshalTest{3, "i3e"},
+			MarshalTest{-3, "i-3e"},
+			MarshalTest{0, "i0e"},
+			MarshalTest{int64(1) << 40, "i1099511627776e"},
+			MarshalTest{uint32(7), "i7e"},
+			MarshalTest{true, "i1e"},
+			MarshalTest{false, "i0e"},
+		})
+	})
+
+	Convey("Marshaling lists", t, func() {
+		checkMarshalTests([]MarshalTest{
+			MarshalTest{[]string{"spam", "eggs"}, "l4:spam4:eggse"},
+			MarshalTest{[]interface{}{"spam", 10}, "l4:spami10ee"},
+			MarshalTest{[]interface{}{}, "le"},
+			MarshalTest{[]interface{}{"hey", []int{1, 2}, "there"}, "l3:heyli1ei2ee5:theree"},
+		})
+	})
+
+	Convey("Marshaling dictionaries sorts the keys", t, func() {
+		checkMarshalTests([]MarshalTest{
+			MarshalTest{map[string]interface{}{"spam": "eggs", "cow": "moo"}, "d3:cow3:moo4:spam4:eggse"},
+			MarshalTest{map[string]interface{}{}, "de"},
+			MarshalTest{map[string]interface{}{"b": 1, "a": map[string]int{"z": 2, "y": 3}}, "d1:ad1:yi3e1:zi2ee1:bi1ee"},
+		})
+	})
+
+	Convey("Marshaling structs uses tags and sorts the keys", t, func() {
+		info := encodeInfo{
+			Name:        "test",
+			PieceLength: 16384,
+			Pieces:      []byte("01234567890123456789"),
+			Files: []encodeFile{
+				encodeFile{Length: 5, Path: []string{"a", "b.txt"}},
+			},
+			Ignored:    "ignored",
+			unexported: 1,
+		}
+		result, err := Marshal(info)
+		So(err, ShouldBeNil)
+		So(string(result), ShouldEqual,
+			"d5:filesld6:lengthi5e4:pathl1:a5:b.txteee4:name4:test12:piece lengthi16384e6:pieces20:01234567890123456789e")
+
+		ptrResult, err := Marshal(&info)
+		So(err, ShouldBeNil)
+		So(ptrResult, ShouldResemble, result)
+	})
+
+	Convey("Marshaling a parsed structure reproduces the input", t, func() {
+		input := "d4:dictd1:ali10e1:bee3:inti99ee"
+		lex := BeginLexing(".torrent", input, LexBegin)
+		output, err := Parse(Collect(lex))
+		So(err, ShouldBeNil)
+		result, err := Marshal(output)
+		So(err, ShouldBeNil)
+		So(string(result), ShouldEqual, input)
+	})
+
+	Convey("Marshaling embedded structs promotes fields like Go does", t, func() {
+		type Inner struct {
+			Name  string `bencode:"name"`
+			Other int    `bencode:"other"`
+			Extra int
+		}
+		type Tagged struct {
+			Extra int `bencode:"Extra"`
+		}
+		type Outer struct {
+			Inner
+			*Tagged
+			Name string `bencode:"name"`
+		}
+		result, err := Marshal(Outer{Inner: Inner{Name: "inner", Other: 1, Extra: 2}, Tagged: &Tagged{Extra: 3}, Name: "outer"})
+		So(err, ShouldBeNil)
+		So(string(result), ShouldEqual, "d5:Extrai3e4:name5:outer5:otheri1ee")
+
+		// Untagged fields at the same depth are ambiguous and dropped
+		type Left struct{ Extra int }
+		type Right struct{ Extra int }
+		type Both struct {
+			Left
+			Right
+		}
+		result, err = Marshal(Both{Left{1}, Right{2}})
+		So(err, ShouldBeNil)
+		So(string(result), ShouldEqual, "de")
+
+		// Tagged fields of one struct with the same key are all decoded
+		// into, but only the first is encoded
+		type Aliases struct {
+			Info    Inner      `bencode:"info"`
+			RawInfo RawMessage `bencode:"info"`
+		}
+		var aliases Aliases
+		So(Unmarshal([]byte("d4:infod4:name1:aee"), &aliases), ShouldBeNil)
+		So(aliases.Info.Name, ShouldEqual, "a")
+		So(string(aliases.RawInfo), ShouldEqual, "d4:name1:ae")
+		result, err = Marshal(aliases)
+		So(err, ShouldBeNil)
+		So(string(result), ShouldEqual, "d4:infod5:Extrai0e4:name1:a5:otheri0eee")
+	})
+
+	Convey("Marshaling a struct that embeds a pointer to itself", t, func() {
+		type Node struct {
+			*Node
+			Value int `bencode:"value"`
+		}
+		result, err := Marshal(Node{Node: &Node{Value: 2}, Value: 1})
+		So(err, ShouldBeNil)
+		So(string(result), ShouldEqual, "d5:valuei1ee")
+
+		var node Node
+		So(Unmarshal([]byte("d5:valuei1ee"), &node), ShouldBeNil)
+		So(node.Value, ShouldEqual, 1)
+	})
+
+	Convey("Marshaling unsupported values", t, func() {
+		_, err := Marshal(1.5)
+		So(err, ShouldNotBeNil)
+
+		_, err = Marshal(map[int]string{1: "a"})
+		So(err, ShouldNotBeNil)
+
+		_, err = Marshal(nil)
+		So(err, ShouldEqual, ErrNilValue)
+
+		_, err = Marshal([]interface{}{"a", make(chan int)})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestEncoder(t *testing.T) {
+	Convey("Encoding values to a stream", t, func() {
+		buf := &bytes.Buffer{}
+		enc := NewEncoder(buf)
+		So(enc.Encode("spam"), ShouldBeNil)
+		So(enc.Encode([]int{1, 2}), ShouldBeNil)
+		So(buf.String(), ShouldEqual, "4:spamli1ei2ee")
+	})
+
+	Convey("Encoding an invalid value writes nothing", t, func() {
+		buf := &bytes.Buffer{}
+		enc := NewEncoder(buf)
+		So(enc.Encode([]interface{}{"a", 1.5}), ShouldNotBeNil)
+		So(buf.Len(), ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,139 @@
+package bencoding
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+/*
+fuzzSeeds are malformed inputs that are likely to break the lexer,
+parser or Decoder: truncated values, bad lengths and numbers, and
+nesting past MaxNestingDepth. Regression cases live in testdata/fuzz,
+which is also where the fuzzer writes any crashers it finds; commit
+them there.
+*/
+var fuzzSeeds = []string{
+	"", "i", "i1", "l", "d", "e", "ie", "i-e", "i-0e", "i03e", "1:", "0:", "0:0:",
+	"d1:ae", "di1ei2ee", "lee", "l4:spamx", "d3:cowe", "d3:cow3:moo", "d4:info",
+	"5:spam", "-1:a", "1.4:aa", "5asdfg", "i1.1e", "i--1e", "i1ei2e",
+	"i9223372036854775808e", "99999999999999999999:a", "999999999999:abc",
+	"d1:bi1e1:ai2ee", "llllllllllllllllllllllllllllllllllllllllllllllllll",
+	"d4:infod5:filesld4:pathl1:ai1.5eeeeee",
+	strings.Repeat("l", MaxNestingDepth+1),
+}
+
+func addFuzzSeeds(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add([]byte(seed))
+	}
+	files, _ := filepath.Glob("../testfiles/*.torrent")
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		lex := BeginLexing("fuzz", string(data), LexBegin)
+		tokens := Collect(lex)
+		root, err := ParseContainer(tokens)
+		if err != nil {
+			if _, ok := err.(*SyntaxError); !ok {
+				t.Fatalf("%q: error is not a SyntaxError: %v", data, err)
+			}
+			return
+		}
+
+		if int(root.End) > len(data) || !bytes.Equal(root.Raw, data[root.Start:root.End]) {
+			t.Fatalf("%q: raw bytes %q do not match span %d-%d", data, root.Raw, root.Start, root.End)
+		}
+
+		// Whatever was parsed must survive a round trip
+		encoded, err := Marshal(*root)
+		if err != nil {
+			t.Fatalf("%q: %v", data, err)
+		}
+		lex = BeginLexing("fuzz", string(encoded), LexBegin)
+		output, err := Parse(Collect(lex))
+		if err != nil {
+			t.Fatalf("%q: re-encoded as %q: %v", data, encoded, err)
+		}
+		if !reflect.DeepEqual(output, root.Collapse()) {
+			t.Fatalf("%q: round trip through %q changed the value", data, encoded)
+		}
+
+		// Canonical input is reproduced exactly
+		if _, err := ParseStrict(tokens); err == nil && !bytes.Equal(encoded, data) {
+			t.Fatalf("%q: strict input re-encoded as %q", data, encoded)
+		}
+	})
+}
+
+func FuzzDecoder(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dec := NewDecoder(bytes.NewReader(data))
+		c, err := dec.DecodeContainer()
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(c.Raw, data[:dec.InputOffset()]) {
+			t.Fatalf("%q: raw bytes %q do not match consumed input", data, c.Raw)
+		}
+
+		// The Decoder never accepts more than the parser does
+		lex := BeginLexing("fuzz", string(data), LexBegin)
+		root, err := ParseContainer(Collect(lex))
+		if err != nil {
+			t.Fatalf("%q: decoded, but failed to parse: %v", data, err)
+		}
+		if !reflect.DeepEqual(root.Collapse(), c.Collapse()) {
+			t.Fatalf("%q: parser and Decoder disagree", data)
+		}
+	})
+}
+
+/*
+FuzzStrict checks that the strict Decoder, ParseStrict and
+UnmarshalStrict accept the same inputs. The Decoder reads one value at
+a time and leaves any data that follows it for the next call, so an
+input is only accepted by it as a whole if the next call finds the end
+of the stream.
+*/
+func FuzzStrict(f *testing.F) {
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dec := NewDecoder(bytes.NewReader(data))
+		dec.Strict = true
+		_, decodeErr := dec.DecodeContainer()
+		if decodeErr == nil {
+			if _, err := dec.DecodeContainer(); err != io.EOF {
+				decodeErr = err
+				if err == nil {
+					decodeErr = errTrailingData
+				}
+			}
+		}
+
+		_, parseErr := ParseStrict(Collect(BeginLexing("fuzz", string(data), LexBegin)))
+		var v interface{}
+		unmarshalErr := UnmarshalStrict(data, &v)
+
+		if (decodeErr == nil) != (parseErr == nil) || (parseErr == nil) != (unmarshalErr == nil) {
+			t.Fatalf("%q: strict Decoder: %v, ParseStrict: %v, UnmarshalStrict: %v", data, decodeErr, parseErr, unmarshalErr)
+		}
+	})
+}
+
+var errTrailingData = errors.New("trailing data")
@@ -0,0 +1,201 @@
+package bencoding
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+BinaryEncoding selects how ToJSON writes byte strings that are not
+valid UTF-8.
+*/
+type BinaryEncoding int
+
+const (
+	BinaryHex BinaryEncoding = iota
+	BinaryBase64
+)
+
+/*
+The JSON form of a bencoded value is lossless:
+
+Integers become JSON numbers, lists become arrays and dictionaries
+become objects. Byte strings that are valid UTF-8 become JSON strings,
+anything else becomes {"$hex": "..."} or {"$base64": "..."}.
+Dictionary keys starting with "$" are escaped by doubling it, and keys
+that are not valid UTF-8 are written as "$hex:..." or "$base64:...".
+*/
+const (
+	jsonEscape    = "$"
+	jsonHexKey    = "$hex"
+	jsonBase64Key = "$base64"
+)
+
+var (
+	ErrJSONInvalidValue = errors.New("JSON Value Has No Bencoded Equivalent")
+	ErrJSONInvalidKey   = errors.New("Invalid Escaped JSON Key")
+)
+
+/*
+ToJSON converts a bencoded value into indented JSON.
+*/
+func ToJSON(c *Container, binary BinaryEncoding) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(toJSONValue(c, binary)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeBinary(b []byte, binary BinaryEncoding) (string, string) {
+	if binary == BinaryBase64 {
+		return jsonBase64Key, base64.StdEncoding.EncodeToString(b)
+	}
+	return jsonHexKey, hex.EncodeToString(b)
+}
+
+func toJSONValue(c *Container, binary BinaryEncoding) interface{} {
+	switch c.Type {
+	case ContainerBString:
+		if utf8.Valid(c.BString) {
+			return string(c.BString)
+		}
+		key, val := encodeBinary(c.BString, binary)
+		return map[string]string{key: val}
+	case ContainerInteger:
+		return c.Integer
+	case ContainerList:
+		list := make([]interface{}, 0, len(*c.List))
+		for i := range *c.List {
+			list = append(list, toJSONValue(&(*c.List)[i], binary))
+		}
+		return list
+	default:
+		dict := make(map[string]interface{}, len(c.Dict))
+		for key, val := range c.Dict {
+			dict[toJSONKey(key, binary)] = toJSONValue(&val, binary)
+		}
+		return dict
+	}
+}
+
+func toJSONKey(key string, binary BinaryEncoding) string {
+	if !utf8.ValidString(key) {
+		prefix, val := encodeBinary([]byte(key), binary)
+		return prefix + ":" + val
+	}
+	if strings.HasPrefix(key, jsonEscape) {
+		return jsonEscape + key
+	}
+	return key
+}
+
+/*
+FromJSON converts JSON written by ToJSON back into a bencoded value.
+Numbers must be integers, and null or boolean values are rejected.
+*/
+func FromJSON(data []byte) (*Container, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return fromJSONValue(v, "")
+}
+
+func fromJSONValue(v interface{}, path string) (*Container, error) {
+	switch v := v.(type) {
+	case string:
+		return &Container{Type: ContainerBString, BString: []byte(v)}, nil
+	case json.Number:
+		n, err := v.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("%s %q at %s", ParseErrInvalidInteger, v, path)
+		}
+		return &Container{Type: ContainerInteger, Integer: n}, nil
+	case []interface{}:
+		list := make([]Container, 0, len(v))
+		for i, item := range v {
+			c, err := fromJSONValue(item, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, *c)
+		}
+		return &Container{Type: ContainerList, List: &list}, nil
+	case map[string]interface{}:
+		if b, ok, err := fromJSONBinary(v); ok {
+			if err != nil {
+				return nil, fmt.Errorf("%s at %s", err, path)
+			}
+			return &Container{Type: ContainerBString, BString: b}, nil
+		}
+		dict := make(map[string]Container, len(v))
+		for key, item := range v {
+			decodedKey, err := fromJSONKey(key)
+			if err != nil {
+				return nil, fmt.Errorf("%s %q at %s", err, key, path)
+			}
+			c, err := fromJSONValue(item, joinPath(path, decodedKey))
+			if err != nil {
+				return nil, err
+			}
+			dict[decodedKey] = *c
+		}
+		return &Container{Type: ContainerDict, Dict: dict}, nil
+	default:
+		return nil, fmt.Errorf("%s: %v at %s", ErrJSONInvalidValue, v, path)
+	}
+}
+
+/*
+fromJSONBinary decodes an object of the form {"$hex": "..."} or
+{"$base64": "..."}. The second result reports whether v has that form.
+*/
+func fromJSONBinary(v map[string]interface{}) ([]byte, bool, error) {
+	if len(v) != 1 {
+		return nil, false, nil
+	}
+	for key, val := range v {
+		s, ok := val.(string)
+		if !ok {
+			return nil, false, nil
+		}
+		switch key {
+		case jsonHexKey:
+			b, err := hex.DecodeString(s)
+			return b, true, err
+		case jsonBase64Key:
+			b, err := base64.StdEncoding.DecodeString(s)
+			return b, true, err
+		}
+	}
+	return nil, false, nil
+}
+
+func fromJSONKey(key string) (string, error) {
+	switch {
+	case !strings.HasPrefix(key, jsonEscape):
+		return key, nil
+	case strings.HasPrefix(key, jsonEscape+jsonEscape):
+		return key[len(jsonEscape):], nil
+	case strings.HasPrefix(key, jsonHexKey+":"):
+		b, err := hex.DecodeString(key[len(jsonHexKey)+1:])
+		return string(b), err
+	case strings.HasPrefix(key, jsonBase64Key+":"):
+		b, err := base64.StdEncoding.DecodeString(key[len(jsonBase64Key)+1:])
+		return string(b), err
+	}
+	return "", ErrJSONInvalidKey
+}
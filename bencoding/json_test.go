@@ -0,0 +1,66 @@
+package bencoding
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"testing"
+)
+
+func checkJSONRoundTrip(input string, binary BinaryEncoding) string {
+	lex := BeginLexing(".torrent", input, LexBegin)
+	root, err := ParseContainer(Collect(lex))
+	So(err, ShouldBeNil)
+
+	data, err := ToJSON(root, binary)
+	So(err, ShouldBeNil)
+
+	c, err := FromJSON(data)
+	So(err, ShouldBeNil)
+	result, err := Marshal(*c)
+	So(err, ShouldBeNil)
+	So(string(result), ShouldEqual, input)
+	return string(data)
+}
+
+func TestJSON(t *testing.T) {
+	Convey("Converting bencoded values to JSON", t, func() {
+		data := checkJSONRoundTrip("d3:cow3:moo4:listli1ei-2e0:ee", BinaryHex)
+		So(data, ShouldEqual, "{\n  \"cow\": \"moo\",\n  \"list\": [\n    1,\n    -2,\n    \"\"\n  ]\n}\n")
+	})
+
+	Convey("Binary strings are escaped", t, func() {
+		data := checkJSONRoundTrip("l3:\xff\x00\x01e", BinaryHex)
+		So(data, ShouldContainSubstring, `"$hex": "ff0001"`)
+
+		data = checkJSONRoundTrip("l3:\xff\x00\x01e", BinaryBase64)
+		So(data, ShouldContainSubstring, `"$base64": "/wAB"`)
+	})
+
+	Convey("Dictionary keys are escaped", t, func() {
+		data := checkJSONRoundTrip("d4:$hex1:a5:plaini2e2:\xfe\xffi1ee", BinaryHex)
+		So(data, ShouldContainSubstring, `"$$hex": "a"`)
+		So(data, ShouldContainSubstring, `"$hex:feff": 1`)
+		So(data, ShouldContainSubstring, `"plain": 2`)
+
+		data = checkJSONRoundTrip("d2:\xfe\xffi1ee", BinaryBase64)
+		So(data, ShouldContainSubstring, `"$base64:/v8=": 1`)
+	})
+
+	Convey("Large integers are kept exact", t, func() {
+		data := checkJSONRoundTrip("i9223372036854775807e", BinaryHex)
+		So(data, ShouldEqual, "9223372036854775807\n")
+	})
+
+	Convey("Converting a torrent file to JSON and back", t, func() {
+		input, err := ioutil.ReadFile("../testfiles/ubuntu.torrent")
+		So(err, ShouldBeNil)
+		checkJSONRoundTrip(string(input), BinaryHex)
+	})
+
+	Convey("Converting invalid JSON", t, func() {
+		for _, input := range []string{"1.5", "null", "true", "[1, false]", `{"$unknown": 1}`, `{"$hex": "xyz"}`, `{"a": 1`} {
+			_, err := FromJSON([]byte(input))
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
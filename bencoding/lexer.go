@@ -1,10 +1,10 @@
 package bencoding
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/oleiade/lane"
 	"strconv"
-	"strings"
 	"unicode"
 	"unicode/utf8"
 )
@@ -52,41 +52,6 @@ func collect(lex *Lexer) (tokens []Token) {
 
 var Collect = collect
 
-/*
-Get the raw bencoded info dictionary value. This is a bit
-of a hack, as it requires two passes through the tokens to
-get the original data. A better approach may have been to
-have the Lexer record the corresponding position and values
-of every token have the parser be able to build up the
-original representation of a parsed structure.
-*/
-func GetBencodedInfo(tokens []Token) []byte {
-	startInfo, endInfo := 0, 0
-	infoBytes := make([]byte, 0)
-
-	dictStack := lane.NewStack()
-	for i, token := range tokens {
-		if token.Type == TOKEN_DICT_START {
-			dictStack.Push(i)
-		} else if token.Type == TOKEN_DICT_END {
-			dictStack.Pop()
-			if dictStack.Size() == 1 && endInfo == 0 {
-				endInfo = i - 1
-				infoBytes = append(infoBytes, token.Value...)
-			}
-		}
-		if startInfo == 0 && string(tokens[i+3].Value) == "info" && dictStack.Size() == 1 {
-			startInfo = i + 3
-		}
-		if startInfo > 0 && i > startInfo && endInfo == 0 {
-			infoBytes = append(infoBytes, token.Value...)
-		}
-	}
-
-	//	fmt.Println(fmt.Sprintf("%x", infoBytes[len(infoBytes)-2:]))
-	return infoBytes
-}
-
 type LexFn func(*Lexer) LexFn
 
 /*
@@ -110,7 +75,7 @@ Puts a token on the token channel. The value of this
 token  is read from the input based on the current lexer position.
 */
 func (lex *Lexer) Emit(tokenType TokenType) {
-	token := Token{Type: tokenType, Value: lex.Input[lex.Start:lex.Pos]}
+	token := Token{Type: tokenType, Value: lex.Input[lex.Start:lex.Pos], Offset: int64(lex.Start)}
 	lex.Tokens <- token
 	lex.Start = lex.Pos
 }
@@ -120,8 +85,9 @@ Returns a token with error information.
 */
 func (lex *Lexer) Errorf(format string, args ...interface{}) LexFn {
 	lex.Tokens <- Token{
-		Type:  TOKEN_ERROR,
-		Value: []byte(fmt.Sprintf(format, args...)),
+		Type:   TOKEN_ERROR,
+		Value:  []byte(fmt.Sprintf(format, args...)),
+		Offset: int64(lex.Start),
 	}
 	return nil
 }
@@ -152,7 +118,8 @@ func (lex *Lexer) Next() byte {
 }
 
 /*
-Return the next token from the channel
+Return the next token from the channel. Once the lexer has stopped
+after an error, every further call returns TOKEN_EOF.
 */
 func (lex *Lexer) NextToken() Token {
 	for {
@@ -160,8 +127,10 @@ func (lex *Lexer) NextToken() Token {
 		case token := <-lex.Tokens:
 			return token
 		default:
+			if lex.State == nil {
+				return Token{Type: TOKEN_EOF, Value: []byte{}, Offset: int64(lex.Start)}
+			}
 			lex.State = lex.State(lex)
-
 		}
 	}
 }
@@ -169,8 +138,12 @@ func (lex *Lexer) NextToken() Token {
 /*
 Returns the next rune in the stream, then puts the lexer
 position back. Basically reads the next rune without consuming it.
+Returns 0 at the end of the input.
 */
 func (lex *Lexer) Peek() byte {
+	if lex.IsEOF() {
+		return 0
+	}
 	r := lex.Next()
 	lex.Backup()
 	return r
@@ -184,9 +157,18 @@ func (lex *Lexer) Shutdown() {
 }
 
 func BeginLexing(name, input string, state LexFn) *Lexer {
+	return BeginLexingBytes(name, []byte(input), state)
+}
+
+/*
+BeginLexingBytes is like BeginLexing, but lexes input in place instead
+of copying it. The values of the tokens are slices of input, so it
+must not be modified while they are in use.
+*/
+func BeginLexingBytes(name string, input []byte, state LexFn) *Lexer {
 	l := &Lexer{
 		Name:        name,
-		Input:       []byte(input),
+		Input:       input,
 		State:       state,
 		Tokens:      make(chan Token, 3),
 		NestedStack: lane.NewStack(),
@@ -221,19 +203,18 @@ func LexBegin(lex *Lexer) LexFn {
 	default:
 		if lex.IsEOF() {
 			if lex.NestedStack.Size() > 0 {
-				lex.Errorf(LexErrUnclosedDelimeter)
+				return lex.Errorf(LexErrUnclosedDelimeter)
 			}
 			lex.Emit(TOKEN_EOF)
+			return LexBegin
 		}
-		if lex.NestedStack.Size() > 0 {
+		if next == LIST_END[0] && lex.NestedStack.Size() > 0 {
 			if closeState := lex.NestedStack.Pop(); closeState != nil {
 				return closeState.(func(*Lexer) LexFn)
 			}
 		}
 
-		lex.Errorf(LexErrInvalidCharacter)
-
-		return lex.Errorf("done")
+		return lex.Errorf(LexErrInvalidCharacter)
 	}
 }
 
@@ -244,7 +225,7 @@ func LexStringStart(lex *Lexer) LexFn {
 			return lex.Errorf(LexErrUnexpectedEOF)
 		}
 
-		if strings.HasPrefix(string(lex.InputToEnd()), COLON) {
+		if bytes.HasPrefix(lex.InputToEnd(), []byte(COLON)) {
 			n, err := strconv.ParseInt(string(lex.CurrentInput()), 10, 64)
 			if err != nil || n < 0 {
 				return lex.Errorf(LexErrInvalidStringLength)
@@ -282,6 +263,10 @@ func LexIntegerStart(lex *Lexer) LexFn {
 
 func LexIntegerValue(lex *Lexer) LexFn {
 	for {
+		if lex.IsEOF() {
+			return lex.Errorf(LexErrUnexpectedEOF)
+		}
+
 		next := lex.Peek()
 		r, _ := utf8.DecodeRune([]byte{next})
 		if unicode.IsDigit(r) || next == '-' {
@@ -290,7 +275,7 @@ func LexIntegerValue(lex *Lexer) LexFn {
 			return lex.Errorf(LexErrInvalidCharacter)
 		}
 
-		if strings.HasPrefix(string(lex.InputToEnd()), INTEGER_END) {
+		if bytes.HasPrefix(lex.InputToEnd(), []byte(INTEGER_END)) {
 			lex.Emit(TOKEN_INTEGER_VALUE)
 			return LexIntegerEnd
 		}
@@ -13,14 +13,14 @@ type LexTest struct {
 }
 
 var (
-	tColon        = Token{TOKEN_COLON, []byte{':'}}
-	tIntegerStart = Token{TOKEN_INTEGER_START, []byte{'i'}}
-	tIntegerEnd   = Token{TOKEN_INTEGER_END, []byte{'e'}}
-	tListStart    = Token{TOKEN_LIST_START, []byte{'l'}}
-	tListEnd      = Token{TOKEN_LIST_END, []byte{'e'}}
-	tDictStart    = Token{TOKEN_DICT_START, []byte{'d'}}
-	tDictEnd      = Token{TOKEN_DICT_END, []byte{'e'}}
-	tEOF          = Token{TOKEN_EOF, []byte{}}
+	tColon        = Token{Type: TOKEN_COLON, Value: []byte{':'}}
+	tIntegerStart = Token{Type: TOKEN_INTEGER_START, Value: []byte{'i'}}
+	tIntegerEnd   = Token{Type: TOKEN_INTEGER_END, Value: []byte{'e'}}
+	tListStart    = Token{Type: TOKEN_LIST_START, Value: []byte{'l'}}
+	tListEnd      = Token{Type: TOKEN_LIST_END, Value: []byte{'e'}}
+	tDictStart    = Token{Type: TOKEN_DICT_START, Value: []byte{'d'}}
+	tDictEnd      = Token{Type: TOKEN_DICT_END, Value: []byte{'e'}}
+	tEOF          = Token{Type: TOKEN_EOF, Value: []byte{}}
 )
 
 func checkLexTests(tests []LexTest) {
@@ -29,11 +29,28 @@ func checkLexTests(tests []LexTest) {
 			lex := BeginLexing(".torrent", test.Input, test.StartState)
 			results := collect(lex)
 			lex.Shutdown()
-			So(results, ShouldResemble, test.Result)
+			So(results, ShouldResemble, withOffsets(test.Result))
 		})
 	}
 }
 
+/*
+withOffsets fills in the expected offset of every token, which is
+the total length of the tokens before it.
+*/
+func withOffsets(tokens []Token) []Token {
+	result := make([]Token, len(tokens))
+	offset := int64(0)
+	for i, token := range tokens {
+		token.Offset = offset
+		result[i] = token
+		if token.Type != TOKEN_ERROR {
+			offset += int64(len(token.Value))
+		}
+	}
+	return result
+}
+
 func TestLexer(t *testing.T) {
 	Convey("Creating a basic Lexer", t, func() {
 		lex := &Lexer{}
@@ -44,6 +61,14 @@ func TestLexer(t *testing.T) {
 		So(lex.String(), ShouldContainSubstring, "Pos")
 		So(lex.String(), ShouldContainSubstring, "Width")
 	})
+
+	Convey("Lexing a byte slice in place", t, func() {
+		input := []byte("4:spam")
+		tokens := Collect(BeginLexingBytes("bytes", input, LexBegin))
+		So(tokens, ShouldHaveLength, 4)
+		So(tokens[2].Value, ShouldResemble, []byte("spam"))
+		So(&tokens[2].Value[0], ShouldEqual, &input[2])
+	})
 }
 
 func TestStringLexing(t *testing.T) {
@@ -363,26 +388,3 @@ func TestDictLexing(t *testing.T) {
 	})
 
 }
-
-func TestGetBencodedInfo(t *testing.T) {
-
-	Convey("Returns the original bencoded info dictionary from tokens", t, func() {
-		Convey("Using artifical data", func() {
-			input := "d4:infod3:keyd1:x1:yee5:otherd1:a1:bee"
-			lex := BeginLexing(".torrent", input, LexBegin)
-			tokens := collect(lex)
-			lex.Shutdown()
-			info := GetBencodedInfo(tokens)
-			So(info, ShouldResemble, []byte("d3:keyd1:x1:yee"))
-		})
-
-		Convey("Using data extracted from torrent file", func() {
-			input := "d8:announce39:http://torrent.ubuntu.com:6969/announce13:announce-listll39:http://torrent.ubuntu.com:6969/announceel44:http://ipv6.torrent.ubuntu.com:6969/announceee7:comment29:Ubuntu CD releases.ubuntu.com13:creation datei1406245935e4:infod6:lengthi1028653056e4:name32:ubuntu-14.04.1-desktop-amd64.iso12:piece lengthi524288eee"
-			lex := BeginLexing(".torrent", input, LexBegin)
-			tokens := collect(lex)
-			lex.Shutdown()
-			info := GetBencodedInfo(tokens)
-			So(info, ShouldResemble, []byte("d6:lengthi1028653056e4:name32:ubuntu-14.04.1-desktop-amd64.iso12:piece lengthi524288ee"))
-		})
-	})
-}
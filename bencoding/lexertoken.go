@@ -2,9 +2,14 @@ package bencoding
 
 import "fmt"
 
+/*
+Token is a single lexical item. Offset is the position of the first
+byte of Value within the lexer input.
+*/
 type Token struct {
-	Type  TokenType
-	Value []byte
+	Type   TokenType
+	Value  []byte
+	Offset int64
 }
 
 func NewToken(tokenType TokenType, val string) Token {
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"github.com/oleiade/lane"
 	"strconv"
-	"unicode/utf8"
 )
 
 type ContainerType int
@@ -16,12 +15,21 @@ const (
 	ContainerDict
 )
 
+/*
+Container is a parsed bencoded value. Start and End are the byte
+offsets of the value within the original input, and Raw holds the
+exact original bytes of the value, e.g. for computing an infohash.
+*/
 type Container struct {
 	Type    ContainerType
 	BString []byte
-	Integer int
+	Integer int64
 	List    *[]Container
 	Dict    map[string]Container
+
+	Start int64
+	End   int64
+	Raw   []byte
 }
 
 func (c *Container) String() string {
@@ -55,6 +63,25 @@ func (c *Container) Append(val Container) {
 	*c.List = append(*c.List, val)
 }
 
+/*
+setRaw points the Raw field of c and all of its children at their
+spans of input, which starts at offset base of the original stream.
+*/
+func (c *Container) setRaw(input []byte, base int64) {
+	c.Raw = input[c.Start-base : c.End-base]
+	switch c.Type {
+	case ContainerList:
+		for i := range *c.List {
+			(*c.List)[i].setRaw(input, base)
+		}
+	case ContainerDict:
+		for key, val := range c.Dict {
+			val.setRaw(input, base)
+			c.Dict[key] = val
+		}
+	}
+}
+
 func (c *Container) Collapse() interface{} {
 	switch c.Type {
 	case ContainerBString:
@@ -78,18 +105,117 @@ func (c *Container) Collapse() interface{} {
 	}
 }
 
+var (
+	ParseErrUnexpectedToken   string = "Unexpected Token"
+	ParseErrUnexpectedEOF     string = "Unexpected EOF"
+	ParseErrInvalidLength     string = "Invalid String Length"
+	ParseErrLengthMismatch    string = "String Length Does Not Match"
+	ParseErrMissingColon      string = "Missing Required Colon"
+	ParseErrInvalidInteger    string = "Invalid Integer"
+	ParseErrMissingIntegerEnd string = "Missing Integer End"
+	ParseErrDictKeyNotString  string = "Dictionary Key Must Be A String"
+	ParseErrMissingDictValue  string = "Missing Dictionary Value"
+	ParseErrMismatchedEnd     string = "Mismatched Container End"
+
+	ParseErrNonCanonicalInteger string = "Non-Canonical Integer"
+	ParseErrNonCanonicalLength  string = "Non-Canonical String Length"
+	ParseErrUnsortedKeys        string = "Dictionary Keys Not Sorted"
+	ParseErrDuplicateKey        string = "Duplicate Dictionary Key"
+	ParseErrTrailingData        string = "Trailing Data After Root Value"
+	ParseErrNestingDepth        string = "Exceeded Maximum Nesting Depth of"
+)
+
+/*
+isCanonicalNumber reports whether digits is written the only way the
+spec allows: no leading zeros, and no negative zero.
+*/
+func isCanonicalNumber(digits string) bool {
+	if len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+		if digits == "0" {
+			return false
+		}
+	}
+	return len(digits) == 1 || (len(digits) > 1 && digits[0] != '0')
+}
+
+/*
+SyntaxError describes malformed bencoded input. Offset is the byte
+offset into the original input, Token is the index of the offending
+token (or -1 when the input was not tokenized), and Path is the
+location of the enclosing value, e.g. "info.files[2]".
+*/
+type SyntaxError struct {
+	Msg    string
+	Offset int64
+	Token  int
+	Path   string
+}
+
+func (e *SyntaxError) Error() string {
+	msg := fmt.Sprintf("%s at offset %d", e.Msg, e.Offset)
+	if e.Token >= 0 {
+		msg += fmt.Sprintf(", token %d", e.Token)
+	}
+	if e.Path != "" {
+		msg += ", path " + e.Path
+	}
+	return msg
+}
+
+/*
+ParseFrame remembers where an open list or dictionary on the
+Parser's stack will be stored once it is closed: under Key in a
+dictionary, or at Index in a list. Parent is the frame of the
+enclosing container, or nil for the root.
+*/
+type ParseFrame struct {
+	Container *Container
+	Parent    *ParseFrame
+	Key       string
+	Index     int
+
+	LastKey    string
+	HasLastKey bool
+}
+
+/*
+checkKeyOrder returns an error message if key does not sort strictly
+after the previous key of a dictionary, or "" if it does.
+*/
+func checkKeyOrder(lastKey string, hasLastKey bool, key string) string {
+	switch {
+	case !hasLastKey || lastKey < key:
+		return ""
+	case lastKey == key:
+		return ParseErrDuplicateKey
+	default:
+		return ParseErrUnsortedKeys
+	}
+}
+
 /*
 Parser keeps track of parsing state, corresponding tokens,
-output data structure, etc.
+output data structure, etc. Lists and dictionaries are kept on
+the Stack while they are open, and only added to their parent
+once they are closed and their full byte span is known. In Strict
+mode, only canonical bencoding is accepted: integers and string
+lengths without leading zeros, dictionary keys sorted and unique,
+every container closed, and nothing after the root value.
 */
 type Parser struct {
 	Tokens []Token
 	State  ParseFn
 	Output interface{}
+	Root   *Container
 	Stack  *lane.Stack
+	Err    error
+	Strict bool
 
-	Pos     int
-	NextKey string
+	Pos        int
+	Offset     int64
+	NextKey    string
+	HasNextKey bool
 }
 
 func (parser *Parser) CurrentType() TokenType {
@@ -100,19 +226,172 @@ func (parser *Parser) CurrentValue() []byte {
 	return parser.Tokens[parser.Pos].Value
 }
 
+/*
+Advance moves past the current token, keeping track of the byte
+offset into the original input.
+*/
+func (parser *Parser) Advance() {
+	parser.Offset += int64(len(parser.Tokens[parser.Pos].Value))
+	parser.Pos++
+}
+
+/*
+input returns the original input up to the current offset. Tokens from
+the Lexer are slices of its input, so it is recovered from the first
+token without copying. Tokens built some other way are joined instead.
+*/
+func (parser *Parser) input() []byte {
+	tokens := parser.Tokens[:parser.Pos]
+	if len(tokens) > 0 && tokens[0].Offset == 0 && int64(cap(tokens[0].Value)) >= parser.Offset {
+		input := tokens[0].Value[:parser.Offset]
+		contiguous := true
+		for _, token := range tokens {
+			if len(token.Value) > 0 && (token.Offset+int64(len(token.Value)) > parser.Offset ||
+				&token.Value[0] != &input[token.Offset]) {
+				contiguous = false
+				break
+			}
+		}
+		if contiguous {
+			return input
+		}
+	}
+
+	input := make([]byte, 0, parser.Offset)
+	for _, token := range tokens {
+		input = append(input, token.Value...)
+	}
+	return input
+}
+
+/*
+Head returns the innermost open container frame, or nil.
+*/
+func (parser *Parser) Head() *ParseFrame {
+	head, _ := parser.Stack.Head().(*ParseFrame)
+	return head
+}
+
+/*
+Expect reports whether the current token exists and has the given type.
+*/
+func (parser *Parser) Expect(tokenType TokenType) bool {
+	return parser.Pos < len(parser.Tokens) && parser.CurrentType() == tokenType
+}
+
+/*
+Path returns the location of the frame's container, e.g.
+"info.files[2]". It is only built when needed, as building it for
+every frame would make parsing deeply nested input quadratic.
+*/
+func (frame *ParseFrame) Path() string {
+	frames := make([]*ParseFrame, 0)
+	for f := frame; f.Parent != nil; f = f.Parent {
+		frames = append(frames, f)
+	}
+	path := ""
+	for i := len(frames) - 1; i >= 0; i-- {
+		path = frames[i].Parent.childPath(path, frames[i].Key, frames[i].Index)
+	}
+	return path
+}
+
+/*
+childPath returns the location of the child at key or index, given
+the frame's own path.
+*/
+func (frame *ParseFrame) childPath(path, key string, index int) string {
+	if frame.Container.Type == ContainerList {
+		return fmt.Sprintf("%s[%d]", path, index)
+	}
+	return joinPath(path, key)
+}
+
+/*
+CurrentPath returns the location of the value currently being parsed.
+*/
+func (parser *Parser) CurrentPath() string {
+	head := parser.Head()
+	if head == nil {
+		return ""
+	}
+	switch {
+	case head.Container.Type == ContainerList:
+		return head.childPath(head.Path(), "", len(*head.Container.List))
+	case parser.HasNextKey:
+		return head.childPath(head.Path(), parser.NextKey, 0)
+	}
+	return head.Path()
+}
+
+/*
+Errorf records a SyntaxError at the current position and stops parsing.
+*/
+func (parser *Parser) Errorf(format string, args ...interface{}) ParseFn {
+	parser.Err = &SyntaxError{
+		Msg:    fmt.Sprintf(format, args...),
+		Offset: parser.Offset,
+		Token:  parser.Pos,
+		Path:   parser.CurrentPath(),
+	}
+	return nil
+}
+
 type ParseFn func(*Parser) ParseFn
 
 /*
-Parse takes a list of Tokens from the lexer and creates the final data structure.
+Parse takes a list of Tokens from the lexer and creates the final data
+structure. Malformed input, including errors reported by the lexer,
+results in a *SyntaxError.
+*/
+func Parse(tokens []Token) (interface{}, error) {
+	parser := runParser(tokens, false)
+	if parser.Err != nil {
+		return nil, parser.Err
+	}
+	return parser.Output, nil
+}
+
+/*
+ParseContainer is like Parse, but returns the root Container instead
+of collapsing it into Go values.
 */
-func Parse(tokens []Token) *Parser {
+func ParseContainer(tokens []Token) (*Container, error) {
+	parser := runParser(tokens, false)
+	if parser.Err != nil {
+		return nil, parser.Err
+	}
+	return parser.Root, nil
+}
+
+/*
+ParseStrict is like Parse, but only accepts canonical encodings.
+*/
+func ParseStrict(tokens []Token) (interface{}, error) {
+	parser := runParser(tokens, true)
+	if parser.Err != nil {
+		return nil, parser.Err
+	}
+	return parser.Output, nil
+}
+
+/*
+ParseContainerStrict is like ParseContainer, but only accepts
+canonical encodings.
+*/
+func ParseContainerStrict(tokens []Token) (*Container, error) {
+	parser := runParser(tokens, true)
+	if parser.Err != nil {
+		return nil, parser.Err
+	}
+	return parser.Root, nil
+}
+
+func runParser(tokens []Token, strict bool) *Parser {
 	parser := beginParsing(tokens, parseBegin)
-	for parser.Pos < len(parser.Tokens) {
-		if parser.State != nil {
-			parser.State = parser.State(parser)
-		} else {
-			break
-		}
+	parser.Strict = strict
+	for parser.State != nil {
+		parser.State = parser.State(parser)
 	}
 	return parser
 }
@@ -124,12 +403,10 @@ func beginParsing(tokens []Token, state ParseFn) *Parser {
 	p := &Parser{
 		Tokens: tokens,
 		State:  state,
-		//		Output: make([]interface{}, 0),
-		Stack: lane.NewStack(),
-		Pos:   0,
+		Stack:  lane.NewStack(),
+		Pos:    0,
 	}
 
-	//	p.CurrentContainer = p.Output
 	return p
 }
 
@@ -138,6 +415,10 @@ parseBegin is the main state function to begin with and that
 all other states eventually transition to.
 */
 func parseBegin(parser *Parser) ParseFn {
+	if parser.Pos >= len(parser.Tokens) {
+		return parser.Errorf(ParseErrUnexpectedEOF)
+	}
+
 	token := parser.Tokens[parser.Pos]
 	switch token.Type {
 	case TOKEN_STRING_LENGTH:
@@ -149,122 +430,224 @@ func parseBegin(parser *Parser) ParseFn {
 	case TOKEN_DICT_START:
 		return parseDict
 	case TOKEN_LIST_END, TOKEN_DICT_END:
-		// Pop stack so new items can be added to the parent container
-		parser.Pos++
-		if parser.Stack.Size() > 1 {
-			parser.Stack.Pop()
-		}
-		return parseBegin
+		return parseEnd
 	case TOKEN_EOF:
-		// TODO: Check if containers have been closed
-
-		// Collapse root Container data structure into interface{}
-		container := parser.Stack.Head().(*Container)
-		parser.Output = container.Collapse()
-		return nil
+		if parser.Root == nil || parser.Strict {
+			return parser.Errorf(ParseErrUnexpectedEOF)
+		}
+		// Outside of Strict mode, unclosed containers are tolerated
+		closeAll(parser)
+		return parseFinish
+	case TOKEN_ERROR:
+		return parser.Errorf("%s", token.Value)
 	default:
 		// Some tokens should only be handled by other state functions
-		fmt.Println("Current Token: ", parser.Pos, ", Total Tokens: ", len(parser.Tokens))
-		panic(fmt.Sprint("UNEXPECTED TOKEN TYPE: ", token.Type))
-	}
-}
-
-func addToContainer(parser *Parser, c *Container, key string) {
-	if parser.Stack.Head() != nil {
-		head := parser.Stack.Head().(*Container)
-		switch head.Type {
-		case ContainerBString:
-			panic("CANT ADD TO STRING")
-		case ContainerInteger:
-			panic("CANT ADD TO INTEGER")
-		case ContainerList:
-			head.Append(*c)
-			if c.Type == ContainerList || c.Type == ContainerDict {
-				parser.Stack.Push(c)
+		return parser.Errorf("%s %s", ParseErrUnexpectedToken, TokenNames[token.Type])
+	}
+}
+
+/*
+parseEnd closes the innermost list or dictionary. Closing the root
+container finishes parsing.
+*/
+func parseEnd(parser *Parser) ParseFn {
+	head := parser.Head()
+	if head == nil {
+		return parser.Errorf("%s %s", ParseErrUnexpectedToken, TokenNames[parser.CurrentType()])
+	}
+	if (parser.CurrentType() == TOKEN_LIST_END) != (head.Container.Type == ContainerList) {
+		return parser.Errorf(ParseErrMismatchedEnd)
+	}
+	if parser.HasNextKey {
+		return parser.Errorf(ParseErrMissingDictValue)
+	}
+
+	// Pop stack so new items can be added to the parent container
+	parser.Advance()
+	parser.Stack.Pop()
+	head.Container.End = parser.Offset
+	if parser.Stack.Size() == 0 {
+		return parseRootEnd
+	}
+	storeInParent(parser.Head(), head.Container, head.Key)
+	return parseBegin
+}
+
+/*
+parseRootEnd runs once the root value is complete. Anything after it
+is ignored, unless in Strict mode.
+*/
+func parseRootEnd(parser *Parser) ParseFn {
+	if parser.Strict && parser.Pos < len(parser.Tokens) && parser.CurrentType() != TOKEN_EOF {
+		return parser.Errorf(ParseErrTrailingData)
+	}
+	return parseFinish
+}
+
+/*
+parseFinish fills in the raw bytes of every value and collapses the
+root Container data structure into interface{}.
+*/
+func parseFinish(parser *Parser) ParseFn {
+	parser.Root.setRaw(parser.input(), 0)
+	parser.Output = parser.Root.Collapse()
+	return nil
+}
+
+/*
+closeAll ends every container still open at the end of the input.
+*/
+func closeAll(parser *Parser) {
+	for parser.Stack.Size() > 0 {
+		head := parser.Stack.Pop().(*ParseFrame)
+		head.Container.End = parser.Offset
+		if parser.Stack.Size() > 0 {
+			storeInParent(parser.Head(), head.Container, head.Key)
+		}
+	}
+}
+
+func storeInParent(parent *ParseFrame, c *Container, key string) {
+	switch parent.Container.Type {
+	case ContainerList:
+		parent.Container.Append(*c)
+	case ContainerDict:
+		parent.Container.SetKey(key, *c)
+	}
+}
+
+/*
+addToContainer stores c in the innermost open container, or makes it
+the root value. Lists and dictionaries are pushed onto the stack so
+that following values are added to them. It returns the next state.
+*/
+func addToContainer(parser *Parser, c *Container) ParseFn {
+	isContainer := c.Type == ContainerList || c.Type == ContainerDict
+
+	// Closing containers and collapsing them is recursive, so the
+	// depth is limited like the Decoder's
+	if isContainer && parser.Stack.Size() >= MaxNestingDepth {
+		return parser.Errorf("%s %d", ParseErrNestingDepth, MaxNestingDepth)
+	}
+
+	head := parser.Head()
+	if head == nil {
+		parser.Root = c
+		if !isContainer {
+			return parseRootEnd
+		}
+		parser.Stack.Push(&ParseFrame{Container: c})
+		return parseBegin
+	}
+
+	var key string
+	if head.Container.Type == ContainerDict {
+		if !parser.HasNextKey {
+			if c.Type != ContainerBString {
+				return parser.Errorf(ParseErrDictKeyNotString)
 			}
-		case ContainerDict:
-			if parser.NextKey != "" {
-				head.SetKey(parser.NextKey, *c)
-				parser.NextKey = ""
-				if c.Type == ContainerList || c.Type == ContainerDict {
-					parser.Stack.Push(c)
-				}
-			} else {
-				if key != "" {
-					parser.NextKey = key
-				} else {
-					panic("DICT KEY NOT SET")
+			parser.NextKey = string(c.BString)
+			parser.HasNextKey = true
+			if parser.Strict {
+				if msg := checkKeyOrder(head.LastKey, head.HasLastKey, parser.NextKey); msg != "" {
+					return parser.Errorf(msg)
 				}
 			}
+			head.LastKey = parser.NextKey
+			head.HasLastKey = true
+			return parseBegin
 		}
+		key = parser.NextKey
+	}
+
+	if isContainer {
+		frame := &ParseFrame{Container: c, Parent: head, Key: key}
+		if head.Container.Type == ContainerList {
+			frame.Index = len(*head.Container.List)
+		}
+		parser.Stack.Push(frame)
 	} else {
-		container := c
-		parser.Stack.Push(container)
+		storeInParent(head, c, key)
 	}
+	parser.NextKey = ""
+	parser.HasNextKey = false
+	return parseBegin
 }
 
 func parseBString(parser *Parser) ParseFn {
+	start := parser.Offset
+
 	// Get Length
 	strLength, err := strconv.ParseInt(string(parser.CurrentValue()), 10, 64)
-	if err != nil {
-		panic("NOT A VALID STRING LENGTH")
+	if err != nil || strLength < 0 {
+		return parser.Errorf(ParseErrInvalidLength)
 	}
-	parser.Pos++
+	if parser.Strict && !isCanonicalNumber(string(parser.CurrentValue())) {
+		return parser.Errorf(ParseErrNonCanonicalLength)
+	}
+	parser.Advance()
 
 	// Get Colon
-	colon := parser.CurrentValue()
-	r, _ := utf8.DecodeRune(colon)
-	if r != ':' {
-		panic("MISSING REQUIRED COLON")
+	if !parser.Expect(TOKEN_COLON) {
+		return parser.Errorf(ParseErrMissingColon)
 	}
-	parser.Pos++
+	parser.Advance()
 
 	// Get Value
+	if !parser.Expect(TOKEN_STRING_VALUE) {
+		return parser.Errorf("%s, expected %s", ParseErrUnexpectedToken, TokenNames[TOKEN_STRING_VALUE])
+	}
 	strValue := parser.CurrentValue()
-	if len(strValue) != int(strLength) {
-		panic("STRING LENGTH DOESNT MATCH")
+	if int64(len(strValue)) != strLength {
+		return parser.Errorf(ParseErrLengthMismatch)
 	}
-	parser.Pos++
-	addToContainer(parser, &Container{Type: ContainerBString, BString: strValue}, string(strValue))
+	parser.Advance()
 
-	return parseBegin
+	return addToContainer(parser, &Container{Type: ContainerBString, BString: strValue, Start: start, End: parser.Offset})
 }
 
 func parseInteger(parser *Parser) ParseFn {
-	//parser.CurrentValue() == TOKEN_INTEGER_START
-	parser.Pos++
+	start := parser.Offset
+
+	// "i"
+	parser.Advance()
 
+	if !parser.Expect(TOKEN_INTEGER_VALUE) {
+		return parser.Errorf("%s, expected %s", ParseErrUnexpectedToken, TokenNames[TOKEN_INTEGER_VALUE])
+	}
 	num, err := strconv.ParseInt(string(parser.CurrentValue()), 10, 64)
 	if err != nil {
-		panic("NOT A VALID INTEGER")
+		return parser.Errorf(ParseErrInvalidInteger)
 	}
-	parser.Pos++
-	addToContainer(parser, &Container{Type: ContainerInteger, Integer: int(num)}, "")
+	if parser.Strict && !isCanonicalNumber(string(parser.CurrentValue())) {
+		return parser.Errorf(ParseErrNonCanonicalInteger)
+	}
+	parser.Advance()
 
-	if parser.CurrentType() != TOKEN_INTEGER_END {
-		panic("MISSING INTEGER END")
+	if !parser.Expect(TOKEN_INTEGER_END) {
+		return parser.Errorf(ParseErrMissingIntegerEnd)
 	}
-	parser.Pos++
+	parser.Advance()
 
-	return parseBegin
+	return addToContainer(parser, &Container{Type: ContainerInteger, Integer: num, Start: start, End: parser.Offset})
 }
 
 func parseList(parser *Parser) ParseFn {
+	start := parser.Offset
+
 	// "l"
-	parser.Pos++
+	parser.Advance()
 
 	list := make([]Container, 0)
-	addToContainer(parser, &Container{Type: ContainerList, List: &list}, "")
-
-	return parseBegin
+	return addToContainer(parser, &Container{Type: ContainerList, List: &list, Start: start})
 }
 
 func parseDict(parser *Parser) ParseFn {
+	start := parser.Offset
+
 	// "d"
-	parser.Pos++
+	parser.Advance()
 
 	dict := make(map[string]Container)
-	addToContainer(parser, &Container{Type: ContainerDict, Dict: dict}, "")
-
-	return parseBegin
+	return addToContainer(parser, &Container{Type: ContainerDict, Dict: dict, Start: start})
 }
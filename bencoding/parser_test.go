@@ -3,6 +3,7 @@ package bencoding
 import (
 	"fmt"
 	. "github.com/smartystreets/goconvey/convey"
+	"strings"
 	"testing"
 )
 
@@ -20,6 +21,8 @@ func makeResultList(vals ...interface{}) []interface{} {
 		switch val.(type) {
 		case string:
 			result = append(result, []byte(val.(string)))
+		case int:
+			result = append(result, int64(val.(int)))
 		default:
 			result = append(result, val)
 		}
@@ -33,8 +36,24 @@ Execute given tests
 func checkParseTests(tests []ParseTest) {
 	for _, test := range tests {
 		Convey(fmt.Sprintf("%s", test.Input), func() {
-			result := Parse(test.Input)
-			So(result.Output, ShouldResemble, test.Result)
+			result, err := Parse(test.Input)
+			So(err, ShouldBeNil)
+			So(result, ShouldResemble, test.Result)
+		})
+	}
+}
+
+/*
+Execute given tests, expecting each to fail with a SyntaxError
+*/
+func checkInvalidParseTests(tests []ParseTest) {
+	for _, test := range tests {
+		Convey(fmt.Sprintf("%s", test.Input), func() {
+			result, err := Parse(test.Input)
+			So(result, ShouldBeNil)
+			So(err, ShouldNotBeNil)
+			_, ok := err.(*SyntaxError)
+			So(ok, ShouldBeTrue)
 		})
 	}
 }
@@ -55,14 +74,43 @@ func TestStringParsing(t *testing.T) {
 		}, []byte("")},
 	}
 
-	invalidTests := []ParseTest{}
+	invalidTests := []ParseTest{
+		ParseTest{[]Token{
+			NewToken(TOKEN_STRING_LENGTH, "5"),
+			tColon,
+			NewToken(TOKEN_STRING_VALUE, "spam"),
+			tEOF,
+		}, nil},
+		ParseTest{[]Token{
+			NewToken(TOKEN_STRING_LENGTH, "x"),
+			tColon,
+			NewToken(TOKEN_STRING_VALUE, "spam"),
+			tEOF,
+		}, nil},
+		ParseTest{[]Token{
+			NewToken(TOKEN_STRING_LENGTH, "4"),
+			NewToken(TOKEN_STRING_VALUE, "spam"),
+			tEOF,
+		}, nil},
+		ParseTest{[]Token{
+			NewToken(TOKEN_STRING_LENGTH, "4"),
+			tColon,
+		}, nil},
+		ParseTest{[]Token{
+			NewToken(TOKEN_ERROR, LexErrUnexpectedEOF),
+		}, nil},
+		ParseTest{[]Token{
+			tEOF,
+		}, nil},
+		ParseTest{[]Token{}, nil},
+	}
 
 	Convey("Given valid inputs", t, func() {
 		checkParseTests(validTests)
 	})
 
 	Convey("Given invalid inputs", t, func() {
-		checkParseTests(invalidTests)
+		checkInvalidParseTests(invalidTests)
 	})
 
 }
@@ -74,35 +122,55 @@ func TestIntegerParsing(t *testing.T) {
 			NewToken(TOKEN_INTEGER_VALUE, "3"),
 			tIntegerEnd,
 			tEOF,
-		}, 3},
+		}, int64(3)},
 		ParseTest{[]Token{
 			tIntegerStart,
 			NewToken(TOKEN_INTEGER_VALUE, "10"),
 			tIntegerEnd,
 			tEOF,
-		}, 10},
+		}, int64(10)},
 		ParseTest{[]Token{
 			tIntegerStart,
 			NewToken(TOKEN_INTEGER_VALUE, "-1"),
 			tIntegerEnd,
 			tEOF,
-		}, -1},
+		}, int64(-1)},
 		ParseTest{[]Token{
 			tIntegerStart,
 			NewToken(TOKEN_INTEGER_VALUE, "0"),
 			tIntegerEnd,
 			tEOF,
-		}, 0},
+		}, int64(0)},
 	}
 
-	invalidTests := []ParseTest{}
+	invalidTests := []ParseTest{
+		ParseTest{[]Token{
+			tIntegerStart,
+			NewToken(TOKEN_INTEGER_VALUE, "1.1"),
+			tIntegerEnd,
+			tEOF,
+		}, nil},
+		ParseTest{[]Token{
+			tIntegerStart,
+			NewToken(TOKEN_INTEGER_VALUE, "3"),
+			tEOF,
+		}, nil},
+		ParseTest{[]Token{
+			tIntegerStart,
+			tIntegerEnd,
+			tEOF,
+		}, nil},
+		ParseTest{[]Token{
+			tIntegerStart,
+		}, nil},
+	}
 
 	Convey("Given valid inputs", t, func() {
 		checkParseTests(validTests)
 	})
 
 	Convey("Given invalid inputs", t, func() {
-		checkParseTests(invalidTests)
+		checkInvalidParseTests(invalidTests)
 	})
 
 }
@@ -161,14 +229,37 @@ func TestListParsing(t *testing.T) {
 		}, makeResultList(makeResultList(makeResultList()))},
 	}
 
-	invalidTests := []ParseTest{}
+	invalidTests := []ParseTest{
+		ParseTest{[]Token{
+			tListEnd,
+			tEOF,
+		}, nil},
+		ParseTest{[]Token{
+			tListStart,
+			tDictEnd,
+			tEOF,
+		}, nil},
+		ParseTest{[]Token{
+			tListStart,
+			tColon,
+			tListEnd,
+			tEOF,
+		}, nil},
+		ParseTest{[]Token{
+			tListStart,
+			tIntegerStart,
+			NewToken(TOKEN_INTEGER_VALUE, "1"),
+			tIntegerEnd,
+			NewToken(TOKEN_ERROR, LexErrUnclosedDelimeter),
+		}, nil},
+	}
 
 	Convey("Given valid inputs", t, func() {
 		checkParseTests(validTests)
 	})
 
 	Convey("Given invalid inputs", t, func() {
-		checkParseTests(invalidTests)
+		checkInvalidParseTests(invalidTests)
 	})
 
 }
@@ -239,17 +330,279 @@ func TestDictParsing(t *testing.T) {
 				tIntegerEnd,
 				tDictEnd,
 				tEOF,
-			}, map[string]interface{}{"dict": map[string]interface{}{"a": makeResultList(10, "b")}, "int": 99},
+			}, map[string]interface{}{"dict": map[string]interface{}{"a": makeResultList(10, "b")}, "int": int64(99)},
 		},
 	}
 
-	invalidTests := []ParseTest{}
+	invalidTests := []ParseTest{
+		ParseTest{
+			[]Token{
+				tDictStart,
+				tIntegerStart,
+				NewToken(TOKEN_INTEGER_VALUE, "1"),
+				tIntegerEnd,
+				NewToken(TOKEN_STRING_LENGTH, "3"),
+				tColon,
+				NewToken(TOKEN_STRING_VALUE, "moo"),
+				tDictEnd,
+				tEOF,
+			}, nil,
+		},
+		ParseTest{
+			[]Token{
+				tDictStart,
+				NewToken(TOKEN_STRING_LENGTH, "3"),
+				tColon,
+				NewToken(TOKEN_STRING_VALUE, "cow"),
+				tDictEnd,
+				tEOF,
+			}, nil,
+		},
+		ParseTest{
+			[]Token{
+				tDictStart,
+				NewToken(TOKEN_STRING_LENGTH, "3"),
+				tColon,
+				NewToken(TOKEN_STRING_VALUE, "cow"),
+				tListEnd,
+				tEOF,
+			}, nil,
+		},
+	}
 
 	Convey("Given valid inputs", t, func() {
 		checkParseTests(validTests)
 	})
 
 	Convey("Given invalid inputs", t, func() {
-		checkParseTests(invalidTests)
+		checkInvalidParseTests(invalidTests)
+	})
+}
+
+func TestSyntaxError(t *testing.T) {
+	Convey("Syntax errors report where parsing failed", t, func() {
+		input := "d4:infod5:filesld6:lengthi5e4:pathl1:ai1.5eeeeee"
+		lex := BeginLexing(".torrent", input, LexBegin)
+		tokens := Collect(lex)
+		// The lexer stops at "1.5", so finish the token stream by hand
+		tokens = append(tokens[:len(tokens)-1],
+			NewToken(TOKEN_INTEGER_VALUE, "1.5"),
+			tIntegerEnd,
+			tListEnd, tDictEnd, tListEnd, tDictEnd, tDictEnd, tEOF)
+
+		_, err := Parse(tokens)
+		So(err, ShouldNotBeNil)
+		syntaxErr, ok := err.(*SyntaxError)
+		So(ok, ShouldBeTrue)
+		So(syntaxErr.Msg, ShouldEqual, ParseErrInvalidInteger)
+		So(syntaxErr.Path, ShouldEqual, "info.files[0].path[1]")
+		So(syntaxErr.Offset, ShouldEqual, strings.Index(input, "1.5"))
+		So(syntaxErr.Token, ShouldEqual, len(tokens)-8)
+		So(err.Error(), ShouldContainSubstring, "info.files[0].path[1]")
+	})
+
+	Convey("Lexer errors are reported as syntax errors", t, func() {
+		lex := BeginLexing(".torrent", "l4:spamx", LexBegin)
+		_, err := Parse(Collect(lex))
+		So(err, ShouldNotBeNil)
+		syntaxErr, ok := err.(*SyntaxError)
+		So(ok, ShouldBeTrue)
+		So(syntaxErr.Msg, ShouldEqual, LexErrInvalidCharacter)
+		So(syntaxErr.Offset, ShouldEqual, 7)
+	})
+
+	Convey("Deeply nested lists are rejected", t, func() {
+		input := strings.Repeat("l", MaxNestingDepth+1) + strings.Repeat("e", MaxNestingDepth+1)
+		lex := BeginLexing(".torrent", input, LexBegin)
+		_, err := Parse(Collect(lex))
+		So(err, ShouldNotBeNil)
+		So(err.(*SyntaxError).Msg, ShouldStartWith, ParseErrNestingDepth)
+
+		input = strings.Repeat("l", MaxNestingDepth) + strings.Repeat("e", MaxNestingDepth)
+		lex = BeginLexing(".torrent", input, LexBegin)
+		_, err = Parse(Collect(lex))
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Trailing data after the root value is ignored", t, func() {
+		lex := BeginLexing(".torrent", "li1eei2e", LexBegin)
+		result, err := Parse(Collect(lex))
+		So(err, ShouldBeNil)
+		So(result, ShouldResemble, makeResultList(1))
+	})
+
+	Convey("Malformed input never panics", t, func() {
+		inputs := []string{"", "i", "l", "d", "e", "ie", "i-e", "1:", "d1:ae", "di1ei2ee", "lee", "l4:spamx", "d3:cowe", "0:0:"}
+		for _, input := range inputs {
+			So(func() {
+				lex := BeginLexing(".torrent", input, LexBegin)
+				Parse(Collect(lex))
+			}, ShouldNotPanic)
+		}
+	})
+}
+
+func parseContainerString(input string) *Container {
+	lex := BeginLexing(".torrent", input, LexBegin)
+	root, err := ParseContainer(Collect(lex))
+	So(err, ShouldBeNil)
+	return root
+}
+
+func TestRawBytes(t *testing.T) {
+	Convey("Parsed values keep their original bytes", t, func() {
+		Convey("Using artifical data", func() {
+			root := parseContainerString("d4:infod3:keyd1:x1:yee5:otherd1:a1:bee")
+			So(root.Raw, ShouldResemble, []byte("d4:infod3:keyd1:x1:yee5:otherd1:a1:bee"))
+
+			info := root.Dict["info"]
+			So(info.Raw, ShouldResemble, []byte("d3:keyd1:x1:yee"))
+			So(info.Start, ShouldEqual, 7)
+			So(info.End, ShouldEqual, 22)
+			So(info.Dict["key"].Raw, ShouldResemble, []byte("d1:x1:ye"))
+			So(info.Dict["key"].Dict["x"].Raw, ShouldResemble, []byte("1:y"))
+		})
+
+		Convey("Using data extracted from torrent file", func() {
+			input := "d8:announce39:http://torrent.ubuntu.com:6969/announce13:announce-listll39:http://torrent.ubuntu.com:6969/announceel44:http://ipv6.torrent.ubuntu.com:6969/announceee7:comment29:Ubuntu CD releases.ubuntu.com13:creation datei1406245935e4:infod6:lengthi1028653056e4:name32:ubuntu-14.04.1-desktop-amd64.iso12:piece lengthi524288eee"
+			root := parseContainerString(input)
+			So(root.Dict["info"].Raw, ShouldResemble, []byte("d6:lengthi1028653056e4:name32:ubuntu-14.04.1-desktop-amd64.iso12:piece lengthi524288ee"))
+			So(root.Dict["creation date"].Raw, ShouldResemble, []byte("i1406245935e"))
+
+			list := *root.Dict["announce-list"].List
+			So(list[1].Raw, ShouldResemble, []byte("l44:http://ipv6.torrent.ubuntu.com:6969/announcee"))
+			So((*list[1].List)[0].Start, ShouldEqual, 115)
+		})
+
+		Convey("Non-canonical input is preserved as is", func() {
+			root := parseContainerString("d1:bli1ee1:ai02ee")
+			So(root.Dict["b"].Raw, ShouldResemble, []byte("li1ee"))
+			So(root.Dict["a"].Raw, ShouldResemble, []byte("i02e"))
+
+			var raw RawMessage
+			So(Unmarshal([]byte("d1:bi1e1:ai2ee"), &raw), ShouldBeNil)
+			So(string(raw), ShouldEqual, "d1:bi1e1:ai2ee")
+		})
+
+		Convey("Unclosed containers do not panic", func() {
+			So(func() {
+				lex := BeginLexing(".torrent", "d3:fooli1e", LexBegin)
+				ParseContainer(Collect(lex))
+			}, ShouldNotPanic)
+		})
+	})
+
+	Convey("Tokens record their offset in the input", t, func() {
+		lex := BeginLexing(".torrent", "l4:spami3ee", LexBegin)
+		tokens := Collect(lex)
+		offsets := make([]int64, len(tokens))
+		for i, token := range tokens {
+			offsets[i] = token.Offset
+		}
+		So(offsets, ShouldResemble, []int64{0, 1, 2, 3, 7, 8, 9, 10, 11})
+	})
+}
+
+func TestIntegerRange(t *testing.T) {
+	Convey("Integers use the full 64-bit range", t, func() {
+		lex := BeginLexing(".torrent", "li9223372036854775807ei-9223372036854775808ei5000000000ee", LexBegin)
+		result, err := Parse(Collect(lex))
+		So(err, ShouldBeNil)
+		So(result, ShouldResemble, []interface{}{int64(9223372036854775807), int64(-9223372036854775808), int64(5000000000)})
+	})
+
+	Convey("Integers outside of the 64-bit range are rejected", t, func() {
+		lex := BeginLexing(".torrent", "i9223372036854775808e", LexBegin)
+		_, err := Parse(Collect(lex))
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestStrictParsing(t *testing.T) {
+	Convey("Non-canonical numbers are accepted by default", t, func() {
+		for _, input := range []string{"i03e", "i-0e", "i-01e", "04:spam"} {
+			lex := BeginLexing(".torrent", input, LexBegin)
+			_, err := Parse(Collect(lex))
+			So(err, ShouldBeNil)
+		}
+	})
+
+	Convey("Non-canonical numbers are rejected in strict mode", t, func() {
+		tests := map[string]string{
+			"i03e":      ParseErrNonCanonicalInteger,
+			"i-0e":      ParseErrNonCanonicalInteger,
+			"i-01e":     ParseErrNonCanonicalInteger,
+			"04:spam":   ParseErrNonCanonicalLength,
+			"l00:e":     ParseErrNonCanonicalLength,
+			"d1:ai00ee": ParseErrNonCanonicalInteger,
+		}
+		for input, msg := range tests {
+			lex := BeginLexing(".torrent", input, LexBegin)
+			_, err := ParseStrict(Collect(lex))
+			So(err, ShouldNotBeNil)
+			So(err.(*SyntaxError).Msg, ShouldEqual, msg)
+		}
+	})
+
+	Convey("Canonical input is accepted in strict mode", t, func() {
+		lex := BeginLexing(".torrent", "d1:ai0e1:bi-10e1:c0:1:dli100eee", LexBegin)
+		root, err := ParseContainerStrict(Collect(lex))
+		So(err, ShouldBeNil)
+		So(root.Dict["b"].Integer, ShouldEqual, -10)
+	})
+}
+
+func TestCanonicalValidation(t *testing.T) {
+	Convey("Non-canonical structure is accepted by default", t, func() {
+		for _, input := range []string{"d1:bi1e1:ai2ee", "d1:ai1e1:ai2ee", "i1ei2e", "le4:spam"} {
+			lex := BeginLexing(".torrent", input, LexBegin)
+			_, err := Parse(Collect(lex))
+			So(err, ShouldBeNil)
+		}
+	})
+
+	Convey("Non-canonical structure is rejected in strict mode", t, func() {
+		tests := map[string]string{
+			"d1:bi1e1:ai2ee":      ParseErrUnsortedKeys,
+			"d1:ai1e1:ai2ee":      ParseErrDuplicateKey,
+			"d1:ad1:bi1e1:ai2eee": ParseErrUnsortedKeys,
+			"d2:abi1e1:bi2ee":     "",
+			"i1ei2e":              ParseErrTrailingData,
+			"le4:spam":            ParseErrTrailingData,
+		}
+		for input, msg := range tests {
+			lex := BeginLexing(".torrent", input, LexBegin)
+			_, err := ParseStrict(Collect(lex))
+			if msg == "" {
+				So(err, ShouldBeNil)
+				continue
+			}
+			So(err, ShouldNotBeNil)
+			So(err.(*SyntaxError).Msg, ShouldEqual, msg)
+		}
+	})
+
+	Convey("Unsorted keys report the path of the offending key", t, func() {
+		lex := BeginLexing(".torrent", "d4:infod4:name1:a6:length1:bee", LexBegin)
+		_, err := ParseStrict(Collect(lex))
+		So(err, ShouldNotBeNil)
+		So(err.(*SyntaxError).Path, ShouldEqual, "info.length")
+	})
+
+	Convey("Unclosed containers are rejected in strict mode", t, func() {
+		tokens := []Token{tListStart, tIntegerStart, NewToken(TOKEN_INTEGER_VALUE, "1"), tIntegerEnd, tEOF}
+		_, err := Parse(tokens)
+		So(err, ShouldBeNil)
+		_, err = ParseStrict(tokens)
+		So(err, ShouldNotBeNil)
+		So(err.(*SyntaxError).Msg, ShouldEqual, ParseErrUnexpectedEOF)
+	})
+
+	Convey("Unmarshaling in strict mode", t, func() {
+		var dict map[string]int
+		So(Unmarshal([]byte("d1:bi1e1:ai2ee"), &dict), ShouldBeNil)
+		So(UnmarshalStrict([]byte("d1:bi1e1:ai2ee"), &dict), ShouldNotBeNil)
+		So(UnmarshalStrict([]byte("d1:ai2e1:bi1ee"), &dict), ShouldBeNil)
+		So(dict, ShouldResemble, map[string]int{"a": 2, "b": 1})
 	})
 }
@@ -0,0 +1,83 @@
+package bencoding
+
+/*
+Get looks up a nested value by following path, where each element is
+either a string key into a dictionary or an int index into a list,
+e.g. c.Get("info", "files", 0, "length"). It returns false if any
+step of the path does not exist or has an unexpected type.
+
+The accessors use value receivers so that they can be chained on the
+result of Get.
+*/
+func (c Container) Get(path ...interface{}) (Container, bool) {
+	current := c
+	for _, step := range path {
+		switch step := step.(type) {
+		case string:
+			if current.Type != ContainerDict {
+				return Container{}, false
+			}
+			next, ok := current.Dict[step]
+			if !ok {
+				return Container{}, false
+			}
+			current = next
+		case int:
+			if current.Type != ContainerList || current.List == nil || step < 0 || step >= len(*current.List) {
+				return Container{}, false
+			}
+			current = (*current.List)[step]
+		default:
+			return Container{}, false
+		}
+	}
+	return current, true
+}
+
+/*
+AsInt returns the value of an integer Container.
+*/
+func (c Container) AsInt() (int64, bool) {
+	if c.Type != ContainerInteger {
+		return 0, false
+	}
+	return c.Integer, true
+}
+
+/*
+AsBytes returns the value of a byte string Container.
+*/
+func (c Container) AsBytes() ([]byte, bool) {
+	if c.Type != ContainerBString || c.BString == nil {
+		return nil, false
+	}
+	return c.BString, true
+}
+
+/*
+AsString returns the value of a byte string Container as a string.
+*/
+func (c Container) AsString() (string, bool) {
+	b, ok := c.AsBytes()
+	return string(b), ok
+}
+
+/*
+AsList returns the items of a list Container.
+*/
+func (c Container) AsList() ([]Container, bool) {
+	if c.Type != ContainerList || c.List == nil {
+		return nil, false
+	}
+	return *c.List, true
+}
+
+/*
+AsDict returns the entries of a dictionary Container.
+*/
+func (c Container) AsDict() (map[string]Container, bool) {
+	if c.Type != ContainerDict || c.Dict == nil {
+		return nil, false
+	}
+	return c.Dict, true
+}
@@ -0,0 +1,73 @@
+package bencoding
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestQuery(t *testing.T) {
+	input := "d8:announce3:url4:infod5:filesld6:lengthi5e4:pathl1:a5:b.txteed6:lengthi3e4:pathl1:ceee4:name4:testee"
+	lex := BeginLexing(".torrent", input, LexBegin)
+	root, err := ParseContainer(Collect(lex))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Getting nested values by path", t, func() {
+		length, ok := root.Get("info", "files", 1, "length")
+		So(ok, ShouldBeTrue)
+		n, ok := length.AsInt()
+		So(ok, ShouldBeTrue)
+		So(n, ShouldEqual, 3)
+
+		name, ok := root.Get("info", "files", 0, "path", 1)
+		So(ok, ShouldBeTrue)
+		s, ok := name.AsString()
+		So(ok, ShouldBeTrue)
+		So(s, ShouldEqual, "b.txt")
+
+		self, ok := root.Get()
+		So(ok, ShouldBeTrue)
+		So(self.Type, ShouldEqual, ContainerDict)
+	})
+
+	Convey("Getting missing or mistyped paths", t, func() {
+		paths := [][]interface{}{
+			{"missing"},
+			{"info", "files", 2},
+			{"info", "files", -1},
+			{"info", "files", "0"},
+			{"announce", 0},
+			{"info", 1.5},
+		}
+		for _, path := range paths {
+			_, ok := root.Get(path...)
+			So(ok, ShouldBeFalse)
+		}
+	})
+
+	Convey("Converting values to the wrong type", t, func() {
+		announce, _ := root.Get("announce")
+		_, ok := announce.AsInt()
+		So(ok, ShouldBeFalse)
+		_, ok = announce.AsList()
+		So(ok, ShouldBeFalse)
+		_, ok = announce.AsDict()
+		So(ok, ShouldBeFalse)
+		b, ok := announce.AsBytes()
+		So(ok, ShouldBeTrue)
+		So(b, ShouldResemble, []byte("url"))
+
+		files, _ := root.Get("info", "files")
+		list, ok := files.AsList()
+		So(ok, ShouldBeTrue)
+		So(list, ShouldHaveLength, 2)
+		_, ok = files.AsString()
+		So(ok, ShouldBeFalse)
+
+		info, _ := root.Get("info")
+		dict, ok := info.AsDict()
+		So(ok, ShouldBeTrue)
+		So(dict, ShouldHaveLength, 2)
+	})
+}
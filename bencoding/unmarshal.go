@@ -0,0 +1,300 @@
+package bencoding
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+/*
+Unmarshaler is implemented by types that can decode a bencoded
+representation of themselves. UnmarshalBencode receives the encoded
+bytes of a single value and must copy them if it wishes to retain them.
+*/
+type Unmarshaler interface {
+	UnmarshalBencode([]byte) error
+}
+
+/*
+RawMessage is a raw encoded bencode value. It can be used to delay
+decoding of part of a message, or to keep the encoded form of a
+sub-value around, e.g. to hash it.
+*/
+type RawMessage []byte
+
+func (m RawMessage) MarshalBencode() ([]byte, error) {
+	if m == nil {
+		return nil, ErrNilValue
+	}
+	return m, nil
+}
+
+func (m *RawMessage) UnmarshalBencode(data []byte) error {
+	*m = append((*m)[0:0], data...)
+	return nil
+}
+
+/*
+InvalidUnmarshalError is returned when Unmarshal is not given a
+non-nil pointer to decode into.
+*/
+type InvalidUnmarshalError struct {
+	Type reflect.Type
+}
+
+func (e *InvalidUnmarshalError) Error() string {
+	if e.Type == nil {
+		return "Unmarshal(nil)"
+	}
+	if e.Type.Kind() != reflect.Ptr {
+		return "Unmarshal(non-pointer " + e.Type.String() + ")"
+	}
+	return "Unmarshal(nil " + e.Type.String() + ")"
+}
+
+/*
+UnmarshalTypeError describes a bencoded value that could not be
+stored in a Go value of the given type. Field is the path of the
+value within the document, e.g. "info.files[2].length".
+*/
+type UnmarshalTypeError struct {
+	Value string
+	Type  reflect.Type
+	Field string
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	if e.Field == "" {
+		return "Cannot unmarshal " + e.Value + " into Go value of type " + e.Type.String()
+	}
+	return "Cannot unmarshal " + e.Value + " into Go struct field " + e.Field + " of type " + e.Type.String()
+}
+
+var ContainerTypeNames = map[ContainerType]string{
+	ContainerBString: "string",
+	ContainerInteger: "integer",
+	ContainerList:    "list",
+	ContainerDict:    "dict",
+}
+
+/*
+Unmarshal parses the bencoded data and stores the result in the
+value pointed to by v, following the same struct tag rules as Marshal.
+
+Byte strings decode into strings, []byte and byte arrays of the exact
+same length; integers decode into any integer type or bool; lists
+decode into slices and arrays; dictionaries decode into structs and
+maps with string keys. Dictionary keys with no matching struct field
+are ignored. Decoding into an interface{} stores the same values as
+Container.Collapse, and decoding into a Container stores the parsed
+container itself. The byte strings of those two share the memory of
+data rather than copying it.
+*/
+func Unmarshal(data []byte, v interface{}) error {
+	return unmarshal(data, v, ParseContainer)
+}
+
+/*
+UnmarshalStrict is like Unmarshal, but fails unless data is canonical
+bencoding, as checked by ParseStrict.
+*/
+func UnmarshalStrict(data []byte, v interface{}) error {
+	return unmarshal(data, v, ParseContainerStrict)
+}
+
+func unmarshal(data []byte, v interface{}, parse func([]Token) (*Container, error)) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &InvalidUnmarshalError{reflect.TypeOf(v)}
+	}
+
+	lex := BeginLexingBytes("unmarshal", data, LexBegin)
+	root, err := parse(Collect(lex))
+	if err != nil {
+		return err
+	}
+
+	return unmarshalContainer(root, rv, "")
+}
+
+var (
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+)
+
+func unmarshalContainer(c *Container, v reflect.Value, path string) error {
+	// Allocate through pointers, stopping at the first Unmarshaler
+	for {
+		if v.Kind() != reflect.Ptr && v.CanAddr() && v.Addr().Type().Implements(unmarshalerType) {
+			v = v.Addr()
+			break
+		}
+		if v.Kind() != reflect.Ptr {
+			break
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		if v.Type().Implements(unmarshalerType) {
+			break
+		}
+		v = v.Elem()
+	}
+
+	if v.Type().Implements(unmarshalerType) {
+		// Containers built by hand have no original bytes, so fall
+		// back to their canonical encoding.
+		raw := c.Raw
+		if raw == nil {
+			var err error
+			if raw, err = Marshal(*c); err != nil {
+				return err
+			}
+		}
+		return v.Interface().(Unmarshaler).UnmarshalBencode(raw)
+	}
+
+	if v.Type() == containerType {
+		v.Set(reflect.ValueOf(*c))
+		return nil
+	}
+
+	typeError := func() error {
+		return &UnmarshalTypeError{Value: ContainerTypeNames[c.Type], Type: v.Type(), Field: path}
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return typeError()
+		}
+		v.Set(reflect.ValueOf(c.Collapse()))
+	case reflect.String:
+		if c.Type != ContainerBString {
+			return typeError()
+		}
+		v.SetString(string(c.BString))
+	case reflect.Bool:
+		if c.Type != ContainerInteger {
+			return typeError()
+		}
+		v.SetBool(c.Integer != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if c.Type != ContainerInteger {
+			return typeError()
+		}
+		n := c.Integer
+		if v.OverflowInt(n) {
+			return &UnmarshalTypeError{Value: "integer " + strconv.FormatInt(n, 10), Type: v.Type(), Field: path}
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if c.Type != ContainerInteger {
+			return typeError()
+		}
+		n := c.Integer
+		if n < 0 || v.OverflowUint(uint64(n)) {
+			return &UnmarshalTypeError{Value: "integer " + strconv.FormatInt(n, 10), Type: v.Type(), Field: path}
+		}
+		v.SetUint(uint64(n))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if c.Type != ContainerBString {
+				return typeError()
+			}
+			b := make([]byte, len(c.BString))
+			copy(b, c.BString)
+			v.SetBytes(b)
+			return nil
+		}
+		if c.Type != ContainerList {
+			return typeError()
+		}
+		items := *c.List
+		slice := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i := range items {
+			if err := unmarshalContainer(&items[i], slice.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if c.Type != ContainerBString || len(c.BString) != v.Len() {
+				return typeError()
+			}
+			reflect.Copy(v, reflect.ValueOf(c.BString))
+			return nil
+		}
+		if c.Type != ContainerList || len(*c.List) != v.Len() {
+			return typeError()
+		}
+		items := *c.List
+		for i := range items {
+			if err := unmarshalContainer(&items[i], v.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if c.Type != ContainerDict || v.Type().Key().Kind() != reflect.String {
+			return typeError()
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for key, val := range c.Dict {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := unmarshalContainer(&val, elem, joinPath(path, key)); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+		}
+	case reflect.Struct:
+		if c.Type != ContainerDict {
+			return typeError()
+		}
+		for _, field := range structFields(v.Type()) {
+			val, ok := c.Dict[field.name]
+			if !ok {
+				continue
+			}
+			fv, err := allocFieldByIndex(v, field.index)
+			if err != nil {
+				return err
+			}
+			if err := unmarshalContainer(&val, fv, joinPath(path, field.name)); err != nil {
+				return err
+			}
+		}
+	default:
+		return typeError()
+	}
+	return nil
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+/*
+allocFieldByIndex returns the struct field at index, allocating any
+nil embedded struct pointers along the way.
+*/
+func allocFieldByIndex(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return v, errors.New("Cannot set embedded pointer to unexported struct: " + v.Type().Elem().String())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
@@ -0,0 +1,149 @@
+package bencoding
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"testing"
+)
+
+type unmarshalFile struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+	MD5Sum string   `bencode:"md5sum,omitempty"`
+}
+
+type unmarshalInfo struct {
+	Name        string          `bencode:"name"`
+	PieceLength int64           `bencode:"piece length"`
+	Pieces      []byte          `bencode:"pieces"`
+	Private     bool            `bencode:"private"`
+	Length      int64           `bencode:"length,omitempty"`
+	Files       []unmarshalFile `bencode:"files"`
+}
+
+type unmarshalTorrent struct {
+	Announce     string        `bencode:"announce"`
+	AnnounceList [][]string    `bencode:"announce-list"`
+	CreationDate int64         `bencode:"creation date"`
+	Info         unmarshalInfo `bencode:"info"`
+	RawInfo      RawMessage    `bencode:"info"`
+}
+
+func TestUnmarshal(t *testing.T) {
+	Convey("Unmarshaling basic values", t, func() {
+		var s string
+		So(Unmarshal([]byte("4:spam"), &s), ShouldBeNil)
+		So(s, ShouldEqual, "spam")
+
+		var b []byte
+		So(Unmarshal([]byte("4:eggs"), &b), ShouldBeNil)
+		So(b, ShouldResemble, []byte("eggs"))
+
+		var a [4]byte
+		So(Unmarshal([]byte("4:abcd"), &a), ShouldBeNil)
+		So(a, ShouldResemble, [4]byte{'a', 'b', 'c', 'd'})
+
+		var n int64
+		So(Unmarshal([]byte("i-42e"), &n), ShouldBeNil)
+		So(n, ShouldEqual, -42)
+
+		var flag bool
+		So(Unmarshal([]byte("i1e"), &flag), ShouldBeNil)
+		So(flag, ShouldBeTrue)
+
+		var list []int
+		So(Unmarshal([]byte("li1ei2ei3ee"), &list), ShouldBeNil)
+		So(list, ShouldResemble, []int{1, 2, 3})
+
+		var dict map[string]string
+		So(Unmarshal([]byte("d3:cow3:moo4:spam4:eggse"), &dict), ShouldBeNil)
+		So(dict, ShouldResemble, map[string]string{"cow": "moo", "spam": "eggs"})
+
+		var any interface{}
+		So(Unmarshal([]byte("l4:spami10ee"), &any), ShouldBeNil)
+		So(any, ShouldResemble, makeResultList("spam", 10))
+
+		var c Container
+		So(Unmarshal([]byte("i7e"), &c), ShouldBeNil)
+		So(c.Type, ShouldEqual, ContainerInteger)
+		So(c.Integer, ShouldEqual, 7)
+
+		var p *string
+		So(Unmarshal([]byte("4:spam"), &p), ShouldBeNil)
+		So(*p, ShouldEqual, "spam")
+	})
+
+	Convey("Unmarshaling nested structs with tags", t, func() {
+		input := "d8:announce3:url13:announce-listll1:a1:bel1:cee13:creation datei1400000000e4:infod5:filesld6:lengthi5e4:pathl1:a5:b.txteed6:lengthi3e6:md5sum3:abc4:pathl1:ceee4:name4:test12:piece lengthi16384e6:pieces4:abcd7:privatei1eee"
+		torrent := &unmarshalTorrent{}
+		So(Unmarshal([]byte(input), torrent), ShouldBeNil)
+		So(torrent.Announce, ShouldEqual, "url")
+		So(torrent.AnnounceList, ShouldResemble, [][]string{[]string{"a", "b"}, []string{"c"}})
+		So(torrent.CreationDate, ShouldEqual, 1400000000)
+		So(torrent.Info.Name, ShouldEqual, "test")
+		So(torrent.Info.PieceLength, ShouldEqual, 16384)
+		So(torrent.Info.Pieces, ShouldResemble, []byte("abcd"))
+		So(torrent.Info.Private, ShouldBeTrue)
+		So(torrent.Info.Files, ShouldResemble, []unmarshalFile{
+			unmarshalFile{Length: 5, Path: []string{"a", "b.txt"}},
+			unmarshalFile{Length: 3, Path: []string{"c"}, MD5Sum: "abc"},
+		})
+
+		var info unmarshalInfo
+		So(Unmarshal(torrent.RawInfo, &info), ShouldBeNil)
+		So(info, ShouldResemble, torrent.Info)
+
+		result, err := Marshal(torrent.Info)
+		So(err, ShouldBeNil)
+		So(string(torrent.RawInfo), ShouldEqual, string(result))
+	})
+
+	Convey("Unmarshaling a torrent file", t, func() {
+		data, err := ioutil.ReadFile("../testfiles/ubuntu.torrent")
+		So(err, ShouldBeNil)
+		torrent := &unmarshalTorrent{}
+		So(Unmarshal(data, torrent), ShouldBeNil)
+		So(torrent.Announce, ShouldEqual, "http://torrent.ubuntu.com:6969/announce")
+		So(torrent.Info.Name, ShouldEqual, "ubuntu-14.04.1-desktop-amd64.iso")
+		So(torrent.Info.Length, ShouldEqual, 1028653056)
+		So(len(torrent.Info.Pieces), ShouldEqual, 39240)
+	})
+
+	Convey("Unmarshaling into mismatched types", t, func() {
+		var n int
+		err := Unmarshal([]byte("4:spam"), &n)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "string")
+
+		var small int8
+		err = Unmarshal([]byte("i1000e"), &small)
+		So(err, ShouldNotBeNil)
+
+		var u uint
+		err = Unmarshal([]byte("i-1e"), &u)
+		So(err, ShouldNotBeNil)
+
+		var a [2]byte
+		err = Unmarshal([]byte("3:abc"), &a)
+		So(err, ShouldNotBeNil)
+
+		torrent := &unmarshalTorrent{}
+		err = Unmarshal([]byte("d4:infod5:filesld6:lengthi5e4:pathl1:ai1eeeeee"), torrent)
+		So(err, ShouldNotBeNil)
+		typeErr, ok := err.(*UnmarshalTypeError)
+		So(ok, ShouldBeTrue)
+		So(typeErr.Field, ShouldEqual, "info.files[0].path[1]")
+	})
+
+	Convey("Unmarshaling requires a non-nil pointer", t, func() {
+		var s string
+		So(Unmarshal([]byte("4:spam"), s), ShouldNotBeNil)
+		So(Unmarshal([]byte("4:spam"), nil), ShouldNotBeNil)
+	})
+
+	Convey("Unmarshaling invalid input", t, func() {
+		var s string
+		So(Unmarshal([]byte("5:spam"), &s), ShouldNotBeNil)
+		So(Unmarshal([]byte(""), &s), ShouldNotBeNil)
+	})
+}
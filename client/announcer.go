@@ -0,0 +1,248 @@
+package client
+
+import (
+	"errors"
+	"github.com/stratospark/torro/structure"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	ErrReannounceTooSoon = errors.New("Tracker Minimum Interval Has Not Passed")
+	ErrAnnouncerStopped  = errors.New("Announcer Is Stopped")
+)
+
+/*
+AnnounceStats are the transfer counters reported to the tracker.
+*/
+type AnnounceStats struct {
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+}
+
+/*
+Announcer keeps a single torrent announced to its trackers. It sends
+started when it is started, regular announces every Interval given by
+the tracker, completed when the download finishes and stopped when it
+is stopped. Failed announces are retried with exponential backoff,
+from MinBackoff up to MaxBackoff.
+
+Stats is called before every announce to get the live counters. Each
+successful response is delivered on Responses, and the error of each
+failed announce on Errors; a response or error that has not been
+received yet is replaced by a newer one.
+*/
+type Announcer struct {
+	Client          *TrackerClient
+	Request         *structure.TrackerRequest
+	Stats           func() AnnounceStats
+	Responses       chan *structure.TrackerResponse
+	Errors          chan error
+	DefaultInterval time.Duration
+	MinBackoff      time.Duration
+	MaxBackoff      time.Duration
+
+	// second is the unit of the tracker's intervals, shortened in tests
+	second time.Duration
+
+	// runOnce makes sure that run is started at most once, and never
+	// after Stop
+	runOnce      sync.Once
+	reannounceCh chan chan error
+	completeCh   chan bool
+	stopCh       chan bool
+	doneCh       chan bool
+}
+
+func NewAnnouncer(tc *TrackerClient, req *structure.TrackerRequest, stats func() AnnounceStats) *Announcer {
+	return &Announcer{
+		Client:          tc,
+		Request:         req,
+		Stats:           stats,
+		Responses:       make(chan *structure.TrackerResponse, 1),
+		Errors:          make(chan error, 1),
+		DefaultInterval: 30 * time.Minute,
+		MinBackoff:      15 * time.Second,
+		MaxBackoff:      30 * time.Minute,
+		second:          time.Second,
+		reannounceCh:    make(chan chan error),
+		completeCh:      make(chan bool),
+		stopCh:          make(chan bool),
+		doneCh:          make(chan bool),
+	}
+}
+
+/*
+Start announces started on a new goroutine and keeps announcing until
+Stop is called.
+*/
+func (a *Announcer) Start() {
+	a.runOnce.Do(func() {
+		go a.run()
+	})
+}
+
+/*
+Reannounce announces right away, unless the tracker's minimum interval
+has not passed since the last announce.
+*/
+func (a *Announcer) Reannounce() error {
+	reply := make(chan error, 1)
+	select {
+	case a.reannounceCh <- reply:
+		return <-reply
+	case <-a.doneCh:
+		return ErrAnnouncerStopped
+	}
+}
+
+/*
+Complete announces completed once the download has finished.
+*/
+func (a *Announcer) Complete() {
+	select {
+	case a.completeCh <- true:
+	case <-a.doneCh:
+	}
+}
+
+/*
+Stop announces stopped and waits for the announcer to finish. If the
+announcer was never started, Stop just keeps it from starting.
+*/
+func (a *Announcer) Stop() {
+	a.runOnce.Do(func() {
+		close(a.doneCh)
+	})
+	select {
+	case a.stopCh <- true:
+		<-a.doneCh
+	case <-a.doneCh:
+	}
+}
+
+func (a *Announcer) run() {
+	defer close(a.doneCh)
+
+	// event is the event to send with the next announce. It is only
+	// cleared once the tracker has received it.
+	event := TrackerRequestStarted
+	started := false
+	failures := 0
+	var minInterval time.Duration
+	var lastAnnounce time.Time
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	announce := func() {
+		lastAnnounce = time.Now()
+		tr, err := a.announce(event)
+		if err != nil {
+			failures++
+			timer.Reset(a.backoff(failures))
+			a.deliverError(err)
+			return
+		}
+		failures = 0
+		if event == TrackerRequestStarted {
+			started = true
+		}
+		event = ""
+
+		interval := time.Duration(tr.Interval) * a.second
+		if interval <= 0 {
+			interval = a.DefaultInterval
+		}
+		minInterval = time.Duration(tr.MinInterval) * a.second
+		timer.Reset(interval)
+		a.deliver(tr)
+	}
+
+	for {
+		select {
+		case <-timer.C:
+			announce()
+		case reply := <-a.reannounceCh:
+			if time.Since(lastAnnounce) < minInterval {
+				reply <- ErrReannounceTooSoon
+				continue
+			}
+			reply <- nil
+			stopTimer(timer)
+			announce()
+		case <-a.completeCh:
+			// A torrent completed before started reached the tracker
+			// is announced with nothing left, so completed is not sent
+			if !started {
+				continue
+			}
+			event = TrackerRequestCompleted
+			stopTimer(timer)
+			announce()
+		case <-a.stopCh:
+			if started {
+				a.announce(TrackerRequestStopped)
+			}
+			return
+		}
+	}
+}
+
+func (a *Announcer) announce(event TrackerRequestEvent) (*structure.TrackerResponse, error) {
+	if a.Stats != nil {
+		stats := a.Stats()
+		a.Request.Uploaded = stats.Uploaded
+		a.Request.Downloaded = stats.Downloaded
+		left := stats.Left
+		a.Request.Remaining = &left
+	}
+
+	tr, err := a.Client.Announce(a.Request, event)
+	if err != nil {
+		log.Printf("Announcer, %q announce failed: %s", event, err)
+	}
+	return tr, err
+}
+
+/*
+backoff is the delay before retrying after the given number of
+consecutive failures.
+*/
+func (a *Announcer) backoff(failures int) time.Duration {
+	delay := a.MinBackoff
+	for i := 1; i < failures && delay < a.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > a.MaxBackoff {
+		delay = a.MaxBackoff
+	}
+	return delay
+}
+
+func (a *Announcer) deliver(tr *structure.TrackerResponse) {
+	select {
+	case <-a.Responses:
+	default:
+	}
+	a.Responses <- tr
+}
+
+func (a *Announcer) deliverError(err error) {
+	select {
+	case <-a.Errors:
+	default:
+	}
+	a.Errors <- err
+}
+
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package client
+
+import (
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/stratospark/torro/structure"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+fakeHTTPTracker records the event and counters of every announce and
+answers with the given intervals, failing the first fail announces.
+*/
+type fakeHTTPTracker struct {
+	Server *httptest.Server
+
+	mu        sync.Mutex
+	fail      int
+	response  string
+	events    []string
+	uploaded  []string
+	remaining []string
+}
+
+func newFakeHTTPTracker(interval, minInterval, fail int) *fakeHTTPTracker {
+	t := &fakeHTTPTracker{
+		fail:     fail,
+		response: fmt.Sprintf("d8:completei1e10:incompletei2e8:intervali%de12:min intervali%de5:peers0:e", interval, minInterval),
+	}
+	t.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		query := r.URL.Query()
+		t.events = append(t.events, query.Get("event"))
+		t.uploaded = append(t.uploaded, query.Get("uploaded"))
+		t.remaining = append(t.remaining, query.Get("left"))
+		if t.fail > 0 {
+			t.fail--
+			fmt.Fprint(w, "d14:failure reason4:busye")
+			return
+		}
+		fmt.Fprint(w, t.response)
+	}))
+	return t
+}
+
+func (t *fakeHTTPTracker) Events() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string{}, t.events...)
+}
+
+/*
+WaitForEvents waits until at least n announces have been received.
+*/
+func (t *fakeHTTPTracker) WaitForEvents(n int) []string {
+	deadline := time.Now().Add(2 * time.Second)
+	for len(t.Events()) < n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	return t.Events()
+}
+
+func newTestAnnouncer(tracker *fakeHTTPTracker, stats func() AnnounceStats) *Announcer {
+	metainfo, _ := structure.NewMetainfo("../testfiles/kali-linux-2.0-i386.iso.torrent")
+	req := structure.NewTrackerRequest(metainfo)
+	req.Tiers = structure.AnnounceList{[]string{tracker.Server.URL}}
+
+	tc := NewTrackerClient()
+	tc.HTTP = &http.Client{}
+	a := NewAnnouncer(tc, req, stats)
+	a.second = time.Millisecond
+	a.MinBackoff = time.Millisecond
+	a.MaxBackoff = 4 * time.Millisecond
+	return a
+}
+
+func TestAnnouncer(t *testing.T) {
+	Convey("Announcing started, regular announces, completed and stopped", t, func() {
+		tracker := newFakeHTTPTracker(10, 0, 0)
+		defer tracker.Server.Close()
+
+		var mu sync.Mutex
+		stats := AnnounceStats{Uploaded: 1, Left: 100}
+		a := newTestAnnouncer(tracker, func() AnnounceStats {
+			mu.Lock()
+			defer mu.Unlock()
+			return stats
+		})
+		a.Start()
+
+		tr := <-a.Responses
+		So(tr.Interval, ShouldEqual, 10)
+		So(tracker.WaitForEvents(3)[:3], ShouldResemble, []string{"started", "", ""})
+
+		mu.Lock()
+		stats = AnnounceStats{Uploaded: 2, Downloaded: 100, Left: 0}
+		mu.Unlock()
+		a.Complete()
+		a.Stop()
+
+		events := tracker.Events()
+		So(events[len(events)-2:], ShouldResemble, []string{"completed", "stopped"})
+		tracker.mu.Lock()
+		So(tracker.uploaded[0], ShouldEqual, "1")
+		So(tracker.remaining[0], ShouldEqual, "100")
+		So(tracker.uploaded[len(events)-1], ShouldEqual, "2")
+		So(tracker.remaining[len(events)-1], ShouldEqual, "0")
+		tracker.mu.Unlock()
+
+		So(a.Reannounce(), ShouldEqual, ErrAnnouncerStopped)
+	})
+
+	Convey("Honoring the minimum interval for manual reannounces", t, func() {
+		tracker := newFakeHTTPTracker(100000, 100000, 0)
+		defer tracker.Server.Close()
+
+		a := newTestAnnouncer(tracker, nil)
+		a.Start()
+		<-a.Responses
+		So(a.Reannounce(), ShouldEqual, ErrReannounceTooSoon)
+		a.Stop()
+		So(tracker.Events(), ShouldResemble, []string{"started", "stopped"})
+
+		tracker = newFakeHTTPTracker(100000, 0, 0)
+		defer tracker.Server.Close()
+
+		a = newTestAnnouncer(tracker, nil)
+		a.Start()
+		<-a.Responses
+		So(a.Reannounce(), ShouldBeNil)
+		<-a.Responses
+		a.Stop()
+		So(tracker.Events(), ShouldResemble, []string{"started", "", "stopped"})
+	})
+
+	Convey("Retrying failed announces with backoff", t, func() {
+		tracker := newFakeHTTPTracker(100000, 0, 3)
+		defer tracker.Server.Close()
+
+		a := newTestAnnouncer(tracker, nil)
+		a.Start()
+		<-a.Responses
+		a.Stop()
+		So(tracker.Events(), ShouldResemble, []string{"started", "started", "started", "started", "stopped"})
+		err := <-a.Errors
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "busy")
+
+		So(a.backoff(1), ShouldEqual, time.Millisecond)
+		So(a.backoff(2), ShouldEqual, 2*time.Millisecond)
+		So(a.backoff(3), ShouldEqual, 4*time.Millisecond)
+		So(a.backoff(30), ShouldEqual, 4*time.Millisecond)
+	})
+
+	Convey("Not sending stopped when started never succeeded", t, func() {
+		tracker := newFakeHTTPTracker(100000, 0, 1000)
+		defer tracker.Server.Close()
+
+		a := newTestAnnouncer(tracker, nil)
+		a.Start()
+		tracker.WaitForEvents(2)
+		a.Complete()
+		a.Stop()
+		for _, event := range tracker.Events() {
+			So(event, ShouldEqual, "started")
+		}
+	})
+	Convey("Stopping an announcer that was never started", t, func() {
+		tracker := newFakeHTTPTracker(100000, 0, 0)
+		defer tracker.Server.Close()
+
+		a := newTestAnnouncer(tracker, nil)
+		a.Stop()
+		a.Stop()
+		a.Start()
+		So(a.Reannounce(), ShouldEqual, ErrAnnouncerStopped)
+		So(tracker.Events(), ShouldBeEmpty)
+	})
+}
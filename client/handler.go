@@ -6,6 +6,7 @@ import (
 	"log"
 	"net"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -30,13 +31,19 @@ type BTConn struct {
 	AmInterested   bool
 	PeerChoking    bool
 	PeerInterested bool
-	Hash           string
+	Hash           structure.InfoHash
 	BitField       *structure.BitField
 	PeerID         string
 	HandshakeChan  chan bool
 	MessageChan    chan bool
 	WriteChan      chan structure.Message
 	DisconnectChan chan bool
+	// PeerExtensions are the extended message IDs of the peer, from its
+	// extended handshake (BEP 10)
+	PeerExtensions map[string]int
+
+	service  *BTService
+	metadata *structure.MetadataAssembler
 }
 
 func NewBTConn(conn Connection, addr string) *BTConn {
@@ -83,7 +90,7 @@ Handler specifies the interface of a locally running BitTorrent client
 */
 type Handler interface {
 	StartListening(chan BTConn, error)
-	AddHash([]byte)
+	AddHash(structure.InfoHash)
 }
 
 type BTState int
@@ -122,8 +129,17 @@ type BTService struct {
 	DisconnectChan    chan bool
 	Port              int
 	Peers             map[*BTConn]BTState
-	Hashes            map[string]bool
+	Hashes            map[structure.InfoHash]bool
 	PeerID            []byte
+	// ExternalIP is our address as seen by other peers, if known, so
+	// that we do not connect to ourselves when a tracker lists us
+	ExternalIP net.IP
+	// MetainfoChan receives the Metainfo of each torrent added with
+	// AddMagnet once its metadata has been fetched from a peer
+	MetainfoChan chan *structure.Metainfo
+
+	magnetsMu sync.Mutex
+	magnets   map[structure.InfoHash]*structure.Magnet
 }
 
 /*
@@ -140,8 +156,10 @@ func NewBTService(port int, peerId []byte) *BTService {
 		DisconnectChan:    make(chan bool, 1),
 		Port:              port,
 		Peers:             make(map[*BTConn]BTState),
-		Hashes:            make(map[string]bool),
+		Hashes:            make(map[structure.InfoHash]bool),
 		PeerID:            peerId,
+		MetainfoChan:      make(chan *structure.Metainfo, 1),
+		magnets:           make(map[structure.InfoHash]*structure.Magnet),
 	}
 	return s
 }
@@ -193,13 +211,34 @@ func (s *BTService) StartListening() (err error) {
 	return nil
 }
 
-func (s *BTService) AddHash(h []byte) {
-	s.Hashes[string(h)] = true
+func (s *BTService) AddHash(h structure.InfoHash) {
+	s.Hashes[h] = true
+}
+
+/*
+AddMagnet adds the torrent of a magnet link. Its metadata is fetched
+from the first peer that has it, and its Metainfo is then sent on
+MetainfoChan, which must be received from for every magnet added.
+*/
+func (s *BTService) AddMagnet(m *structure.Magnet) {
+	s.magnetsMu.Lock()
+	s.magnets[m.InfoHash] = m
+	s.magnetsMu.Unlock()
+	s.AddHash(m.InfoHash)
+}
+
+func (s *BTService) magnet(h structure.InfoHash) *structure.Magnet {
+	s.magnetsMu.Lock()
+	defer s.magnetsMu.Unlock()
+	return s.magnets[h]
 }
 
-func (s *BTService) InitiateHandshakes(hash []byte, peers []structure.Peer) {
+func (s *BTService) InitiateHandshakes(hash structure.InfoHash, peers []structure.Peer) {
 	for _, peer := range peers {
-		addr := fmt.Sprintf("%q:%d", peer.IP, peer.Port)
+		if s.isSelf(peer) {
+			continue
+		}
+		addr := peer.AddrString()
 		log.Printf("[InitiateHandshakes] Address: %q", addr)
 		btc, err := s.ConnectionFetcher.Dial(addr)
 		if err != nil {
@@ -207,14 +246,22 @@ func (s *BTService) InitiateHandshakes(hash []byte, peers []structure.Peer) {
 			continue
 		}
 		hs, _ := structure.NewHandshake(hash, s.PeerID)
+		hs.SetExtensions()
 		btc.Write(hs.Bytes())
-		btc.Hash = string(hash)
+		btc.Hash = hash
 		btc.State = BTStateWaitingForHandshake
 		btc.handleConnection(s)
 		btc.HandshakeChan <- true
 	}
 }
 
+/*
+isSelf reports whether peer is this service, as listed by a tracker.
+*/
+func (s *BTService) isSelf(peer structure.Peer) bool {
+	return s.ExternalIP != nil && peer.IP.Equal(s.ExternalIP) && int(peer.Port) == s.Port
+}
+
 func (s *BTService) handleMessages() {
 	for {
 		select {
@@ -241,6 +288,7 @@ func (btc *BTConn) handleConnection(s *BTService) {
 	btc.DisconnectChan = make(chan bool, 1)
 	btc.WriteChan = make(chan structure.Message, 1)
 	btc.PeerID = string(s.PeerID)
+	btc.service = s
 
 	go btc.readLoop(s.AddChan, s.LeaveChan)
 	go btc.writeLoop(s.AddChan, s.LeaveChan)
@@ -262,11 +310,14 @@ func (btc *BTConn) readLoop(addChan, leaveChan chan<- *BTConn) {
 			}
 
 			log.Printf("[readLoop] State: %q", btc.State)
+			if pc, ok := structure.ParsePeerClient(string(peerHs.PeerID)); ok {
+				log.Printf("[readLoop] Peer Client: %s", pc)
+			}
 
 			switch btc.State {
 			case BTStateWaitingForHandshake:
-				log.Printf("[readLoop] HashMatch? %q === %q?", btc.Hash, string(peerHs.Hash))
-				if btc.Hash != string(peerHs.Hash) {
+				log.Printf("[readLoop] HashMatch? %s === %s?", btc.Hash, peerHs.Hash)
+				if btc.Hash != peerHs.Hash {
 					// TODO: What if same connection is handling multiple hashes?
 					log.Printf("[readLoop] Hash mismatch\n")
 					btc.Close()
@@ -274,7 +325,7 @@ func (btc *BTConn) readLoop(addChan, leaveChan chan<- *BTConn) {
 					continue
 				}
 			case BTStateStartListening:
-				log.Printf("Writing byte %q\n", btc)
+				log.Printf("Writing byte %q\n", btc.Addr)
 				respHs, err := structure.NewHandshake(peerHs.Hash, []byte(btc.PeerID))
 				log.Println("[readLoop] respHS ", respHs)
 				if err != nil {
@@ -283,7 +334,9 @@ func (btc *BTConn) readLoop(addChan, leaveChan chan<- *BTConn) {
 					leaveChan <- btc
 					continue
 				}
+				respHs.SetExtensions()
 				btc.Write(respHs.Bytes())
+				btc.Hash = peerHs.Hash
 			default:
 				log.Printf("[readLoop] BAD STATE: %d", btc.State)
 				btc.Close()
@@ -291,12 +344,24 @@ func (btc *BTConn) readLoop(addChan, leaveChan chan<- *BTConn) {
 				continue
 			}
 
+			// Extension messages may only be sent to peers that support them
+			if peerHs.SupportsExtensions() {
+				extHs, err := newExtendedHandshake()
+				if err != nil {
+					log.Printf("[readLoop] %q\n", err.Error())
+					btc.Close()
+					leaveChan <- btc
+					continue
+				}
+				btc.WriteChan <- extHs
+			}
+
 			addChan <- btc
 			log.Printf("AAAAAAAAAAAAAAAAAAAAAAAA: %q", btc.Addr)
 			btc.State = BTStateReadyForMessages
 			btc.MessageChan <- true
 		case _ = <-btc.MessageChan:
-			log.Printf("[readLoop] Reading from MessageChan: %q", btc)
+			log.Printf("[readLoop] Reading from MessageChan: %q", btc.Addr)
 			m, err := structure.ReadMessage(btc)
 			if err != nil {
 				log.Printf("[readLoop] Error reading message: %s", err)
@@ -328,6 +393,14 @@ func (btc *BTConn) readLoop(addChan, leaveChan chan<- *BTConn) {
 				log.Printf("BIT 0: %q", btc.BitField.Get(0))
 				btc.BitField.Set(uint32(pi), 1)
 				log.Printf("BIT 0: %q", btc.BitField.Get(0))
+			case *structure.ExtendedMessage:
+				log.Println("[readLoop] Received: Extended MESSAGE")
+				if err := btc.handleExtendedMessage(m.(*structure.ExtendedMessage)); err != nil {
+					log.Printf("[readLoop] Error handling extended message: %s", err)
+					btc.Close()
+					leaveChan <- btc
+					continue
+				}
 
 			//			case *structure.PieceMessage:
 			//				log.Println("[readLoop] Received: Piece MESSAGE")
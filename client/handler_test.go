@@ -119,7 +119,7 @@ var (
 	port         = 55555
 	peerIDRemote = "-TR2840-nj5ovtREMOTE"
 	peerIDClient = "-TR2840-nj5ovtCLIENT"
-	hash         = []byte("\x6f\xda\xb6\xc1\x9f\x72\x14\x76\xfa\xca\xab\x36\x60\x8a\x87\x7a\x2a\xac\xbf\xc9")
+	hash         = structure.InfoHash{0x6f, 0xda, 0xb6, 0xc1, 0x9f, 0x72, 0x14, 0x76, 0xfa, 0xca, 0xab, 0x36, 0x60, 0x8a, 0x87, 0x7a, 0x2a, 0xac, 0xbf, 0xc9}
 )
 
 func TestListen(t *testing.T) {
@@ -227,6 +227,22 @@ func TestInitiateHandshakes(t *testing.T) {
 	})
 }
 
+func TestInitiateHandshakesSkipsSelf(t *testing.T) {
+	Convey("Does not connect to our own external address", t, func() {
+		s := NewBTService(port, []byte(peerIDRemote))
+		mc := NewMockConnectionFetcher()
+		s.ConnectionFetcher = mc
+		s.ExternalIP = net.IPv4(203, 0, 113, 1)
+
+		self := structure.Peer{IP: net.IPv4(203, 0, 113, 1), Port: uint16(port)}
+		other := structure.Peer{IP: net.IPv4(203, 0, 113, 1), Port: uint16(port + 1)}
+		s.InitiateHandshakes(hash, []structure.Peer{self, other})
+
+		So(mc.Conns, ShouldHaveLength, 1)
+		So(mc.Conns[other.AddrString()], ShouldNotBeNil)
+	})
+}
+
 func ReadMessageOrTimeout(c *MockConnection, ctx C) (structure.Message, error) {
 	select {
 	case b := <-c.ReceiveBytesChan:
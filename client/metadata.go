@@ -0,0 +1,163 @@
+package client
+
+import (
+	"errors"
+	"github.com/stratospark/torro/structure"
+	"log"
+)
+
+var (
+	ErrPeerNoMetadata     = errors.New("Peer Does Not Support ut_metadata")
+	ErrPeerRejectMetadata = errors.New("Peer Rejected The Metadata Request")
+)
+
+/*
+utMetadataID is the extended message ID peers use to send us
+ut_metadata messages, as announced in our extended handshake.
+*/
+const utMetadataID byte = 1
+
+/*
+newExtendedHandshake returns the extended handshake (BEP 10) sent to
+every peer that supports the extension protocol.
+*/
+func newExtendedHandshake() (*structure.ExtendedMessage, error) {
+	return structure.NewExtendedHandshakeMessage(&structure.ExtendedHandshake{
+		M:       map[string]int{structure.UTMetadata: int(utMetadataID)},
+		Version: structure.PeerIDPrefix,
+	})
+}
+
+/*
+handleExtendedMessage handles a message of the extension protocol.
+When the peer's torrent was added with AddMagnet, its metadata is
+requested using ut_metadata (BEP 9) as soon as the peer's extended
+handshake says that it has it. Peers that send metadata which does
+not match the info hash are dropped.
+*/
+func (btc *BTConn) handleExtendedMessage(ext *structure.ExtendedMessage) error {
+	switch ext.ExtendedID {
+	case 0:
+		peerExtHs, err := structure.ParseExtendedHandshake(ext.Data())
+		if err != nil {
+			return err
+		}
+		btc.PeerExtensions = peerExtHs.M
+		return btc.requestMetadata(peerExtHs.MetadataSize)
+	case utMetadataID:
+		mm, err := structure.ParseMetadataMessage(ext.Data())
+		if err != nil {
+			return err
+		}
+		return btc.handleMetadataMessage(mm)
+	}
+	return nil
+}
+
+/*
+requestMetadata requests every piece of the metadata of the torrent,
+unless it is not needed or the peer cannot send it.
+*/
+func (btc *BTConn) requestMetadata(size int64) error {
+	if btc.metadata != nil || btc.service.magnet(btc.Hash) == nil {
+		return nil
+	}
+	if _, ok := btc.peerMetadataID(); !ok {
+		log.Printf("[requestMetadata] %s: %s", btc.Addr, ErrPeerNoMetadata)
+		return nil
+	}
+	assembler, err := structure.NewMetadataAssembler(btc.Hash, size)
+	if err != nil {
+		log.Printf("[requestMetadata] %s: %s", btc.Addr, err)
+		return nil
+	}
+
+	btc.metadata = assembler
+	log.Printf("[requestMetadata] Requesting %d metadata pieces", assembler.NumPieces())
+	for _, piece := range assembler.Missing() {
+		if err := btc.sendMetadataMessage(&structure.MetadataMessage{Type: structure.MetadataRequest, Piece: piece}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (btc *BTConn) handleMetadataMessage(mm *structure.MetadataMessage) error {
+	switch mm.Type {
+	case structure.MetadataRequest:
+		// We do not share metadata
+		return btc.sendMetadataMessage(&structure.MetadataMessage{Type: structure.MetadataReject, Piece: mm.Piece})
+	case structure.MetadataReject:
+		if btc.metadata != nil {
+			log.Printf("[handleMetadataMessage] %s: %s", btc.Addr, ErrPeerRejectMetadata)
+			btc.metadata = nil
+		}
+	case structure.MetadataData:
+		if btc.metadata == nil {
+			return nil
+		}
+		if err := btc.metadata.Add(mm.Piece, mm.Data); err != nil {
+			return err
+		}
+		if !btc.metadata.Complete() {
+			return nil
+		}
+		info, err := btc.metadata.Bytes()
+		btc.metadata = nil
+		if err != nil {
+			return err
+		}
+		return btc.service.metadataFetched(btc.Hash, info)
+	}
+	return nil
+}
+
+/*
+peerMetadataID returns the extended message ID of ut_metadata on the
+peer's side, if the peer supports it.
+*/
+func (btc *BTConn) peerMetadataID() (byte, bool) {
+	id := btc.PeerExtensions[structure.UTMetadata]
+	if id <= 0 || id > 255 {
+		return 0, false
+	}
+	return byte(id), true
+}
+
+func (btc *BTConn) sendMetadataMessage(mm *structure.MetadataMessage) error {
+	id, ok := btc.peerMetadataID()
+	if !ok {
+		return nil
+	}
+	msg, err := mm.Message(id)
+	if err != nil {
+		return err
+	}
+	btc.WriteChan <- msg
+	return nil
+}
+
+/*
+metadataFetched sends the Metainfo of a magnet link on MetainfoChan,
+once the info dictionary fetched for it matches its info hash, unless
+another peer already sent it.
+*/
+func (s *BTService) metadataFetched(hash structure.InfoHash, info []byte) error {
+	m := s.magnet(hash)
+	if m == nil {
+		return nil
+	}
+	metainfo, err := structure.NewMetainfoFromInfo(info, m)
+	if err != nil {
+		return err
+	}
+
+	s.magnetsMu.Lock()
+	_, ok := s.magnets[hash]
+	delete(s.magnets, hash)
+	s.magnetsMu.Unlock()
+	if ok {
+		s.MetainfoChan <- metainfo
+	}
+	return nil
+}
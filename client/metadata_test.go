@@ -0,0 +1,173 @@
+package client
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/stratospark/torro/bencoding"
+	"github.com/stratospark/torro/structure"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+/*
+serveMetadata accepts a single connection and answers ut_metadata
+requests with pieces of info, the way a seeding peer would. Requests
+for pieces in reject are rejected, and corrupt flips a byte of the
+first piece sent.
+*/
+func serveMetadata(l net.Listener, info []byte, reject map[int]bool, corrupt bool) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	hs, err := structure.ReadHandshake(conn)
+	if err != nil {
+		return
+	}
+	resp, _ := structure.NewHandshake(hs.Hash, []byte("-TR2840-nj5ovtREMOTE"))
+	resp.SetExtensions()
+	conn.Write(resp.Bytes())
+	conn.Write(structure.NewBitFieldMessage(structure.BitFieldFromHexString("\xff")).Bytes())
+
+	var peerMetadataID byte
+	for {
+		msg, err := structure.ReadMessage(conn)
+		if err != nil {
+			return
+		}
+		ext, ok := msg.(*structure.ExtendedMessage)
+		if !ok {
+			continue
+		}
+		if ext.ExtendedID == 0 {
+			peerExtHs, _ := structure.ParseExtendedHandshake(ext.Data())
+			peerMetadataID = byte(peerExtHs.M[structure.UTMetadata])
+			extHs, _ := structure.NewExtendedHandshakeMessage(&structure.ExtendedHandshake{
+				M:            map[string]int{structure.UTMetadata: 3},
+				MetadataSize: int64(len(info)),
+			})
+			conn.Write(extHs.Bytes())
+			continue
+		}
+
+		req, err := structure.ParseMetadataMessage(ext.Data())
+		if err != nil || ext.ExtendedID != 3 || req.Type != structure.MetadataRequest {
+			return
+		}
+		mm := &structure.MetadataMessage{Type: structure.MetadataReject, Piece: req.Piece}
+		if !reject[req.Piece] {
+			end := (req.Piece + 1) * structure.MetadataPieceSize
+			if end > len(info) {
+				end = len(info)
+			}
+			mm.Type = structure.MetadataData
+			mm.TotalSize = int64(len(info))
+			mm.Data = append([]byte{}, info[req.Piece*structure.MetadataPieceSize:end]...)
+			if corrupt {
+				mm.Data[0]++
+				corrupt = false
+			}
+		}
+		msg, _ = mm.Message(peerMetadataID)
+		conn.Write(msg.Bytes())
+	}
+}
+
+func TestFetchMetadata(t *testing.T) {
+	filename := "../testfiles/ubuntu.torrent"
+	data, _ := ioutil.ReadFile(filename)
+	lex := bencoding.BeginLexing(filename, string(data), bencoding.LexBegin)
+	root, _ := bencoding.ParseContainer(bencoding.Collect(lex))
+	info := root.Dict["info"].Raw
+	magnet := &structure.Magnet{
+		InfoHash:    structure.HashInfo(info),
+		DisplayName: "ubuntu",
+		Trackers:    []string{"http://torrent.ubuntu.com:6969/announce"},
+	}
+
+	// fetch connects a BTService fetching the metadata of magnet to a
+	// peer served by serve, returning the Metainfo it sends before timeout
+	fetch := func(serve func(net.Listener), timeout time.Duration) *structure.Metainfo {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil
+		}
+		defer l.Close()
+		go serve(l)
+
+		s := NewBTService(0, []byte(peerIDClient))
+		s.AddMagnet(magnet)
+		if err := s.StartListening(); err != nil {
+			return nil
+		}
+		defer s.StopListening()
+
+		addr := l.Addr().(*net.TCPAddr)
+		s.InitiateHandshakes(magnet.InfoHash, []structure.Peer{{IP: addr.IP, Port: uint16(addr.Port)}})
+		select {
+		case metainfo := <-s.MetainfoChan:
+			return metainfo
+		case <-time.After(timeout):
+			return nil
+		}
+	}
+
+	Convey("Fetching metadata from a peer", t, func() {
+		metainfo := fetch(func(l net.Listener) { serveMetadata(l, info, nil, false) }, 2*time.Second)
+		So(metainfo, ShouldNotBeNil)
+		expected, _ := structure.NewMetainfo(filename)
+		So(metainfo.Info, ShouldResemble, expected.Info)
+		So(metainfo.Announce, ShouldEqual, "http://torrent.ubuntu.com:6969/announce")
+	})
+
+	Convey("Giving up on a peer that rejects a request", t, func() {
+		metainfo := fetch(func(l net.Listener) { serveMetadata(l, info, map[int]bool{1: true}, false) }, 200*time.Millisecond)
+		So(metainfo, ShouldBeNil)
+	})
+
+	Convey("Dropping a peer whose metadata does not match the info hash", t, func() {
+		done := make(chan bool)
+		metainfo := fetch(func(l net.Listener) {
+			serveMetadata(l, info, nil, true)
+			close(done)
+		}, 200*time.Millisecond)
+		So(metainfo, ShouldBeNil)
+		dropped := false
+		select {
+		case <-done:
+			dropped = true
+		case <-time.After(time.Second):
+		}
+		So(dropped, ShouldBeTrue)
+	})
+
+	Convey("Sending no extension messages to a peer without extension support", t, func() {
+		written := make(chan []byte, 1)
+		offered := false
+		metainfo := fetch(func(l net.Listener) {
+			conn, err := l.Accept()
+			if err != nil {
+				close(written)
+				return
+			}
+			defer conn.Close()
+			hs, err := structure.ReadHandshake(conn)
+			if err != nil {
+				close(written)
+				return
+			}
+			offered = hs.SupportsExtensions()
+			resp, _ := structure.NewHandshake(hs.Hash, []byte("-TR2840-nj5ovtREMOTE"))
+			conn.Write(resp.Bytes())
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			rest, _ := ioutil.ReadAll(conn)
+			written <- rest
+		}, 200*time.Millisecond)
+		So(metainfo, ShouldBeNil)
+		So(<-written, ShouldBeEmpty)
+		So(offered, ShouldBeTrue)
+	})
+}
@@ -1,14 +1,48 @@
 package client
 
 import (
+	"errors"
 	"github.com/stratospark/torro/structure"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	// trackerTimeout bounds a whole announce or scrape, so that a
+	// tracker that hangs or never answers fails and the next tracker
+	// in its tier is tried.
+	trackerTimeout = 30 * time.Second
+
+	// maxTrackerResponseSize limits how much of a tracker response
+	// is read. Scrapes of many torrents are the largest responses.
+	maxTrackerResponseSize = 4 << 20
+)
+
+/*
+TrackerClient announces to HTTP and UDP trackers, choosing the
+protocol by the scheme of the announce URL.
+*/
 type TrackerClient struct {
 	HTTP *http.Client
+	UDP  *UDPTrackerClient
+
+	mu         sync.Mutex
+	externalIP net.IP
+	trackerIDs map[trackerIDKey]string
+}
+
+/*
+trackerIDKey identifies the tracker id a tracker sent for a torrent.
+*/
+type trackerIDKey struct {
+	announceURL string
+	infoHash    structure.InfoHash
 }
 
 type TrackerRequestEvent string
@@ -21,27 +55,39 @@ const (
 
 func NewTrackerClient() *TrackerClient {
 	tc := &TrackerClient{
-		HTTP: http.DefaultClient,
+		HTTP:       &http.Client{Timeout: trackerTimeout},
+		UDP:        NewUDPTrackerClient(),
+		trackerIDs: make(map[trackerIDKey]string),
 	}
+	tc.UDP.Deadline = trackerTimeout
 
 	return tc
 }
 
 func (tc *TrackerClient) MakeAnnounceRequest(req *structure.TrackerRequest, event TrackerRequestEvent) (tr *structure.TrackerResponse, err error) {
-	// TODO: Validate that tracker request has valid fields, e.g. peer_id = 20 bytes
+	if err := req.Validate(); err != nil {
+		return tr, err
+	}
 	req.Event = string(event)
-	url := req.GetURL()
-	resp, err := tc.HTTP.Get(url)
-	log.Print("MakeAnounceRequest, URL: ", url)
+
+	announceURL := req.AnnounceURL
+	if announceURL == "" {
+		announceURL = req.Metainfo.Announce
+	}
+	if strings.HasPrefix(announceURL, "udp://") {
+		return tc.UDP.Announce(announceURL, req, event)
+	}
+
+	url, err := req.GetURL()
 	if err != nil {
 		return tr, err
 	}
-
-	contents, err := ioutil.ReadAll(resp.Body)
-	log.Println("MakeAnnounceRequest, Contents: ", string(contents))
+	log.Print("MakeAnounceRequest, URL: ", url)
+	contents, err := tc.get(url)
 	if err != nil {
 		return tr, err
 	}
+	log.Println("MakeAnnounceRequest, Contents: ", string(contents))
 
 	tr, err = structure.NewTrackerResponse(string(contents))
 	if err != nil {
@@ -49,5 +95,164 @@ func (tc *TrackerClient) MakeAnnounceRequest(req *structure.TrackerRequest, even
 	}
 	log.Println("MakeAnnounceRequest, TrackerResponse: ", tr)
 
+	if tr.WarningMessage != "" {
+		log.Printf("Tracker %s warning: %s", announceURL, tr.WarningMessage)
+	}
+	tc.mu.Lock()
+	if tr.TrackerID != "" {
+		req.TrackerID = tr.TrackerID
+		tc.trackerIDs[trackerIDKey{announceURL, req.InfoHash}] = tr.TrackerID
+	}
+	if tr.ExternalIP != nil {
+		tc.externalIP = tr.ExternalIP
+	}
+	tc.mu.Unlock()
+
 	return tr, nil
 }
+
+/*
+HTTPStatusError is returned when a tracker answers with a status other
+than 2xx, whose body is usually an error page rather than bencode.
+*/
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return "Tracker Returned HTTP Status: " + e.Status
+}
+
+var ErrTrackerResponseTooLarge = errors.New("Tracker Response Too Large")
+
+/*
+get fetches url and returns the body of a successful response, which
+may be at most maxTrackerResponseSize bytes.
+*/
+func (tc *TrackerClient) get(url string) ([]byte, error) {
+	resp, err := tc.HTTP.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxTrackerResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxTrackerResponseSize {
+		return nil, ErrTrackerResponseTooLarge
+	}
+	return body, nil
+}
+
+/*
+trackerID returns the tracker id the tracker at announceURL last sent
+for the torrent, if any.
+*/
+func (tc *TrackerClient) trackerID(announceURL string, infoHash structure.InfoHash) string {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.trackerIDs[trackerIDKey{announceURL, infoHash}]
+}
+
+/*
+ExternalIP returns our address as last reported by a tracker, or nil
+if no tracker has reported it.
+*/
+func (tc *TrackerClient) ExternalIP() net.IP {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.externalIP
+}
+
+var ErrNoTrackers = errors.New("No Trackers To Announce To")
+
+/*
+Announce tries every tracker in the request's tiers in order, as
+described in BEP 12, until one of them responds. The tracker that
+responded is moved to the front of its tier, so that it is tried
+first next time. If every tracker fails, the last error is returned.
+Each tracker is sent the tracker id it last sent for the torrent.
+*/
+func (tc *TrackerClient) Announce(req *structure.TrackerRequest, event TrackerRequestEvent) (tr *structure.TrackerResponse, err error) {
+	err = ErrNoTrackers
+	for i, tier := range req.Tiers {
+		for j, url := range tier {
+			req.AnnounceURL = url
+			req.TrackerID = tc.trackerID(url, req.InfoHash)
+			tr, err = tc.MakeAnnounceRequest(req, event)
+			if err == nil {
+				req.Tiers.Promote(i, j)
+				return tr, nil
+			}
+			log.Printf("Announce to %s failed: %s", url, err)
+		}
+	}
+	return tr, err
+}
+
+/*
+httpScrapeBatchSize keeps scrape URLs to a length that trackers and
+proxies accept.
+*/
+const httpScrapeBatchSize = 50
+
+/*
+Scrape asks the tracker at announceURL for the counts of each of the
+given infohashes. Many infohashes are sent in batches. Results are
+keyed by infohash; torrents the tracker does not know are omitted.
+*/
+func (tc *TrackerClient) Scrape(announceURL string, infoHashes ...structure.InfoHash) (map[structure.InfoHash]structure.ScrapeFile, error) {
+	batchSize := httpScrapeBatchSize
+	scrape := tc.scrapeHTTP
+	if strings.HasPrefix(announceURL, "udp://") {
+		batchSize = udpMaxScrapeHashes
+		scrape = tc.UDP.Scrape
+	}
+
+	files := make(map[structure.InfoHash]structure.ScrapeFile)
+	for start := 0; start < len(infoHashes); start += batchSize {
+		end := start + batchSize
+		if end > len(infoHashes) {
+			end = len(infoHashes)
+		}
+		batch, err := scrape(announceURL, infoHashes[start:end]...)
+		if err != nil {
+			return files, err
+		}
+		for hash, file := range batch {
+			files[hash] = file
+		}
+	}
+	return files, nil
+}
+
+func (tc *TrackerClient) scrapeHTTP(announceURL string, infoHashes ...structure.InfoHash) (map[structure.InfoHash]structure.ScrapeFile, error) {
+	scrapeURL, err := structure.GetScrapeURL(announceURL, infoHashes...)
+	if err != nil {
+		return nil, err
+	}
+	log.Print("Scrape, URL: ", scrapeURL)
+	contents, err := tc.get(scrapeURL)
+	if err != nil {
+		return nil, err
+	}
+	allFiles, err := structure.NewScrapeResponse(string(contents))
+	if err != nil {
+		return nil, err
+	}
+
+	// Some trackers send every torrent they know
+	files := make(map[structure.InfoHash]structure.ScrapeFile)
+	for _, hash := range infoHashes {
+		if file, ok := allFiles[hash]; ok {
+			files[hash] = file
+		}
+	}
+	return files, nil
+}
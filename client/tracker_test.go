@@ -8,6 +8,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 )
 
 func newTestServer(f http.HandlerFunc) *httptest.Server {
@@ -29,7 +30,7 @@ func TestTrackerClient(t *testing.T) {
 			},
 		}
 		filename := "../testfiles/kali-linux-2.0-i386.iso.torrent"
-		metainfo := structure.NewMetainfo(filename)
+		metainfo, _ := structure.NewMetainfo(filename)
 		tReq := structure.NewTrackerRequest(metainfo)
 		tResp, err := tc.MakeAnnounceRequest(tReq, "started")
 		So(tc, ShouldNotBeNil)
@@ -52,7 +53,7 @@ func TestTrackerClient(t *testing.T) {
 			},
 		}
 		filename := "../testfiles/kali-linux-2.0-i386.iso.torrent"
-		metainfo := structure.NewMetainfo(filename)
+		metainfo, _ := structure.NewMetainfo(filename)
 		tReq := structure.NewTrackerRequest(metainfo)
 		tResp, err := tc.MakeAnnounceRequest(tReq, "started")
 		So(tc, ShouldNotBeNil)
@@ -60,4 +61,194 @@ func TestTrackerClient(t *testing.T) {
 		So(tResp, ShouldNotBeNil)
 		So(tResp.FailureReason, ShouldEqual, "an error")
 	})
+
+	Convey("Should fall back across tiers and promote the tracker that responds", t, func() {
+		var requested []string
+		newTracker := func(name, body string) *httptest.Server {
+			return newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requested = append(requested, name)
+				fmt.Fprint(w, body)
+			}))
+		}
+		ok := "d8:completei1e10:incompletei2e8:intervali60e5:peers0:e"
+		failing := newTracker("failing", "d14:failure reason8:an errore")
+		defer failing.Close()
+		working := newTracker("working", ok)
+		defer working.Close()
+		unused := newTracker("unused", ok)
+		defer unused.Close()
+		dead := newTracker("dead", ok)
+		dead.Close()
+
+		metainfo, _ := structure.NewMetainfo("../testfiles/kali-linux-2.0-i386.iso.torrent")
+		tReq := structure.NewTrackerRequest(metainfo)
+		tReq.Tiers = structure.AnnounceList{
+			[]string{dead.URL, failing.URL},
+			[]string{"udp://unsupported.invalid:6969", working.URL},
+			[]string{unused.URL},
+		}
+
+		tc := NewTrackerClient()
+		tc.HTTP = &http.Client{}
+		tResp, err := tc.Announce(tReq, TrackerRequestStarted)
+		So(err, ShouldBeNil)
+		So(tResp.Complete, ShouldEqual, 1)
+		So(requested, ShouldResemble, []string{"failing", "working"})
+		So(tReq.AnnounceURL, ShouldEqual, working.URL)
+		So(tReq.Tiers[1][0], ShouldEqual, working.URL)
+	})
+
+	Convey("Should return the last error when every tracker fails", t, func() {
+		failing := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "d14:failure reason8:an errore")
+		}))
+		defer failing.Close()
+
+		metainfo, _ := structure.NewMetainfo("../testfiles/kali-linux-2.0-i386.iso.torrent")
+		tReq := structure.NewTrackerRequest(metainfo)
+		tReq.Tiers = structure.AnnounceList{[]string{failing.URL}}
+
+		tc := NewTrackerClient()
+		tc.HTTP = &http.Client{}
+		tResp, err := tc.Announce(tReq, TrackerRequestStarted)
+		So(err, ShouldNotBeNil)
+		So(tResp.FailureReason, ShouldEqual, "an error")
+
+		tReq.Tiers = structure.AnnounceList{}
+		_, err = tc.Announce(tReq, TrackerRequestStarted)
+		So(err, ShouldEqual, ErrNoTrackers)
+	})
+
+	Convey("Should move on from a tracker that hangs", t, func() {
+		release := make(chan struct{})
+		hanging := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer hanging.Close()
+		defer close(release)
+		working := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "d8:completei1e10:incompletei2e8:intervali1800e5:peers0:e")
+		}))
+		defer working.Close()
+
+		metainfo, _ := structure.NewMetainfo("../testfiles/kali-linux-2.0-i386.iso.torrent")
+		tReq := structure.NewTrackerRequest(metainfo)
+		tReq.Tiers = structure.AnnounceList{[]string{hanging.URL}, []string{working.URL}}
+
+		tc := NewTrackerClient()
+		tc.HTTP.Timeout = 50 * time.Millisecond
+		start := time.Now()
+		tResp, err := tc.Announce(tReq, TrackerRequestStarted)
+		So(err, ShouldBeNil)
+		So(tResp.Complete, ShouldEqual, 1)
+		So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+	})
+
+	Convey("Should reject oversized responses", t, func() {
+		ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "d8:completei1e10:incompletei2e8:intervali1800e5:peers%d:", maxTrackerResponseSize)
+			w.Write(make([]byte, maxTrackerResponseSize))
+			fmt.Fprint(w, "e")
+		}))
+		defer ts.Close()
+
+		metainfo, _ := structure.NewMetainfo("../testfiles/kali-linux-2.0-i386.iso.torrent")
+		tReq := structure.NewTrackerRequest(metainfo)
+		tReq.AnnounceURL = ts.URL
+
+		tc := NewTrackerClient()
+		_, err := tc.MakeAnnounceRequest(tReq, TrackerRequestStarted)
+		So(err, ShouldEqual, ErrTrackerResponseTooLarge)
+	})
+
+	Convey("Should echo the tracker id and remember the external IP", t, func() {
+		var trackerIDs []string
+		ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			trackerIDs = append(trackerIDs, r.URL.Query().Get("trackerid"))
+			fmt.Fprint(w, "d8:completei1e11:external ip4:\x0a\x00\x00\x0910:incompletei2e8:intervali1800e5:peers0:10:tracker id3:abc15:warning message4:slowe")
+		}))
+		defer ts.Close()
+
+		metainfo, _ := structure.NewMetainfo("../testfiles/kali-linux-2.0-i386.iso.torrent")
+		tReq := structure.NewTrackerRequest(metainfo)
+		tReq.Tiers = structure.AnnounceList{[]string{ts.URL}}
+
+		tc := NewTrackerClient()
+		tc.HTTP = &http.Client{}
+		So(tc.ExternalIP(), ShouldBeNil)
+		tResp, err := tc.Announce(tReq, TrackerRequestStarted)
+		So(err, ShouldBeNil)
+		So(tResp.WarningMessage, ShouldEqual, "slow")
+		So(tReq.TrackerID, ShouldEqual, "abc")
+		So(tc.ExternalIP().String(), ShouldEqual, "10.0.0.9")
+
+		_, err = tc.Announce(tReq, "")
+		So(err, ShouldBeNil)
+		So(trackerIDs, ShouldResemble, []string{"", "abc"})
+	})
+
+	Convey("Should echo the tracker id to the tracker that sent it behind a dead tier", t, func() {
+		var trackerIDs []string
+		ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			trackerIDs = append(trackerIDs, r.URL.Query().Get("trackerid"))
+			fmt.Fprint(w, "d8:completei1e10:incompletei2e8:intervali1800e5:peers0:10:tracker id3:abce")
+		}))
+		defer ts.Close()
+		dead := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		dead.Close()
+
+		metainfo, _ := structure.NewMetainfo("../testfiles/kali-linux-2.0-i386.iso.torrent")
+		tReq := structure.NewTrackerRequest(metainfo)
+		tReq.Tiers = structure.AnnounceList{[]string{dead.URL}, []string{ts.URL}}
+
+		tc := NewTrackerClient()
+		tc.HTTP = &http.Client{}
+		for i := 0; i < 3; i++ {
+			_, err := tc.Announce(tReq, "")
+			So(err, ShouldBeNil)
+		}
+		So(trackerIDs, ShouldResemble, []string{"", "abc", "abc"})
+	})
+
+	Convey("Should fail on an HTTP error status", t, func() {
+		ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprint(w, "<html>Bad Gateway</html>")
+		}))
+		defer ts.Close()
+
+		metainfo, _ := structure.NewMetainfo("../testfiles/kali-linux-2.0-i386.iso.torrent")
+		tReq := structure.NewTrackerRequest(metainfo)
+		tReq.AnnounceURL = ts.URL
+
+		tc := NewTrackerClient()
+		tc.HTTP = &http.Client{}
+		_, err := tc.MakeAnnounceRequest(tReq, TrackerRequestStarted)
+		So(err, ShouldResemble, &HTTPStatusError{StatusCode: 502, Status: "502 Bad Gateway"})
+		So(err.Error(), ShouldEqual, "Tracker Returned HTTP Status: 502 Bad Gateway")
+	})
+
+	Convey("Should scrape an HTTP tracker", t, func() {
+		var path, query string
+		ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path, query = r.URL.Path, r.URL.RawQuery
+			fmt.Fprint(w, "d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei5e10:downloadedi50e10:incompletei10eeee")
+		}))
+		defer ts.Close()
+
+		known, _ := structure.NewInfoHash([]byte("aaaaaaaaaaaaaaaaaaaa"))
+		unknown, _ := structure.NewInfoHash([]byte("bbbbbbbbbbbbbbbbbbbb"))
+		tc := NewTrackerClient()
+		tc.HTTP = &http.Client{}
+		files, err := tc.Scrape(ts.URL+"/announce", known, unknown)
+		So(err, ShouldBeNil)
+		So(path, ShouldEqual, "/scrape")
+		So(query, ShouldEqual, "info_hash="+known.URLEscaped()+"&info_hash="+unknown.URLEscaped())
+		So(files, ShouldResemble, map[structure.InfoHash]structure.ScrapeFile{
+			known: structure.ScrapeFile{Complete: 5, Downloaded: 50, Incomplete: 10},
+		})
+
+		_, err = tc.Scrape(ts.URL+"/tracker", known)
+		So(err, ShouldEqual, structure.ErrScrapeNotSupported)
+	})
 }
@@ -0,0 +1,334 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/stratospark/torro/structure"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+UDP tracker protocol constants, see BEP 15.
+*/
+const (
+	udpProtocolID int64 = 0x41727101980
+
+	udpActionConnect  uint32 = 0
+	udpActionAnnounce uint32 = 1
+	udpActionScrape   uint32 = 2
+	udpActionError    uint32 = 3
+
+	udpEventNone      uint32 = 0
+	udpEventCompleted uint32 = 1
+	udpEventStarted   uint32 = 2
+	udpEventStopped   uint32 = 3
+
+	// A connection ID may be used for one minute after it was received
+	udpConnectionIDTTL = time.Minute
+
+	// Scrape requests are limited to what fits in a single packet
+	udpMaxScrapeHashes = 74
+
+	// Announce responses grow with the number of peers, so read up to
+	// the largest possible UDP payload
+	udpMaxPacketSize = 64 * 1024
+)
+
+var (
+	ErrUDPTrackerTimeout = errors.New("UDP Tracker Did Not Respond")
+	ErrUDPInvalidPacket  = errors.New("Invalid UDP Tracker Packet")
+	ErrUDPTooManyHashes  = errors.New(fmt.Sprint("Too Many Infohashes For One Scrape, Maximum Is ", udpMaxScrapeHashes))
+	errUDPReadTimeout    = errors.New("UDP Read Timeout")
+)
+
+var udpEvents = map[TrackerRequestEvent]uint32{
+	"":                      udpEventNone,
+	TrackerRequestCompleted: udpEventCompleted,
+	TrackerRequestStarted:   udpEventStarted,
+	TrackerRequestStopped:   udpEventStopped,
+}
+
+/*
+UDPTrackerClient speaks the UDP tracker protocol. Each request is
+retransmitted after Timeout·2^n for n = 0..MaxRetries; the spec calls
+for a Timeout of 15 seconds and 8 retries, which takes over two hours
+to give up on a tracker that never answers. If Deadline is set, a
+request gives up once that much time has passed instead. Connection
+IDs are cached per tracker address for as long as the spec allows.
+*/
+type UDPTrackerClient struct {
+	Timeout    time.Duration
+	MaxRetries int
+	Deadline   time.Duration
+
+	mu            sync.Mutex
+	connectionIDs map[string]udpConnectionID
+}
+
+type udpConnectionID struct {
+	ID       int64
+	Received time.Time
+}
+
+func NewUDPTrackerClient() *UDPTrackerClient {
+	return &UDPTrackerClient{
+		Timeout:       15 * time.Second,
+		MaxRetries:    8,
+		connectionIDs: make(map[string]udpConnectionID),
+	}
+}
+
+/*
+UDPTrackerError is a message sent by the tracker with the error action.
+*/
+type UDPTrackerError struct {
+	Message string
+}
+
+func (e *UDPTrackerError) Error() string {
+	return "UDP Tracker Error: " + e.Message
+}
+
+/*
+Announce sends an announce request to the udp:// tracker at announceURL.
+*/
+func (c *UDPTrackerClient) Announce(announceURL string, req *structure.TrackerRequest, event TrackerRequestEvent) (*structure.TrackerResponse, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	eventID, ok := udpEvents[event]
+	if !ok {
+		return nil, errors.New("Invalid Event: " + string(event))
+	}
+
+	var ip uint32
+	if addr := net.ParseIP(req.IP).To4(); addr != nil {
+		ip = binary.BigEndian.Uint32(addr)
+	}
+	key, _ := strconv.ParseUint(req.Key, 16, 32)
+
+	// Zero would ask for no peers at all, so use the tracker's default
+	numWant := int32(req.NumWant)
+	if numWant == 0 {
+		numWant = -1
+	}
+
+	payload := &bytes.Buffer{}
+	payload.Write(req.InfoHash[:])
+	payload.WriteString(req.PeerID)
+	binary.Write(payload, binary.BigEndian, req.Downloaded)
+	binary.Write(payload, binary.BigEndian, req.Left())
+	binary.Write(payload, binary.BigEndian, req.Uploaded)
+	binary.Write(payload, binary.BigEndian, eventID)
+	binary.Write(payload, binary.BigEndian, ip)
+	binary.Write(payload, binary.BigEndian, uint32(key))
+	binary.Write(payload, binary.BigEndian, numWant)
+	binary.Write(payload, binary.BigEndian, uint16(req.Port))
+
+	conn, err := c.dial(announceURL)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	resp, err := c.request(conn, udpActionAnnounce, payload.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 12 {
+		return nil, ErrUDPInvalidPacket
+	}
+
+	// Trackers reached over IPv6 return IPv6 peers
+	ipLen := net.IPv4len
+	if conn.RemoteAddr().(*net.UDPAddr).IP.To4() == nil {
+		ipLen = net.IPv6len
+	}
+	peers, err := structure.NewCompactPeers(resp[12:], ipLen)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := &structure.TrackerResponse{
+		Interval:   int(binary.BigEndian.Uint32(resp[0:4])),
+		Incomplete: int(binary.BigEndian.Uint32(resp[4:8])),
+		Complete:   int(binary.BigEndian.Uint32(resp[8:12])),
+		Peers:      peers,
+	}
+	log.Println("UDP Announce, TrackerResponse: ", tr)
+	return tr, nil
+}
+
+/*
+Scrape asks the udp:// tracker at announceURL for the counts of each
+of the given infohashes. Results are keyed by infohash.
+*/
+func (c *UDPTrackerClient) Scrape(announceURL string, infoHashes ...structure.InfoHash) (map[structure.InfoHash]structure.ScrapeFile, error) {
+	if len(infoHashes) > udpMaxScrapeHashes {
+		return nil, ErrUDPTooManyHashes
+	}
+
+	payload := &bytes.Buffer{}
+	for _, hash := range infoHashes {
+		payload.Write(hash[:])
+	}
+
+	conn, err := c.dial(announceURL)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	resp, err := c.request(conn, udpActionScrape, payload.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 12*len(infoHashes) {
+		return nil, ErrUDPInvalidPacket
+	}
+
+	files := make(map[structure.InfoHash]structure.ScrapeFile)
+	for i, hash := range infoHashes {
+		entry := resp[12*i : 12*i+12]
+		files[hash] = structure.ScrapeFile{
+			Complete:   int(binary.BigEndian.Uint32(entry[0:4])),
+			Downloaded: int(binary.BigEndian.Uint32(entry[4:8])),
+			Incomplete: int(binary.BigEndian.Uint32(entry[8:12])),
+		}
+	}
+	return files, nil
+}
+
+func (c *UDPTrackerClient) dial(announceURL string) (*net.UDPConn, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "udp" {
+		return nil, errors.New("Not A UDP Tracker: " + announceURL)
+	}
+	addr, err := net.ResolveUDPAddr("udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialUDP("udp", nil, addr)
+}
+
+/*
+request sends action with the given payload, connecting first if there
+is no usable connection ID, and retransmitting with exponential backoff
+until the tracker answers or the Deadline passes. It returns the
+response after its header.
+*/
+func (c *UDPTrackerClient) request(conn *net.UDPConn, action uint32, payload []byte) ([]byte, error) {
+	host := conn.RemoteAddr().String()
+	deadline := time.Now().Add(c.Deadline)
+
+	for n := 0; n <= c.MaxRetries; n++ {
+		timeout := c.Timeout * time.Duration(1<<uint(n))
+		if c.Deadline > 0 {
+			remaining := deadline.Sub(time.Now())
+			if remaining <= 0 {
+				break
+			}
+			if timeout > remaining {
+				timeout = remaining
+			}
+		}
+
+		connectionID, ok := c.connectionID(host)
+		if !ok {
+			resp, err := c.send(conn, udpProtocolID, udpActionConnect, nil, timeout)
+			if err == errUDPReadTimeout {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(resp) < 8 {
+				return nil, ErrUDPInvalidPacket
+			}
+			connectionID = int64(binary.BigEndian.Uint64(resp[0:8]))
+			c.setConnectionID(host, connectionID, time.Now())
+		}
+
+		resp, err := c.send(conn, connectionID, action, payload, timeout)
+		if err == errUDPReadTimeout {
+			continue
+		}
+		if err != nil {
+			// The tracker may have rejected our connection ID
+			c.setConnectionID(host, 0, time.Time{})
+		}
+		return resp, err
+	}
+	return nil, ErrUDPTrackerTimeout
+}
+
+/*
+send writes a single packet and waits up to timeout for the response
+with the same transaction ID, ignoring any stale responses.
+*/
+func (c *UDPTrackerClient) send(conn *net.UDPConn, connectionID int64, action uint32, payload []byte, timeout time.Duration) ([]byte, error) {
+	transactionID := rand.Uint32()
+
+	packet := &bytes.Buffer{}
+	binary.Write(packet, binary.BigEndian, connectionID)
+	binary.Write(packet, binary.BigEndian, action)
+	binary.Write(packet, binary.BigEndian, transactionID)
+	packet.Write(payload)
+	if _, err := conn.Write(packet.Bytes()); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return nil, errUDPReadTimeout
+			}
+			return nil, err
+		}
+		if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != transactionID {
+			continue
+		}
+
+		switch binary.BigEndian.Uint32(buf[0:4]) {
+		case action:
+			return append([]byte{}, buf[8:n]...), nil
+		case udpActionError:
+			return nil, &UDPTrackerError{Message: string(buf[8:n])}
+		default:
+			return nil, ErrUDPInvalidPacket
+		}
+	}
+}
+
+func (c *UDPTrackerClient) connectionID(host string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conn, ok := c.connectionIDs[host]
+	if !ok || time.Since(conn.Received) >= udpConnectionIDTTL {
+		return 0, false
+	}
+	return conn.ID, true
+}
+
+func (c *UDPTrackerClient) setConnectionID(host string, id int64, received time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.connectionIDs == nil {
+		c.connectionIDs = make(map[string]udpConnectionID)
+	}
+	c.connectionIDs[host] = udpConnectionID{ID: id, Received: received}
+}
@@ -0,0 +1,342 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/stratospark/torro/structure"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+fakeUDPTracker is a minimal stand-in for a BEP 15 tracker. It can
+drop a number of incoming packets to exercise retransmission.
+*/
+type fakeUDPTracker struct {
+	Conn         *net.UDPConn
+	ConnectionID int64
+	Drop         int
+	Error        string
+	Peers        []byte
+
+	mu       sync.Mutex
+	connects int
+	requests [][]byte
+}
+
+func newFakeUDPTracker(network, addr string) (*fakeUDPTracker, error) {
+	laddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeUDPTracker{Conn: conn, ConnectionID: 0x1234}, nil
+}
+
+/*
+Start answers requests in the background. The tracker must not be
+reconfigured after it has started.
+*/
+func (t *fakeUDPTracker) Start() {
+	go t.serve()
+}
+
+func (t *fakeUDPTracker) Request(i int) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.requests[i]
+}
+
+func (t *fakeUDPTracker) URL() string {
+	return "udp://" + t.Conn.LocalAddr().String() + "/announce"
+}
+
+func (t *fakeUDPTracker) Connects() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.connects
+}
+
+func (t *fakeUDPTracker) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := t.Conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		packet := append([]byte{}, buf[:n]...)
+
+		t.mu.Lock()
+		if t.Drop > 0 {
+			t.Drop--
+			t.mu.Unlock()
+			continue
+		}
+		t.requests = append(t.requests, packet)
+		t.mu.Unlock()
+
+		connectionID := int64(binary.BigEndian.Uint64(packet[0:8]))
+		action := binary.BigEndian.Uint32(packet[8:12])
+		resp := &bytes.Buffer{}
+		binary.Write(resp, binary.BigEndian, action)
+		resp.Write(packet[12:16])
+
+		switch {
+		case action == udpActionConnect && connectionID == udpProtocolID:
+			t.mu.Lock()
+			t.connects++
+			t.mu.Unlock()
+			binary.Write(resp, binary.BigEndian, t.ConnectionID)
+		case connectionID != t.ConnectionID || t.Error != "":
+			resp.Reset()
+			binary.Write(resp, binary.BigEndian, udpActionError)
+			resp.Write(packet[12:16])
+			resp.WriteString(t.Error)
+		case action == udpActionAnnounce:
+			binary.Write(resp, binary.BigEndian, uint32(1800))
+			binary.Write(resp, binary.BigEndian, uint32(3))
+			binary.Write(resp, binary.BigEndian, uint32(7))
+			resp.Write(t.Peers)
+		case action == udpActionScrape:
+			for i := 16; i+20 <= len(packet); i += 20 {
+				seeders := uint32(packet[i])
+				binary.Write(resp, binary.BigEndian, []uint32{seeders, seeders * 2, seeders * 3})
+			}
+		}
+		t.Conn.WriteToUDP(resp.Bytes(), addr)
+	}
+}
+
+func newUDPTrackerRequest() *structure.TrackerRequest {
+	metainfo, _ := structure.NewMetainfo("../testfiles/ubuntu.torrent")
+	req := structure.NewTrackerRequest(metainfo)
+	req.PeerID = "-TR2840-nj5ovtkoz2ed"
+	req.Port = 6881
+	req.Key = "deadbeef"
+	return req
+}
+
+func newTestUDPTrackerClient() *UDPTrackerClient {
+	c := NewUDPTrackerClient()
+	c.Timeout = 50 * time.Millisecond
+	c.MaxRetries = 3
+	return c
+}
+
+func TestUDPTrackerClient(t *testing.T) {
+	Convey("Announcing to a UDP tracker", t, func() {
+		tracker, err := newFakeUDPTracker("udp4", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer tracker.Conn.Close()
+		tracker.Peers = []byte{10, 0, 0, 1, 0x1a, 0xe1, 192, 168, 1, 2, 0xc8, 0xd5}
+
+		tracker.Start()
+		c := newTestUDPTrackerClient()
+		req := newUDPTrackerRequest()
+		req.Downloaded = 100
+		tr, err := c.Announce(tracker.URL(), req, TrackerRequestStarted)
+		So(err, ShouldBeNil)
+		So(tr.Interval, ShouldEqual, 1800)
+		So(tr.Incomplete, ShouldEqual, 3)
+		So(tr.Complete, ShouldEqual, 7)
+		So(tr.Peers, ShouldHaveLength, 2)
+		So(tr.Peers[0].String(), ShouldEqual, "10.0.0.1:6881")
+		So(tr.Peers[1].String(), ShouldEqual, "192.168.1.2:51413")
+
+		Convey("The announce packet follows the spec", func() {
+			packet := tracker.Request(1)
+			So(packet, ShouldHaveLength, 98)
+			So(string(packet[16:36]), ShouldEqual, string(req.InfoHash[:]))
+			So(string(packet[36:56]), ShouldEqual, req.PeerID)
+			So(binary.BigEndian.Uint64(packet[56:64]), ShouldEqual, 100)
+			So(binary.BigEndian.Uint64(packet[64:72]), ShouldEqual, req.Left())
+			So(binary.BigEndian.Uint32(packet[80:84]), ShouldEqual, udpEventStarted)
+			So(binary.BigEndian.Uint32(packet[88:92]), ShouldEqual, 0xdeadbeef)
+			So(int32(binary.BigEndian.Uint32(packet[92:96])), ShouldEqual, -1)
+			So(binary.BigEndian.Uint16(packet[96:98]), ShouldEqual, 6881)
+		})
+
+		Convey("The connection ID is reused", func() {
+			_, err := c.Announce(tracker.URL(), req, "")
+			So(err, ShouldBeNil)
+			So(tracker.Connects(), ShouldEqual, 1)
+		})
+
+		Convey("An expired connection ID is renewed", func() {
+			host := tracker.Conn.LocalAddr().String()
+			c.setConnectionID(host, tracker.ConnectionID, time.Now().Add(-udpConnectionIDTTL))
+			_, err := c.Announce(tracker.URL(), req, "")
+			So(err, ShouldBeNil)
+			So(tracker.Connects(), ShouldEqual, 2)
+		})
+	})
+
+	Convey("Retransmitting lost packets", t, func() {
+		tracker, err := newFakeUDPTracker("udp4", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer tracker.Conn.Close()
+		tracker.Drop = 2
+
+		tracker.Start()
+		c := newTestUDPTrackerClient()
+		tr, err := c.Announce(tracker.URL(), newUDPTrackerRequest(), TrackerRequestStarted)
+		So(err, ShouldBeNil)
+		So(tr.Complete, ShouldEqual, 7)
+	})
+
+	Convey("Giving up on a tracker that never answers", t, func() {
+		tracker, err := newFakeUDPTracker("udp4", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer tracker.Conn.Close()
+		tracker.Drop = 100
+
+		tracker.Start()
+		c := newTestUDPTrackerClient()
+		c.MaxRetries = 1
+		start := time.Now()
+		_, err = c.Announce(tracker.URL(), newUDPTrackerRequest(), TrackerRequestStarted)
+		So(err, ShouldEqual, ErrUDPTrackerTimeout)
+		So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 150*time.Millisecond)
+	})
+
+	Convey("Falling back from a silent tracker to the next tier", t, func() {
+		silent, err := newFakeUDPTracker("udp4", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer silent.Conn.Close()
+		silent.Drop = 100
+		silent.Start()
+
+		working := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "d8:completei1e10:incompletei2e8:intervali1800e5:peers0:e")
+		}))
+		defer working.Close()
+
+		req := newUDPTrackerRequest()
+		req.Tiers = structure.AnnounceList{[]string{silent.URL()}, []string{working.URL}}
+
+		// The spec's 15 second timeout is kept, only the deadline is short
+		tc := NewTrackerClient()
+		tc.UDP.Deadline = 100 * time.Millisecond
+		start := time.Now()
+		tr, err := tc.Announce(req, TrackerRequestStarted)
+		So(err, ShouldBeNil)
+		So(tr.Complete, ShouldEqual, 1)
+		So(req.AnnounceURL, ShouldEqual, working.URL)
+		So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+	})
+
+	Convey("Receiving an error from the tracker", t, func() {
+		tracker, err := newFakeUDPTracker("udp4", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer tracker.Conn.Close()
+		tracker.Error = "unregistered torrent"
+
+		tracker.Start()
+		c := newTestUDPTrackerClient()
+		_, err = c.Announce(tracker.URL(), newUDPTrackerRequest(), TrackerRequestStarted)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "unregistered torrent")
+	})
+
+	Convey("Announcing to an IPv6 UDP tracker", t, func() {
+		tracker, err := newFakeUDPTracker("udp6", "[::1]:0")
+		if err != nil {
+			t.Skip("IPv6 is not available")
+		}
+		defer tracker.Conn.Close()
+		peer := net.ParseIP("2001:db8::1")
+		tracker.Peers = append(append([]byte{}, peer...), 0x1a, 0xe1)
+
+		tracker.Start()
+		c := newTestUDPTrackerClient()
+		tr, err := c.Announce(tracker.URL(), newUDPTrackerRequest(), TrackerRequestStarted)
+		So(err, ShouldBeNil)
+		So(tr.Peers, ShouldHaveLength, 1)
+		So(tr.Peers[0].IP.String(), ShouldEqual, "2001:db8::1")
+		So(tr.Peers[0].Port, ShouldEqual, 6881)
+	})
+
+	Convey("Receiving an announce response with many peers", t, func() {
+		tracker, err := newFakeUDPTracker("udp4", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer tracker.Conn.Close()
+		for i := 0; i < 1000; i++ {
+			tracker.Peers = append(tracker.Peers, 10, 0, byte(i>>8), byte(i), 0x1a, 0xe1)
+		}
+
+		tracker.Start()
+		c := newTestUDPTrackerClient()
+		tr, err := c.Announce(tracker.URL(), newUDPTrackerRequest(), TrackerRequestStarted)
+		So(err, ShouldBeNil)
+		So(tr.Peers, ShouldHaveLength, 1000)
+		So(tr.Peers[999].String(), ShouldEqual, "10.0.3.231:6881")
+	})
+
+	Convey("Validating the request like the HTTP tracker client", t, func() {
+		req := newUDPTrackerRequest()
+		req.PeerID = "short"
+		_, err := newTestUDPTrackerClient().Announce("udp://127.0.0.1:1/announce", req, TrackerRequestStarted)
+		So(err, ShouldResemble, req.Validate())
+	})
+
+	Convey("Scraping a UDP tracker", t, func() {
+		tracker, err := newFakeUDPTracker("udp4", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer tracker.Conn.Close()
+
+		first, _ := structure.NewInfoHash([]byte("\x01aaaaaaaaaaaaaaaaaaa"))
+		second, _ := structure.NewInfoHash([]byte("\x02bbbbbbbbbbbbbbbbbbb"))
+		tracker.Start()
+		c := newTestUDPTrackerClient()
+		files, err := c.Scrape(tracker.URL(), first, second)
+		So(err, ShouldBeNil)
+		So(files[first], ShouldResemble, structure.ScrapeFile{Complete: 1, Downloaded: 2, Incomplete: 3})
+		So(files[second], ShouldResemble, structure.ScrapeFile{Complete: 2, Downloaded: 4, Incomplete: 6})
+
+		_, err = c.Scrape(tracker.URL(), make([]structure.InfoHash, udpMaxScrapeHashes+1)...)
+		So(err, ShouldEqual, ErrUDPTooManyHashes)
+	})
+
+	Convey("TrackerClient dispatches udp:// URLs", t, func() {
+		tracker, err := newFakeUDPTracker("udp4", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer tracker.Conn.Close()
+
+		tracker.Start()
+		tc := NewTrackerClient()
+		tc.UDP = newTestUDPTrackerClient()
+		req := newUDPTrackerRequest()
+		req.Tiers = structure.AnnounceList{[]string{tracker.URL()}}
+		tr, err := tc.Announce(req, TrackerRequestStarted)
+		So(err, ShouldBeNil)
+		So(tr.Complete, ShouldEqual, 7)
+	})
+
+	Convey("TrackerClient scrapes many infohashes in batches", t, func() {
+		tracker, err := newFakeUDPTracker("udp4", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer tracker.Conn.Close()
+
+		hashes := make([]structure.InfoHash, 100)
+		for i := range hashes {
+			hashes[i], _ = structure.NewInfoHash([]byte(string([]byte{byte(i)}) + "aaaaaaaaaaaaaaaaaaa"))
+		}
+		tracker.Start()
+		tc := NewTrackerClient()
+		tc.UDP = newTestUDPTrackerClient()
+		files, err := tc.Scrape(tracker.URL(), hashes...)
+		So(err, ShouldBeNil)
+		So(files, ShouldHaveLength, 100)
+		So(files[hashes[99]], ShouldResemble, structure.ScrapeFile{Complete: 99, Downloaded: 198, Incomplete: 297})
+		So(tracker.Connects(), ShouldEqual, 1)
+		So(len(tracker.Request(2)), ShouldEqual, 16+20*(100-udpMaxScrapeHashes))
+	})
+}
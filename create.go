@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/stratospark/torro/structure"
+	"io"
+	"strings"
+)
+
+const createUsage = `Usage: torro create <path> [-o out.torrent] [-a announce]... [options]
+
+Creates a torrent of a file, or of every file under a directory. Each
+-a adds a tracker in its own tier; the first one is the announce URL.
+`
+
+/*
+stringsFlag collects every value of a flag that may be repeated.
+*/
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+/*
+createCommand implements "torro create". It returns the exit status.
+*/
+func createCommand(args []string, stdout, stderr io.Writer) int {
+	// Allow the path before the flags, as in the usage
+	var path string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		path, args = args[0], args[1:]
+	}
+
+	flags := flag.NewFlagSet("create", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, createUsage)
+		flags.PrintDefaults()
+	}
+	var trackers stringsFlag
+	flags.Var(&trackers, "a", "tracker announce URL, may be repeated")
+	pOutput := flags.String("o", "", "output file (default <name>.torrent)")
+	pComment := flags.String("comment", "", "comment")
+	pSource := flags.String("source", "", "source, to give private trackers distinct info hashes")
+	pPrivate := flags.Bool("private", false, "only use the torrent's trackers to find peers")
+	pPieceLength := flags.Int64("piece-length", 0, "piece length in bytes (default chosen from the total size)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if path == "" && flags.NArg() > 0 {
+		path = flags.Arg(0)
+	}
+	if path == "" {
+		flags.Usage()
+		return 2
+	}
+
+	b := structure.NewMetainfoBuilder(path)
+	for _, tracker := range trackers {
+		b.AnnounceList = append(b.AnnounceList, []string{tracker})
+	}
+	b.Comment = *pComment
+	b.Source = *pSource
+	b.Private = *pPrivate
+	b.PieceLength = *pPieceLength
+
+	output := *pOutput
+	if output == "" {
+		output = b.Name + ".torrent"
+	}
+	if err := b.WriteFile(output); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	fmt.Fprintln(stdout, "Created", output)
+	return 0
+}
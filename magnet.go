@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stratospark/torro/client"
+	"github.com/stratospark/torro/structure"
+	"log"
+	"net"
+	"time"
+)
+
+// metadataTimeout bounds how long the metadata of a magnet link is fetched
+const metadataTimeout = 2 * time.Minute
+
+/*
+fetchMetainfo fetches the metadata of the torrent of a magnet link
+from the peers given in the link and those returned by its trackers,
+and returns the torrent's Metainfo.
+*/
+func fetchMetainfo(m *structure.Magnet, externalIP net.IP) (*structure.Metainfo, error) {
+	port := 55555
+	s := client.NewBTService(port, []byte(structure.SessionPeerID))
+	s.ExternalIP = externalIP
+	s.AddMagnet(m)
+	if err := s.StartListening(); err != nil {
+		return nil, err
+	}
+	defer s.StopListening()
+
+	responses := make(chan []structure.Peer, 1)
+	if len(m.Trackers) > 0 {
+		tiers := make([][]string, 0, len(m.Trackers))
+		for _, tracker := range m.Trackers {
+			tiers = append(tiers, []string{tracker})
+		}
+		req := structure.NewTrackerRequest(&structure.Metainfo{
+			AnnounceList: structure.NewAnnounceList("", tiers),
+			Info:         structure.Info{Hash: m.InfoHash},
+		})
+		req.Port = port
+		req.Compact = true
+		if externalIP != nil {
+			req.IP = externalIP.String()
+		}
+		// The size of the torrent is not known yet, but announcing
+		// nothing left would make trackers leave out the seeders
+		left := int64(1)
+		req.Remaining = &left
+
+		go func() {
+			res, err := client.NewTrackerClient().Announce(req, "")
+			if err != nil {
+				log.Println("Announce failed:", err)
+				return
+			}
+			responses <- res.Peers
+		}()
+	}
+
+	s.InitiateHandshakes(m.InfoHash, magnetPeers(m))
+	timeout := time.After(metadataTimeout)
+	for {
+		select {
+		case metainfo := <-s.MetainfoChan:
+			return metainfo, nil
+		case peers := <-responses:
+			s.InitiateHandshakes(m.InfoHash, peers)
+		case <-timeout:
+			return nil, errors.New(fmt.Sprint("No Peer Sent The Metadata Within ", metadataTimeout))
+		}
+	}
+}
+
+/*
+magnetPeers resolves the peer addresses given in a magnet link,
+skipping those that cannot be resolved.
+*/
+func magnetPeers(m *structure.Magnet) []structure.Peer {
+	peers := make([]structure.Peer, 0, len(m.Peers))
+	for _, addr := range m.Peers {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			log.Printf("Cannot resolve magnet peer %s: %s", addr, err)
+			continue
+		}
+		peers = append(peers, structure.Peer{IP: tcpAddr.IP, Port: uint16(tcpAddr.Port)})
+	}
+	return peers
+}
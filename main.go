@@ -11,11 +11,28 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"strings"
 	"time"
 )
 
+// announceTimeout bounds how long -announce waits for the first response
+const announceTimeout = 2 * time.Minute
+
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bencode":
+			os.Exit(bencodeCommand(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+		case "create":
+			os.Exit(createCommand(os.Args[2:], os.Stdout, os.Stderr))
+		case "tracker":
+			os.Exit(trackerCommand(os.Args[2:], os.Stderr))
+		}
+	}
+
 	// Set up logging to file and stdout
 	f, err := os.OpenFile("torro.log", os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
 	if err != nil {
@@ -28,7 +45,7 @@ func main() {
 	println("TORRO!\n\n\n")
 
 	// Read command line flags and arguments
-	pPrint := flag.String("print", "metainfo", "either tokens, parsed, or metainfo")
+	pPrint := flag.String("print", "metainfo", "either tokens, parsed, metainfo or magnet")
 	pUPNP := flag.Bool("upnp", false, "open port through UPNP")
 	pAnnounce := flag.Bool("announce", false, "send announce request to tracker")
 	flag.Parse()
@@ -41,64 +58,128 @@ func main() {
 		filename = "testfiles/TheInternetsOwnBoyTheStoryOfAaronSwartz_archive.torrent"
 	}
 
+	// externalIP is our address as seen by peers: the one found by UPnP
+	// or, failing that, the one reported by the tracker
+	var externalIP net.IP
 	if *pUPNP {
 		fmt.Println("Opening port through UPNP")
-		d, _ := upnp.Discover()
-		ip, _ := d.ExternalIP()
-		_ = d.Forward(55555, "torro")
-		defer d.Clear(55555)
-		log.Printf("Discovered: %q\n", d)
-		log.Printf("External IP: %q\n", ip)
-		log.Printf("Location: %q\n", d.Location())
-	}
-
-	// Read actual .torrent file
-	fmt.Println("Parsing: ", filename)
-	data, err := ioutil.ReadFile(filename)
-	if err != nil {
-		panic(err)
+		if d, err := upnp.Discover(); err != nil {
+			log.Println("UPNP discovery failed:", err)
+		} else {
+			ip, _ := d.ExternalIP()
+			_ = d.Forward(55555, "torro")
+			defer d.Clear(55555)
+			externalIP = net.ParseIP(ip)
+			log.Printf("Discovered: %q\n", d)
+			log.Printf("External IP: %q\n", ip)
+			log.Printf("Location: %q\n", d.Location())
+		}
 	}
 
-	// Lex and Parse .torrent file
-	torrentStr := string(data)
-	lex := bencoding.BeginLexing(".torrent", torrentStr, bencoding.LexBegin)
-	tokens := bencoding.Collect(lex)
+	var metainfo *structure.Metainfo
+	var tokens []bencoding.Token
+	var root *bencoding.Container
+	if strings.HasPrefix(filename, "magnet:") {
+		m, err := structure.ParseMagnet(filename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid magnet link:", err)
+			os.Exit(1)
+		}
+		PrintMagnet(m)
 
-	output := bencoding.Parse(tokens)
-	result := output.Output.(map[string]interface{})
+		// Fetch the metadata from peers, then carry on as if the
+		// .torrent file had been given
+		fmt.Println("Fetching metadata from peers")
+		metainfo, err = fetchMetainfo(m, externalIP)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Fetching metadata failed:", err)
+			os.Exit(1)
+		}
+	} else {
+		// Read actual .torrent file
+		fmt.Println("Parsing: ", filename)
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot read torrent:", err)
+			os.Exit(1)
+		}
 
-	// Read .torrent metainfo and make request to the announce URL
-	metainfo := structure.NewMetainfo(filename)
+		// Read .torrent metainfo and make request to the announce URL
+		metainfo, err = structure.ParseMetainfo(data)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid torrent:", err)
+			os.Exit(1)
+		}
+
+		// Lex and Parse .torrent file
+		lex := bencoding.BeginLexingBytes(".torrent", data, bencoding.LexBegin)
+		tokens = bencoding.Collect(lex)
+
+		root, err = bencoding.ParseContainer(tokens)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid torrent:", err)
+			os.Exit(1)
+		}
+	}
 
 	c := client.NewTrackerClient()
 	req := structure.NewTrackerRequest(metainfo)
-	req.PeerID = "-qB3230-u~QGMmUs~yXH"
 	req.Port = 55555
 	req.Compact = true
 	req.NoPeerID = true
+	if externalIP != nil {
+		req.IP = externalIP.String()
+	}
 
 	if *pAnnounce {
-		res, err := c.MakeAnnounceRequest(req, client.TrackerRequestStarted)
-		if err != nil {
-			fmt.Println(res.FailureReason)
-			panic(err.Error())
+		announcer := client.NewAnnouncer(c, req, func() client.AnnounceStats {
+			return client.AnnounceStats{Left: metainfo.Info.TotalBytes}
+		})
+		announcer.Start()
+		defer announcer.Stop()
+
+		// The announcer keeps retrying failed announces, so give up on
+		// the first failure instead of waiting for a response forever
+		var res *structure.TrackerResponse
+		select {
+		case res = <-announcer.Responses:
+		case err := <-announcer.Errors:
+			fmt.Fprintln(os.Stderr, "Announce failed:", err)
+			os.Exit(1)
+		case <-time.After(announceTimeout):
+			fmt.Fprintln(os.Stderr, "Announce failed: no response from any tracker after", announceTimeout)
+			os.Exit(1)
 		}
 		fmt.Println(res)
+		if res.WarningMessage != "" {
+			fmt.Println("Tracker Warning:", res.WarningMessage)
+		}
+		if ip := c.ExternalIP(); ip != nil && externalIP == nil {
+			externalIP = ip
+			log.Println("External IP reported by tracker:", ip)
+		}
 
 		log.Println("StartListening")
 		port := 55555
-		peerId := []byte("-TR2840-nj5ovtkoz2ed")
-		s := client.NewBTService(port, peerId)
+		s := client.NewBTService(port, []byte(req.PeerID))
+		s.ExternalIP = externalIP
+		s.AddHash(metainfo.Info.Hash)
 		s.StartListening()
+		s.InitiateHandshakes(metainfo.Info.Hash, res.Peers)
 	}
 
 	switch *pPrint {
 	case "tokens":
 		PrintTokens(&tokens)
 	case "parsed":
-		PrintParsedStructure(result)
+		// Torrents added by magnet link have no .torrent file to show
+		if root != nil {
+			PrintParsedStructure(root)
+		}
 	case "metainfo":
 		PrintMetainfo(metainfo)
+	case "magnet":
+		fmt.Println(metainfo.Magnet())
 	default:
 		PrintMetainfo(metainfo)
 	}
@@ -114,61 +195,61 @@ func PrintTokens(tokens *[]bencoding.Token) {
 	}
 }
 
-func PrintParsedStructure(result map[string]interface{}) {
+func PrintParsedStructure(root *bencoding.Container) {
 
-	conv := func(val interface{}) string {
-		b, _ := val.([]uint8)
-		return string(b)
+	str := func(path ...interface{}) string {
+		val, _ := root.Get(path...)
+		s, _ := val.AsString()
+		return s
+	}
+	num := func(path ...interface{}) interface{} {
+		val, _ := root.Get(path...)
+		if n, ok := val.AsInt(); ok {
+			return n
+		}
+		return nil
 	}
 
-	pretty.Println("Announce: ", conv(result["announce"]))
-	pretty.Println("Announce-List", conv(result["annnounce-list"]))
+	pretty.Println("Announce: ", str("announce"))
+	if tiers, ok := root.Get("announce-list"); ok {
+		list, _ := tiers.AsList()
+		for i := range list {
+			pretty.Println("Announce-List", i, ":", str("announce-list", i, 0))
+		}
+	}
 
-	if result["creation date"] != nil {
-		creationDate := int64(result["creation date"].(int))
+	if creationDate, ok := num("creation date").(int64); ok {
 		t := time.Unix(creationDate, 0)
 		pretty.Println("Creation Date:", t.String())
 	}
 
-	pretty.Println("Comment:", conv(result["comment"]))
-	pretty.Println("Created by:", conv(result["created by"]))
-	pretty.Println("Encoding:", conv(result["encoding"]))
-
-	info := result["info"].(map[string]interface{})
-	pretty.Println("Info Piece Length:", info["piece length"])
-	pretty.Println("Info Private:", info["private"])
-
-	pretty.Println("Info/Name:", conv(info["name"]))
-	pretty.Println("Info/piece length:", info["piece length"])
-	pretty.Println("Info/pieces:", len(conv(info["pieces"])))
-	pretty.Println("Info/pieces/20:", len(conv(info["pieces"]))/20)
-	//	pretty.Println("Info/pieces:", info["pieces"].(string)[:4])
-	pretty.Println("Info/Length:", info["length"])
-	pretty.Println("Info/md5sum:", info["md5sum"])
-	//	pretty.Println("Info/files:", info["files"])
-
-	if info["files"] != nil {
-		files := info["files"].([]interface{})
-		for i, val := range files {
-			//		pretty.Println(i, ": ", val)
-			pretty.Println("\n\n", i)
-			file := val.(map[string]interface{})
-			for key, val2 := range file {
-				switch val2.(type) {
-				case int:
-					pretty.Println(key, ": ", val2)
-				case []uint8:
-					pretty.Println(key, ": ", conv(val2))
-				case []interface{}:
-					path := val2.([]interface{})
-					pretty.Println("Paths:")
-					for _, val3 := range path {
-						pretty.Println("\t\t", conv(val3))
-					}
-				default:
-					pretty.Println(key, ": ", val2)
-				}
-			}
+	pretty.Println("Comment:", str("comment"))
+	pretty.Println("Created by:", str("created by"))
+	pretty.Println("Encoding:", str("encoding"))
+
+	pretty.Println("Info Piece Length:", num("info", "piece length"))
+	pretty.Println("Info Private:", num("info", "private"))
+
+	pretty.Println("Info/Name:", str("info", "name"))
+	pretty.Println("Info/piece length:", num("info", "piece length"))
+	pretty.Println("Info/pieces:", len(str("info", "pieces")))
+	pretty.Println("Info/pieces/20:", len(str("info", "pieces"))/20)
+	pretty.Println("Info/Length:", num("info", "length"))
+	pretty.Println("Info/md5sum:", str("info", "md5sum"))
+
+	files, _ := root.Get("info", "files")
+	fileList, _ := files.AsList()
+	for i := range fileList {
+		pretty.Println("\n\n", i)
+		pretty.Println("length: ", num("info", "files", i, "length"))
+		if md5sum := str("info", "files", i, "md5sum"); md5sum != "" {
+			pretty.Println("md5sum: ", md5sum)
+		}
+		pretty.Println("Paths:")
+		path, _ := root.Get("info", "files", i, "path")
+		parts, _ := path.AsList()
+		for j := range parts {
+			pretty.Println("\t\t", str("info", "files", i, "path", j))
 		}
 	}
 }
@@ -176,3 +257,14 @@ func PrintParsedStructure(result map[string]interface{}) {
 func PrintMetainfo(metainfo *structure.Metainfo) {
 	fmt.Println(metainfo.Announce)
 }
+
+func PrintMagnet(m *structure.Magnet) {
+	fmt.Println("Info Hash:", m.InfoHash)
+	fmt.Println("Name:", m.DisplayName)
+	for _, tracker := range m.Trackers {
+		fmt.Println("Tracker:", tracker)
+	}
+	for _, peer := range m.Peers {
+		fmt.Println("Peer:", peer)
+	}
+}
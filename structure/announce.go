@@ -0,0 +1,69 @@
+package structure
+
+import (
+	"math/rand"
+)
+
+/*
+AnnounceList holds tracker URLs grouped into tiers, as described in
+BEP 12. Trackers in earlier tiers are tried first, and trackers within
+a tier are tried in order until one of them responds.
+*/
+type AnnounceList [][]string
+
+/*
+NewAnnounceList returns a copy of tiers that is safe to reorder. If
+there are no tiers, the single announce URL is used as the only tier.
+*/
+func NewAnnounceList(announce string, tiers [][]string) AnnounceList {
+	list := make(AnnounceList, 0, len(tiers))
+	for _, tier := range tiers {
+		if len(tier) == 0 {
+			continue
+		}
+		list = append(list, append([]string{}, tier...))
+	}
+	if len(list) == 0 && announce != "" {
+		list = append(list, []string{announce})
+	}
+	return list
+}
+
+/*
+Shuffle randomizes the order of the trackers within each tier. This
+should be done once, when the list is first loaded.
+*/
+func (al AnnounceList) Shuffle() {
+	for _, tier := range al {
+		rand.Shuffle(len(tier), func(i, j int) {
+			tier[i], tier[j] = tier[j], tier[i]
+		})
+	}
+}
+
+/*
+Promote moves the tracker at the given position to the front of its
+tier, after a successful announce to it.
+*/
+func (al AnnounceList) Promote(tier, index int) {
+	if tier < 0 || tier >= len(al) || index <= 0 || index >= len(al[tier]) {
+		return
+	}
+	url := al[tier][index]
+	copy(al[tier][1:index+1], al[tier][:index])
+	al[tier][0] = url
+}
+
+/*
+Contains reports whether url is in any tier.
+*/
+func (al AnnounceList) Contains(url string) bool {
+	for _, tier := range al {
+		for _, u := range tier {
+			if u == url {
+				return true
+			}
+		}
+	}
+	return false
+}
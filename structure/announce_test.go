@@ -0,0 +1,50 @@
+package structure
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"sort"
+	"testing"
+)
+
+func TestAnnounceList(t *testing.T) {
+	Convey("Creating an announce list", t, func() {
+		Convey("Falls back to the announce URL", func() {
+			So(NewAnnounceList("http://a/announce", nil), ShouldResemble, AnnounceList{[]string{"http://a/announce"}})
+			So(NewAnnounceList("", nil), ShouldBeEmpty)
+		})
+
+		Convey("Skips empty tiers and copies the rest", func() {
+			tiers := [][]string{[]string{"a", "b"}, []string{}, []string{"c"}}
+			list := NewAnnounceList("x", tiers)
+			So(list, ShouldResemble, AnnounceList{[]string{"a", "b"}, []string{"c"}})
+
+			list[0][0] = "changed"
+			So(tiers[0][0], ShouldEqual, "a")
+		})
+	})
+
+	Convey("Shuffling keeps trackers within their tier", t, func() {
+		list := AnnounceList{[]string{"a", "b", "c", "d"}, []string{"e", "f"}}
+		list.Shuffle()
+		So(list, ShouldHaveLength, 2)
+
+		first := append([]string{}, list[0]...)
+		sort.Strings(first)
+		So(first, ShouldResemble, []string{"a", "b", "c", "d"})
+
+		second := append([]string{}, list[1]...)
+		sort.Strings(second)
+		So(second, ShouldResemble, []string{"e", "f"})
+	})
+
+	Convey("Promoting a tracker moves it to the front of its tier", t, func() {
+		list := AnnounceList{[]string{"a", "b", "c", "d"}, []string{"e"}}
+		list.Promote(0, 2)
+		So(list, ShouldResemble, AnnounceList{[]string{"c", "a", "b", "d"}, []string{"e"}})
+
+		list.Promote(0, 0)
+		list.Promote(1, 3)
+		list.Promote(5, 0)
+		So(list, ShouldResemble, AnnounceList{[]string{"c", "a", "b", "d"}, []string{"e"}})
+	})
+}
@@ -0,0 +1,334 @@
+package structure
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"github.com/stratospark/torro/bencoding"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoFiles          = errors.New("No Files To Add To The Torrent")
+	ErrFileChanged      = errors.New("File Changed While Hashing")
+	ErrInvalidName      = errors.New("Invalid Torrent Name")
+	ErrPieceLengthRange = errors.New("Piece Length Must Be A Power Of Two Between 16 KiB And 16 MiB")
+)
+
+const (
+	minPieceLength = 16 * 1024
+	maxPieceLength = 16 * 1024 * 1024
+	// Piece lengths are chosen to give about this many pieces
+	targetPieces = 1500
+)
+
+/*
+MetainfoBuilder creates a torrent of a file or of every regular file
+under a directory. A PieceLength of zero chooses one from the total
+size, otherwise it must be a power of two between 16 KiB and 16 MiB.
+A zero CreationDate uses the time Build is called.
+*/
+type MetainfoBuilder struct {
+	Path         string
+	Name         string
+	PieceLength  int64
+	Announce     string
+	AnnounceList [][]string
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time
+	Private      bool
+	Source       string
+	Workers      int
+}
+
+/*
+NewMetainfoBuilder returns a builder for the file or directory at path,
+named after its last element, so that "." is named after the current
+directory.
+*/
+func NewMetainfoBuilder(path string) *MetainfoBuilder {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = filepath.Clean(path)
+	}
+	return &MetainfoBuilder{
+		Path:      path,
+		Name:      filepath.Base(abs),
+		CreatedBy: "torro",
+		Workers:   runtime.NumCPU(),
+	}
+}
+
+/*
+PieceLengthFor returns a power of two piece length between 16 KiB and
+16 MiB that splits totalBytes into about 1500 pieces.
+*/
+func PieceLengthFor(totalBytes int64) int64 {
+	pieceLength := int64(minPieceLength)
+	for pieceLength < maxPieceLength && totalBytes/pieceLength > targetPieces {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+type fileDict struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+type infoDict struct {
+	Files       []fileDict `bencode:"files,omitempty"`
+	Length      *int64     `bencode:"length,omitempty"`
+	Name        string     `bencode:"name"`
+	PieceLength int64      `bencode:"piece length"`
+	Pieces      []byte     `bencode:"pieces"`
+	Private     bool       `bencode:"private,omitempty"`
+	Source      string     `bencode:"source,omitempty"`
+}
+
+type metainfoDict struct {
+	Announce     string     `bencode:"announce,omitempty"`
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+	Comment      string     `bencode:"comment,omitempty"`
+	CreatedBy    string     `bencode:"created by,omitempty"`
+	CreationDate int64      `bencode:"creation date"`
+	Info         infoDict   `bencode:"info"`
+}
+
+/*
+sourceFile is a file to be added, at offset bytes into the torrent.
+*/
+type sourceFile struct {
+	osPath string
+	path   []string
+	offset int64
+	length int64
+}
+
+/*
+Build hashes the files and returns the bencoded torrent.
+*/
+func (b *MetainfoBuilder) Build() ([]byte, error) {
+	if !validPathComponent(b.Name) {
+		return nil, ErrInvalidName
+	}
+	if b.PieceLength != 0 && (b.PieceLength < minPieceLength || b.PieceLength > maxPieceLength ||
+		b.PieceLength&(b.PieceLength-1) != 0) {
+		return nil, ErrPieceLengthRange
+	}
+	root, err := os.Stat(b.Path)
+	if err != nil {
+		return nil, err
+	}
+	files, err := b.findFiles(root.IsDir())
+	if err != nil {
+		return nil, err
+	}
+
+	totalBytes := int64(0)
+	for _, file := range files {
+		totalBytes += file.length
+	}
+	pieceLength := b.PieceLength
+	if pieceLength == 0 {
+		pieceLength = PieceLengthFor(totalBytes)
+	}
+
+	pieces, err := hashPieces(files, totalBytes, pieceLength, b.Workers)
+	if err != nil {
+		return nil, err
+	}
+
+	info := infoDict{
+		Name:        b.Name,
+		PieceLength: pieceLength,
+		Pieces:      pieces,
+		Private:     b.Private,
+		Source:      b.Source,
+	}
+	if root.IsDir() {
+		for _, file := range files {
+			info.Files = append(info.Files, fileDict{Length: file.length, Path: file.path})
+		}
+	} else {
+		info.Length = &totalBytes
+	}
+
+	creationDate := b.CreationDate
+	if creationDate.IsZero() {
+		creationDate = time.Now()
+	}
+	// Clients that support announce-list ignore announce, so it is
+	// added as the first tier if the list does not contain it
+	announceList := NewAnnounceList("", b.AnnounceList)
+	announce := b.Announce
+	if announce == "" && len(announceList) > 0 {
+		announce = announceList[0][0]
+	}
+	if len(announceList) > 0 && !announceList.Contains(announce) {
+		announceList = append(AnnounceList{[]string{announce}}, announceList...)
+	}
+
+	return bencoding.Marshal(metainfoDict{
+		Announce:     announce,
+		AnnounceList: announceList,
+		Comment:      b.Comment,
+		CreatedBy:    b.CreatedBy,
+		CreationDate: creationDate.Unix(),
+		Info:         info,
+	})
+}
+
+/*
+WriteFile builds the torrent and writes it to filename.
+*/
+func (b *MetainfoBuilder) WriteFile(filename string) error {
+	data, err := b.Build()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
+
+/*
+findFiles lists the regular files to add in lexical order, skipping
+symlinks and other special files. Files with names that torrents may
+not contain, such as ones with a backslash, are an error.
+*/
+func (b *MetainfoBuilder) findFiles(isDir bool) ([]sourceFile, error) {
+	files := make([]sourceFile, 0)
+	offset := int64(0)
+	err := filepath.Walk(b.Path, func(osPath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(b.Path, osPath)
+		if err != nil {
+			return err
+		}
+		file := sourceFile{osPath: osPath, offset: offset, length: fi.Size()}
+		if isDir {
+			file.path = splitPath(rel)
+			for _, component := range file.path {
+				if !validPathComponent(component) {
+					return errors.New(fmt.Sprint("Invalid File Path: ", osPath))
+				}
+			}
+		}
+		files = append(files, file)
+		offset += fi.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, ErrNoFiles
+	}
+	return files, nil
+}
+
+func splitPath(path string) []string {
+	dir, file := filepath.Split(path)
+	if dir == "" {
+		return []string{file}
+	}
+	return append(splitPath(filepath.Clean(dir)), file)
+}
+
+/*
+hashPieces returns the concatenated SHA1 hashes of every piece of the
+files, hashing pieces on the given number of goroutines.
+*/
+func hashPieces(files []sourceFile, totalBytes, pieceLength int64, workers int) ([]byte, error) {
+	numPieces := int((totalBytes + pieceLength - 1) / pieceLength)
+	pieces := make([]byte, numPieces*sha1.Size)
+	if workers < 1 {
+		workers = 1
+	}
+
+	indexes := make(chan int)
+	errs := make(chan error, workers)
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, pieceLength)
+			for i := range indexes {
+				start := int64(i) * pieceLength
+				end := start + pieceLength
+				if end > totalBytes {
+					end = totalBytes
+				}
+				if err := readFiles(files, buf[:end-start], start); err != nil {
+					errs <- err
+					// Keep draining so that the producer does not block
+					for range indexes {
+					}
+					return
+				}
+				sum := sha1.Sum(buf[:end-start])
+				copy(pieces[i*sha1.Size:], sum[:])
+			}
+		}()
+	}
+
+	for i := 0; i < numPieces; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return nil, err
+	default:
+		return pieces, nil
+	}
+}
+
+/*
+readFiles fills buf with the bytes of the torrent starting at offset,
+reading across file boundaries.
+*/
+func readFiles(files []sourceFile, buf []byte, offset int64) error {
+	for _, file := range files {
+		if len(buf) == 0 {
+			break
+		}
+		if offset >= file.offset+file.length || file.length == 0 {
+			continue
+		}
+		n := file.offset + file.length - offset
+		if n > int64(len(buf)) {
+			n = int64(len(buf))
+		}
+
+		f, err := os.Open(file.osPath)
+		if err != nil {
+			return err
+		}
+		_, err = f.ReadAt(buf[:n], offset-file.offset)
+		f.Close()
+		if err == io.EOF {
+			return ErrFileChanged
+		}
+		if err != nil {
+			return err
+		}
+		buf = buf[n:]
+		offset += n
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package structure
+
+import (
+	"bytes"
+	"crypto/sha1"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestFiles(dir string, files map[string]string) {
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte(contents), 0644)
+	}
+}
+
+func sequentialPieces(data []byte, pieceLength int) [][sha1.Size]byte {
+	pieces := make([][sha1.Size]byte, 0)
+	for start := 0; start < len(data); start += pieceLength {
+		end := start + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		pieces = append(pieces, sha1.Sum(data[start:end]))
+	}
+	return pieces
+}
+
+func TestMetainfoBuilder(t *testing.T) {
+	Convey("Creating a torrent of a directory", t, func() {
+		dir, err := ioutil.TempDir("", "torro")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		a := string(bytes.Repeat([]byte("a"), 40000))
+		b := string(bytes.Repeat([]byte("b"), 10))
+		c := string(bytes.Repeat([]byte("c"), 30000))
+		writeTestFiles(dir, map[string]string{
+			"artifacts/a.bin":     a,
+			"artifacts/b/b.bin":   b,
+			"artifacts/c.bin":     c,
+			"artifacts/empty.txt": "",
+		})
+
+		builder := NewMetainfoBuilder(filepath.Join(dir, "artifacts") + "/")
+		So(builder.Name, ShouldEqual, "artifacts")
+		builder.Announce = "http://tracker.example.com/announce"
+		builder.AnnounceList = [][]string{{"udp://tracker.example.com:6969"}}
+		builder.Comment = "nightly build"
+		builder.Private = true
+		builder.Source = "builds"
+		builder.CreationDate = time.Unix(1500000000, 0)
+		builder.Workers = 3
+
+		output := filepath.Join(dir, "artifacts.torrent")
+		So(builder.WriteFile(output), ShouldBeNil)
+
+		metainfo, _ := NewMetainfo(output)
+		So(metainfo.Announce, ShouldEqual, "http://tracker.example.com/announce")
+		So(metainfo.AnnounceList, ShouldResemble, AnnounceList{
+			{"http://tracker.example.com/announce"},
+			{"udp://tracker.example.com:6969"},
+		})
+		So(metainfo.Comment, ShouldEqual, "nightly build")
+		So(metainfo.CreatedBy, ShouldEqual, "torro")
+		So(metainfo.CreationDate.Unix(), ShouldEqual, 1500000000)
+
+		info := metainfo.Info
+		So(info.Mode, ShouldEqual, InfoModeMultiple)
+		So(info.Name, ShouldEqual, "artifacts")
+		So(info.Private, ShouldBeTrue)
+		So(info.Source, ShouldEqual, "builds")
+		So(info.PieceLength, ShouldEqual, 16*1024)
+		So(info.TotalBytes, ShouldEqual, 70010)
+		So(info.Files, ShouldResemble, []File{
+			{Length: 40000, Path: "a.bin"},
+			{Length: 10, Path: "b/b.bin"},
+			{Length: 30000, Path: "c.bin"},
+			{Length: 0, Path: "empty.txt"},
+		})
+		So(info.Pieces, ShouldResemble, sequentialPieces([]byte(a+b+c), 16*1024))
+	})
+
+	Convey("Creating a torrent of a single file", t, func() {
+		dir, err := ioutil.TempDir("", "torro")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		data := bytes.Repeat([]byte("0123456789"), 5000)
+		writeTestFiles(dir, map[string]string{"build.tar": string(data)})
+
+		builder := NewMetainfoBuilder(filepath.Join(dir, "build.tar"))
+		builder.PieceLength = 32 * 1024
+		output := filepath.Join(dir, "build.torrent")
+		So(builder.WriteFile(output), ShouldBeNil)
+
+		metainfo, _ := NewMetainfo(output)
+		So(metainfo.Announce, ShouldEqual, "")
+		So(metainfo.Info.Mode, ShouldEqual, InfoModeSingle)
+		So(metainfo.Info.Name, ShouldEqual, "build.tar")
+		So(metainfo.Info.Length, ShouldEqual, 50000)
+		So(metainfo.Info.Pieces, ShouldResemble, sequentialPieces(data, 32*1024))
+	})
+
+	Convey("Failing without any files", t, func() {
+		dir, err := ioutil.TempDir("", "torro")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		_, err = NewMetainfoBuilder(dir).Build()
+		So(err, ShouldEqual, ErrNoFiles)
+		_, err = NewMetainfoBuilder(filepath.Join(dir, "missing")).Build()
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Rejecting invalid piece lengths", t, func() {
+		dir, err := ioutil.TempDir("", "torro")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		writeTestFiles(dir, map[string]string{"build.tar": "data"})
+
+		builder := NewMetainfoBuilder(filepath.Join(dir, "build.tar"))
+		for _, pieceLength := range []int64{1000, -1, 8 * 1024, 32 * 1024 * 1024, 48 * 1024} {
+			builder.PieceLength = pieceLength
+			_, err = builder.Build()
+			So(err, ShouldEqual, ErrPieceLengthRange)
+		}
+		builder.PieceLength = 16 * 1024 * 1024
+		_, err = builder.Build()
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Rejecting file names that torrents cannot contain", t, func() {
+		dir, err := ioutil.TempDir("", "torro")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		writeTestFiles(dir, map[string]string{
+			"artifacts/a.bin":      "a",
+			"artifacts/sub/b.bin":  "b",
+			"artifacts/back\\c.sh": "c",
+		})
+
+		_, err = NewMetainfoBuilder(filepath.Join(dir, "artifacts")).Build()
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "Invalid File Path")
+		So(err.Error(), ShouldContainSubstring, "back\\c.sh")
+
+		// Every torrent that is built can be parsed again
+		So(os.Remove(filepath.Join(dir, "artifacts", "back\\c.sh")), ShouldBeNil)
+		data, err := NewMetainfoBuilder(filepath.Join(dir, "artifacts")).Build()
+		So(err, ShouldBeNil)
+		metainfo, err := ParseMetainfo(data)
+		So(err, ShouldBeNil)
+		So(metainfo.Info.Files, ShouldHaveLength, 2)
+		So(metainfo.Info.Files[1].Path, ShouldEqual, "sub/b.bin")
+	})
+
+	Convey("Naming the torrent after the directory", t, func() {
+		dir, err := ioutil.TempDir("", "torro")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		wd, err := os.Getwd()
+		So(err, ShouldBeNil)
+		defer os.Chdir(wd)
+
+		So(os.Chdir(dir), ShouldBeNil)
+		So(NewMetainfoBuilder(".").Name, ShouldEqual, filepath.Base(dir))
+		So(NewMetainfoBuilder("./").Name, ShouldEqual, filepath.Base(dir))
+
+		builder := NewMetainfoBuilder("/")
+		So(builder.Name, ShouldEqual, "/")
+		_, err = builder.Build()
+		So(err, ShouldEqual, ErrInvalidName)
+		builder.Name = ".."
+		_, err = builder.Build()
+		So(err, ShouldEqual, ErrInvalidName)
+	})
+
+	Convey("Choosing a piece length", t, func() {
+		So(PieceLengthFor(0), ShouldEqual, 16*1024)
+		So(PieceLengthFor(100*1024*1024), ShouldEqual, 128*1024)
+		So(PieceLengthFor(4*1024*1024*1024), ShouldEqual, 4*1024*1024)
+		So(PieceLengthFor(1<<50), ShouldEqual, 16*1024*1024)
+	})
+}
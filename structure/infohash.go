@@ -0,0 +1,84 @@
+package structure
+
+import (
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+var ErrInvalidInfoHash = errors.New("Invalid Info Hash")
+
+/*
+InfoHash is the SHA1 hash of a torrent's bencoded info dictionary,
+which identifies the torrent to trackers and peers.
+*/
+type InfoHash [sha1.Size]byte
+
+/*
+NewInfoHash returns the info hash held in the 20 bytes of b.
+*/
+func NewInfoHash(b []byte) (InfoHash, error) {
+	var h InfoHash
+	if len(b) != len(h) {
+		return h, ErrInvalidInfoHash
+	}
+	copy(h[:], b)
+	return h, nil
+}
+
+/*
+HashInfo returns the info hash of the bencoded info dictionary info.
+*/
+func HashInfo(info []byte) InfoHash {
+	return InfoHash(sha1.Sum(info))
+}
+
+/*
+ParseInfoHash parses an info hash written in hex, as 40 characters,
+or in base32, as 32 characters. Either may be in any case.
+*/
+func ParseInfoHash(s string) (InfoHash, error) {
+	var b []byte
+	var err error
+	switch len(s) {
+	case 40:
+		b, err = hex.DecodeString(s)
+	case 32:
+		b, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return InfoHash{}, ErrInvalidInfoHash
+	}
+	if err != nil {
+		return InfoHash{}, ErrInvalidInfoHash
+	}
+	return NewInfoHash(b)
+}
+
+func (h InfoHash) Hex() string {
+	return hex.EncodeToString(h[:])
+}
+
+func (h InfoHash) Base32() string {
+	return base32.StdEncoding.EncodeToString(h[:])
+}
+
+/*
+URLEscaped returns the hash percent-encoded for the query of a tracker
+announce or scrape URL.
+*/
+func (h InfoHash) URLEscaped() string {
+	return escapeBinary(string(h[:]))
+}
+
+/*
+IsZero reports whether h is unset.
+*/
+func (h InfoHash) IsZero() bool {
+	return h == InfoHash{}
+}
+
+func (h InfoHash) String() string {
+	return h.Hex()
+}
@@ -0,0 +1,46 @@
+package structure
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestInfoHash(t *testing.T) {
+	Convey("Formatting an info hash", t, func() {
+		h, err := NewInfoHash([]byte("\x29\xeb\x26\xd6\xba\x89\x64\x9c\x10\x5d\xc8\xe2\x7e\xaf\xdc\x0c\x2e\xf6\x22\x92"))
+		So(err, ShouldBeNil)
+		So(h.Hex(), ShouldEqual, "29eb26d6ba89649c105dc8e27eafdc0c2ef62292")
+		So(h.String(), ShouldEqual, h.Hex())
+		So(h.Base32(), ShouldEqual, "FHVSNVV2RFSJYEC5ZDRH5L64BQXPMIUS")
+		So(h.URLEscaped(), ShouldEqual, "%29%EB%26%D6%BA%89d%9C%10%5D%C8%E2~%AF%DC%0C.%F6%22%92")
+		So(h.IsZero(), ShouldBeFalse)
+		So(InfoHash{}.IsZero(), ShouldBeTrue)
+	})
+
+	Convey("Parsing an info hash", t, func() {
+		expected, _ := NewInfoHash([]byte("\x29\xeb\x26\xd6\xba\x89\x64\x9c\x10\x5d\xc8\xe2\x7e\xaf\xdc\x0c\x2e\xf6\x22\x92"))
+		for _, s := range []string{
+			"29eb26d6ba89649c105dc8e27eafdc0c2ef62292",
+			"29EB26D6BA89649C105DC8E27EAFDC0C2EF62292",
+			"FHVSNVV2RFSJYEC5ZDRH5L64BQXPMIUS",
+			"fhvsnvv2rfsjyec5zdrh5l64bqxpmius",
+		} {
+			h, err := ParseInfoHash(s)
+			So(err, ShouldBeNil)
+			So(h, ShouldEqual, expected)
+		}
+
+		for _, s := range []string{"", "29eb26", "zz" + expected.Hex()[2:], "11111111111111111111111111111111"} {
+			_, err := ParseInfoHash(s)
+			So(err, ShouldEqual, ErrInvalidInfoHash)
+		}
+		_, err := NewInfoHash([]byte("short"))
+		So(err, ShouldEqual, ErrInvalidInfoHash)
+	})
+
+	Convey("Hashing an info dictionary", t, func() {
+		metainfo, err := NewMetainfo("../testfiles/ubuntu.torrent")
+		So(err, ShouldBeNil)
+		So(HashInfo(readInfoDict("../testfiles/ubuntu.torrent")), ShouldEqual, metainfo.Info.Hash)
+	})
+}
@@ -0,0 +1,161 @@
+package structure
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNotMagnet         = errors.New("Not A Magnet Link")
+	ErrMagnetNoInfoHash  = errors.New("Magnet Link Has No BitTorrent Info Hash")
+	ErrMagnetBadInfoHash = errors.New("Invalid Magnet Info Hash")
+)
+
+const btihPrefix = "urn:btih:"
+
+/*
+MaxMagnetSelectOnly limits the number of file indexes a magnet link
+may select, so that a range such as "0-200000000" cannot exhaust memory.
+*/
+const MaxMagnetSelectOnly = 1 << 20
+
+/*
+Magnet holds the parameters of a magnet link, see BEP 9. Peers are
+host:port addresses from x.pe, and SelectOnly lists the indexes of
+the files to download from so.
+*/
+type Magnet struct {
+	InfoHash    InfoHash
+	DisplayName string
+	Trackers    []string
+	WebSeeds    []string
+	Peers       []string
+	SelectOnly  []int
+}
+
+/*
+ParseMagnet parses a magnet URI. The info hash may be given in hex or
+in base32.
+*/
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, ErrNotMagnet
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Magnet{
+		DisplayName: query.Get("dn"),
+		Trackers:    query["tr"],
+		WebSeeds:    query["ws"],
+	}
+
+	// Other hashes, such as BitTorrent v2 btmh, may also be given
+	found := false
+	for _, xt := range query["xt"] {
+		if !strings.HasPrefix(xt, btihPrefix) {
+			continue
+		}
+		m.InfoHash, err = ParseInfoHash(xt[len(btihPrefix):])
+		if err != nil {
+			return nil, ErrMagnetBadInfoHash
+		}
+		found = true
+		break
+	}
+	if !found {
+		return nil, ErrMagnetNoInfoHash
+	}
+
+	for _, peer := range query["x.pe"] {
+		if _, _, err := net.SplitHostPort(peer); err != nil {
+			return nil, errors.New("Invalid Magnet Peer: " + peer)
+		}
+		m.Peers = append(m.Peers, peer)
+	}
+
+	if so := query.Get("so"); so != "" {
+		m.SelectOnly, err = parseSelectOnly(so)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+/*
+parseSelectOnly parses a list of file indexes and inclusive ranges,
+such as "0,2,4-6", selecting at most MaxMagnetSelectOnly indexes.
+*/
+func parseSelectOnly(so string) ([]int, error) {
+	indexes := make([]int, 0)
+	for _, part := range strings.Split(so, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		last := first
+		if err == nil && len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+		}
+		if err != nil || first < 0 || last < first {
+			return nil, errors.New("Invalid Magnet File Selection: " + so)
+		}
+		if last-first >= MaxMagnetSelectOnly-len(indexes) {
+			return nil, errors.New("Too Many Files In Magnet File Selection: " + so)
+		}
+		for i := first; i <= last; i++ {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes, nil
+}
+
+/*
+String returns the magnet URI, with the info hash in hex.
+*/
+func (m *Magnet) String() string {
+	params := []string{"xt=" + btihPrefix + m.InfoHash.Hex()}
+	if m.DisplayName != "" {
+		params = append(params, "dn="+url.QueryEscape(m.DisplayName))
+	}
+	for _, tracker := range m.Trackers {
+		params = append(params, "tr="+url.QueryEscape(tracker))
+	}
+	for _, webSeed := range m.WebSeeds {
+		params = append(params, "ws="+url.QueryEscape(webSeed))
+	}
+	for _, peer := range m.Peers {
+		params = append(params, "x.pe="+url.QueryEscape(peer))
+	}
+	if len(m.SelectOnly) > 0 {
+		indexes := make([]string, 0, len(m.SelectOnly))
+		for _, i := range m.SelectOnly {
+			indexes = append(indexes, strconv.Itoa(i))
+		}
+		params = append(params, "so="+strings.Join(indexes, ","))
+	}
+	return "magnet:?" + strings.Join(params, "&")
+}
+
+/*
+Magnet returns a magnet URI for the torrent, with every tracker of
+its announce list.
+*/
+func (metainfo *Metainfo) Magnet() string {
+	m := &Magnet{
+		InfoHash:    metainfo.Info.Hash,
+		DisplayName: metainfo.Info.Name,
+	}
+	for _, tier := range NewAnnounceList(metainfo.Announce, metainfo.AnnounceList) {
+		m.Trackers = append(m.Trackers, tier...)
+	}
+	return m.String()
+}
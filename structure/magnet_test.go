@@ -0,0 +1,82 @@
+package structure
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestMagnet(t *testing.T) {
+	infoHash := InfoHash{0x29, 0xeb, 0x26, 0xd6, 0xba, 0x89, 0x64, 0x9c, 0x10, 0x5d, 0xc8, 0xe2, 0x7e, 0xaf, 0xdc, 0x0c, 0x2e, 0xf6, 0x22, 0x92}
+
+	Convey("Parsing a magnet link", t, func() {
+		m, err := ParseMagnet("magnet:?xt=urn:btih:29eb26d6ba89649c105dc8e27eafdc0c2ef62292&dn=The+Internet%27s+Own+Boy" +
+			"&tr=http%3A%2F%2Fbt1.archive.org%3A6969%2Fannounce&tr=udp://tracker.example.com:6969" +
+			"&ws=http%3A%2F%2Farchive.org%2Fdownload%2F&x.pe=10.0.0.1:6881&x.pe=[2001:db8::1]:6881&so=0,2,4-6")
+		So(err, ShouldBeNil)
+		So(m.InfoHash, ShouldEqual, infoHash)
+		So(m.DisplayName, ShouldEqual, "The Internet's Own Boy")
+		So(m.Trackers, ShouldResemble, []string{"http://bt1.archive.org:6969/announce", "udp://tracker.example.com:6969"})
+		So(m.WebSeeds, ShouldResemble, []string{"http://archive.org/download/"})
+		So(m.Peers, ShouldResemble, []string{"10.0.0.1:6881", "[2001:db8::1]:6881"})
+		So(m.SelectOnly, ShouldResemble, []int{0, 2, 4, 5, 6})
+
+		again, err := ParseMagnet(m.String())
+		So(err, ShouldBeNil)
+		So(again, ShouldResemble, m)
+	})
+
+	Convey("Parsing a base32 info hash", t, func() {
+		m, err := ParseMagnet("magnet:?xt=urn:btih:FHVSNVV2RFSJYEC5ZDRH5L64BQXPMIUS")
+		So(err, ShouldBeNil)
+		So(m.InfoHash, ShouldEqual, infoHash)
+
+		m, err = ParseMagnet("magnet:?xt=urn:btmh:1220aaaa&xt=urn:btih:fhvsnvv2rfsjyec5zdrh5l64bqxpmius")
+		So(err, ShouldBeNil)
+		So(m.InfoHash, ShouldEqual, infoHash)
+	})
+
+	Convey("Rejecting invalid magnet links", t, func() {
+		invalid := map[string]error{
+			"http://example.com/?xt=urn:btih:29eb26d6ba89649c105dc8e27eafdc0c2ef62292": ErrNotMagnet,
+			"magnet:?dn=name":            ErrMagnetNoInfoHash,
+			"magnet:?xt=urn:btih:29eb26": ErrMagnetBadInfoHash,
+			"magnet:?xt=urn:btih:zzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzz": ErrMagnetBadInfoHash,
+		}
+		for uri, expected := range invalid {
+			_, err := ParseMagnet(uri)
+			So(err, ShouldEqual, expected)
+		}
+
+		_, err := ParseMagnet("magnet:?xt=urn:btih:29eb26d6ba89649c105dc8e27eafdc0c2ef62292&x.pe=10.0.0.1")
+		So(err, ShouldNotBeNil)
+		_, err = ParseMagnet("magnet:?xt=urn:btih:29eb26d6ba89649c105dc8e27eafdc0c2ef62292&so=3-1")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Rejecting a file selection that is too large", t, func() {
+		uri := "magnet:?xt=urn:btih:29eb26d6ba89649c105dc8e27eafdc0c2ef62292&so="
+		_, err := ParseMagnet(uri + "0-200000000")
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "Too Many Files In Magnet File Selection: 0-200000000")
+		_, err = ParseMagnet(uri + "0-9223372036854775807")
+		So(err, ShouldNotBeNil)
+		_, err = ParseMagnet(uri + "0-1048574,1048576-1048577")
+		So(err, ShouldNotBeNil)
+
+		m, err := ParseMagnet(uri + "0-1048574,1048576")
+		So(err, ShouldBeNil)
+		So(m.SelectOnly, ShouldHaveLength, MaxMagnetSelectOnly)
+	})
+
+	Convey("Creating a magnet link from a torrent", t, func() {
+		metainfo, _ := NewMetainfo("../testfiles/ubuntu.torrent")
+		m, err := ParseMagnet(metainfo.Magnet())
+		So(err, ShouldBeNil)
+		So(m.InfoHash, ShouldEqual, metainfo.Info.Hash)
+		So(m.DisplayName, ShouldEqual, "ubuntu-14.04.1-desktop-amd64.iso")
+		So(m.Trackers, ShouldResemble, []string{
+			"http://torrent.ubuntu.com:6969/announce",
+			"http://ipv6.torrent.ubuntu.com:6969/announce",
+		})
+	})
+}
@@ -11,9 +11,19 @@ import (
 )
 
 var (
-	ErrNotBitTorrentProtocol error = errors.New("Not BitTorrentProtocol")
+	ErrNotBitTorrentProtocol  error = errors.New("Not BitTorrentProtocol")
+	ErrInvalidExtendedMessage error = errors.New("Invalid Extended Message")
+	ErrMessageTooLong         error = errors.New("Message Too Long")
+	ErrInvalidMessageLength   error = errors.New("Invalid Message Length")
 )
 
+/*
+MaxMessageLength bounds the length of messages read from peers, which
+is far above a 16 KiB block and leaves room for the bitfields of
+torrents with millions of pieces.
+*/
+const MaxMessageLength = 1024 * 1024
+
 type Reader interface {
 	Read(p []byte) (n int, err error)
 }
@@ -22,7 +32,7 @@ type Handshake struct {
 	Length            byte
 	Name              string
 	ReservedExtension []byte
-	Hash              []byte
+	Hash              InfoHash
 	PeerID            []byte
 }
 
@@ -30,7 +40,7 @@ func (h *Handshake) String() string {
 	return fmt.Sprintf("pstrlen: %d, name: %s, reserved extension: %x , hash: %x , peer id: %s", h.Length, h.Name, h.ReservedExtension, h.Hash, h.PeerID)
 }
 
-func NewHandshake(hash, peerId []byte) (h *Handshake, err error) {
+func NewHandshake(hash InfoHash, peerId []byte) (h *Handshake, err error) {
 	return &Handshake{
 		Length:            19,
 		Name:              "BitTorrent protocol",
@@ -73,9 +83,9 @@ func ReadHandshake(r Reader) (h *Handshake, err error) {
 		Length:            byte(pstrLen),
 		Name:              string(buf[0:pstrLen]),
 		ReservedExtension: buf[pstrLen : pstrLen+8],
-		Hash:              buf[pstrLen+8 : pstrLen+8+20],
 		PeerID:            buf[pstrLen+8+20 : pstrLen+8+20+20],
 	}
+	copy(h.Hash[:], buf[pstrLen+8:pstrLen+8+20])
 
 	log.Println("[ReadHandshake]: ", h)
 
@@ -91,11 +101,26 @@ func (h *Handshake) Bytes() []byte {
 	buf.Write([]byte{h.Length})
 	buf.Write([]byte(h.Name))
 	buf.Write(h.ReservedExtension)
-	buf.Write(h.Hash)
+	buf.Write(h.Hash[:])
 	buf.Write(h.PeerID)
 	return buf.Bytes()
 }
 
+/*
+SupportsExtensions reports whether the peer set the reserved bit for
+the extension protocol, see BEP 10.
+*/
+func (h *Handshake) SupportsExtensions() bool {
+	return len(h.ReservedExtension) == 8 && h.ReservedExtension[5]&0x10 != 0
+}
+
+/*
+SetExtensions sets the reserved bit for the extension protocol.
+*/
+func (h *Handshake) SetExtensions() {
+	h.ReservedExtension[5] |= 0x10
+}
+
 func (h *Handshake) GetType() MessageType {
 	return MessageTypeHandshake
 }
@@ -115,6 +140,7 @@ const (
 	MessageTypePiece         MessageType = 7
 	MessageTypeCancel        MessageType = 8
 	MessageTypePort          MessageType = 9
+	MessageTypeExtended      MessageType = 20
 )
 
 func (m MessageType) String() string {
@@ -143,6 +169,8 @@ func (m MessageType) String() string {
 		return "MessageTypeCancel"
 	case MessageTypePort:
 		return "MessageTypePort"
+	case MessageTypeExtended:
+		return "MessageTypeExtended"
 	default:
 		return "Unknown Message Type"
 	}
@@ -307,6 +335,32 @@ func NewPortMessage(port int) *PortMessage {
 	return msg
 }
 
+/*
+ExtendedMessage carries a message of the extension protocol, see
+BEP 10. ExtendedID 0 is the extended handshake, other IDs are those
+announced by the receiving peer in its handshake.
+*/
+type ExtendedMessage struct {
+	BasicMessage
+	ExtendedID byte
+}
+
+func NewExtendedMessage(extendedID byte, payload []byte) *ExtendedMessage {
+	msg := &ExtendedMessage{BasicMessage: BasicMessage{Type: MessageTypeExtended, Length: len(payload) + 2}, ExtendedID: extendedID}
+	msg.Payload = append([]byte{extendedID}, payload...)
+	return msg
+}
+
+/*
+Data returns the payload following the extended message ID.
+*/
+func (m *ExtendedMessage) Data() []byte {
+	if len(m.Payload) == 0 {
+		return nil
+	}
+	return m.Payload[1:]
+}
+
 /*
 Bytes converts a message into its []byte representation, useful
 for serializing over the wire.
@@ -332,9 +386,22 @@ func (m BasicMessage) Bytes() []byte {
 	return buf.Bytes()
 }
 
+/*
+payloadLengths holds the length of the payload of message types with
+a fixed size payload.
+*/
+var payloadLengths = map[MessageType]int{
+	MessageTypeHave:    4,
+	MessageTypeRequest: 12,
+	MessageTypeCancel:  12,
+	MessageTypePort:    2,
+}
+
 /*
 ReadMessage reads from a Reader, most likely net.Conn during real operation,
-and decodes the next available message..
+and decodes the next available message.. Messages longer than
+MaxMessageLength, or whose payload is too short for their type, are
+refused with an error.
 */
 func ReadMessage(r Reader) (m Message, err error) {
 	lr := io.LimitReader(r, 4)
@@ -344,17 +411,36 @@ func ReadMessage(r Reader) (m Message, err error) {
 		return nil, err
 	}
 
-	log.Printf("[ReadMessage] Buf: %q", buf)
+	if len(buf) == 0 {
+		return nil, io.EOF
+	}
+	if len(buf) < 4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
 	mLen := int(binary.BigEndian.Uint32(buf[0:4]))
-	log.Printf("[ReadMessage] Length: %q", mLen)
 	if mLen == 0 {
 		return &KeepAliveMessage{BasicMessage: BasicMessage{Length: 0, Type: MessageTypeKeepAlive}}, nil
 	}
+	if mLen > MaxMessageLength {
+		return nil, ErrMessageTooLong
+	}
 
 	lr = io.LimitReader(r, int64(mLen))
 	buf, err = ioutil.ReadAll(lr)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < mLen {
+		return nil, io.ErrUnexpectedEOF
+	}
 	mType := MessageType(buf[0])
-	log.Printf("[ReadMessage] mType: %q", mType)
+	if n, ok := payloadLengths[mType]; ok && mLen-1 != n {
+		return nil, ErrInvalidMessageLength
+	}
+	if mType == MessageTypePiece && mLen-1 < 8 {
+		return nil, ErrInvalidMessageLength
+	}
 
 	// TODO: Use specific Message constructors
 	if mLen >= 1 {
@@ -397,6 +483,11 @@ func ReadMessage(r Reader) (m Message, err error) {
 		case MessageTypePort:
 			port := int(binary.BigEndian.Uint16(mPayload))
 			m = &PortMessage{BasicMessage: bm, Port: port}
+		case MessageTypeExtended:
+			if len(mPayload) == 0 {
+				return nil, ErrInvalidExtendedMessage
+			}
+			m = &ExtendedMessage{BasicMessage: bm, ExtendedID: mPayload[0]}
 		}
 	} else {
 		m = &BasicMessage{Length: mLen, Type: mType}
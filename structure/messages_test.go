@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	. "github.com/smartystreets/goconvey/convey"
+	"io"
 	"testing"
 )
 
@@ -93,6 +94,24 @@ func TestMessages(t *testing.T) {
 		}
 	})
 
+	Convey("Refusing malformed messages", t, func() {
+		malformed := map[string]error{
+			"\x00\x00\x00\x02\x04\x01":                         ErrInvalidMessageLength,
+			"\x00\x00\x00\x06\x04\x00\x00\x00\x01\x00":         ErrInvalidMessageLength,
+			"\x00\x00\x00\x05\x06\x00\x00\x00\x01":             ErrInvalidMessageLength,
+			"\x00\x00\x00\x08\x07\x00\x00\x00\x01\x00\x00\x00": ErrInvalidMessageLength,
+			"\x00\x00\x00\x01\x08":                             ErrInvalidMessageLength,
+			"\x00\x00\x00\x02\x09\x01":                         ErrInvalidMessageLength,
+			"\x00\x10\x00\x01\x07":                             ErrMessageTooLong,
+			"\xff\xff\xff\xff\x07":                             ErrMessageTooLong,
+			"\x00\x00\x00\x05\x04\x00":                         io.ErrUnexpectedEOF,
+		}
+		for msg, expected := range malformed {
+			_, err := ReadMessage(bytes.NewReader([]byte(msg)))
+			So(err, ShouldEqual, expected)
+		}
+	})
+
 	Convey("Convert messages to bytes", t, func() {
 		for _, sm := range smTests {
 			Convey(fmt.Sprintf("%s Message", sm.Desc), func() {
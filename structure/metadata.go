@@ -0,0 +1,211 @@
+package structure
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stratospark/torro/bencoding"
+)
+
+var (
+	ErrMetadataSize         = errors.New("Invalid Metadata Size")
+	ErrMetadataPiece        = errors.New("Invalid Metadata Piece")
+	ErrMetadataHashMismatch = errors.New("Metadata Does Not Match Info Hash")
+	ErrInvalidInfoDict      = errors.New("Invalid Info Dictionary")
+)
+
+/*
+ut_metadata constants, see BEP 9. Metadata is exchanged in pieces of
+16 KiB, the last of which may be shorter.
+*/
+const (
+	UTMetadata        = "ut_metadata"
+	MetadataPieceSize = 16 * 1024
+	// Larger metadata sizes announced by peers are refused
+	MaxMetadataSize = 8 * 1024 * 1024
+
+	MetadataRequest = 0
+	MetadataData    = 1
+	MetadataReject  = 2
+)
+
+/*
+ExtendedHandshake is the payload of the extended handshake, see BEP 10.
+M maps the names of the supported extensions to the message IDs the
+sender wants to receive them on, an ID of 0 disabling the extension.
+*/
+type ExtendedHandshake struct {
+	M            map[string]int `bencode:"m"`
+	MetadataSize int64          `bencode:"metadata_size,omitempty"`
+	Port         int            `bencode:"p,omitempty"`
+	Version      string         `bencode:"v,omitempty"`
+}
+
+/*
+NewExtendedHandshakeMessage returns the extended handshake as a
+message, with extended ID 0.
+*/
+func NewExtendedHandshakeMessage(h *ExtendedHandshake) (*ExtendedMessage, error) {
+	payload, err := bencoding.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	return NewExtendedMessage(0, payload), nil
+}
+
+func ParseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	h := &ExtendedHandshake{}
+	if err := bencoding.Unmarshal(payload, h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+/*
+MetadataMessage is a ut_metadata request, data or reject message. The
+bytes of a data message follow its bencoded dictionary.
+*/
+type MetadataMessage struct {
+	Type      int    `bencode:"msg_type"`
+	Piece     int    `bencode:"piece"`
+	TotalSize int64  `bencode:"total_size,omitempty"`
+	Data      []byte `bencode:"-"`
+}
+
+/*
+Message returns m as an extended message with the ID the receiving
+peer assigned to ut_metadata.
+*/
+func (m *MetadataMessage) Message(extendedID byte) (*ExtendedMessage, error) {
+	payload, err := bencoding.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return NewExtendedMessage(extendedID, append(payload, m.Data...)), nil
+}
+
+func ParseMetadataMessage(payload []byte) (*MetadataMessage, error) {
+	m := &MetadataMessage{}
+	d := bencoding.NewDecoder(bytes.NewReader(payload))
+	if err := d.Decode(m); err != nil {
+		return nil, err
+	}
+	if m.Type < MetadataRequest || m.Type > MetadataReject || m.Piece < 0 {
+		return nil, ErrMetadataPiece
+	}
+	if m.Type == MetadataData {
+		m.Data = payload[d.InputOffset():]
+	}
+	return m, nil
+}
+
+/*
+MetadataAssembler collects the pieces of the info dictionary of a
+torrent, as received from peers, and checks them against its info
+hash once all of them have arrived.
+*/
+type MetadataAssembler struct {
+	infoHash InfoHash
+	size     int
+	pieces   [][]byte
+}
+
+/*
+NewMetadataAssembler returns an assembler for metadata of the given
+size, as announced in an extended handshake.
+*/
+func NewMetadataAssembler(infoHash InfoHash, size int64) (*MetadataAssembler, error) {
+	if size <= 0 || size > MaxMetadataSize {
+		return nil, ErrMetadataSize
+	}
+	numPieces := (int(size) + MetadataPieceSize - 1) / MetadataPieceSize
+	return &MetadataAssembler{
+		infoHash: infoHash,
+		size:     int(size),
+		pieces:   make([][]byte, numPieces),
+	}, nil
+}
+
+func (a *MetadataAssembler) NumPieces() int {
+	return len(a.pieces)
+}
+
+/*
+Missing returns the indexes of the pieces that have not arrived yet.
+*/
+func (a *MetadataAssembler) Missing() []int {
+	missing := make([]int, 0)
+	for i, piece := range a.pieces {
+		if piece == nil {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+/*
+Add stores the data of a piece, which must be 16 KiB long unless it is
+the last piece.
+*/
+func (a *MetadataAssembler) Add(piece int, data []byte) error {
+	if piece < 0 || piece >= len(a.pieces) {
+		return ErrMetadataPiece
+	}
+	length := MetadataPieceSize
+	if piece == len(a.pieces)-1 {
+		length = a.size - piece*MetadataPieceSize
+	}
+	if len(data) != length {
+		return ErrMetadataPiece
+	}
+	a.pieces[piece] = append([]byte{}, data...)
+	return nil
+}
+
+func (a *MetadataAssembler) Complete() bool {
+	return len(a.Missing()) == 0
+}
+
+/*
+Bytes returns the assembled info dictionary once every piece has
+arrived. If it does not match the info hash, every piece is discarded
+so that the metadata can be fetched again, possibly from another peer.
+*/
+func (a *MetadataAssembler) Bytes() ([]byte, error) {
+	if !a.Complete() {
+		return nil, ErrMetadataPiece
+	}
+	info := bytes.Join(a.pieces, nil)
+	if HashInfo(info) != a.infoHash {
+		a.pieces = make([][]byte, len(a.pieces))
+		return nil, ErrMetadataHashMismatch
+	}
+	return info, nil
+}
+
+/*
+NewMetainfoFromInfo builds the Metainfo of a torrent added by magnet
+link from its info dictionary, as fetched from peers. The trackers of
+the magnet link are each put in their own tier.
+*/
+func NewMetainfoFromInfo(info []byte, m *Magnet) (*Metainfo, error) {
+	if HashInfo(info) != m.InfoHash {
+		return nil, ErrMetadataHashMismatch
+	}
+
+	parsed, err := parseInfo(info)
+	if err != nil {
+		return nil, err
+	}
+	parsed.Hash = m.InfoHash
+	metainfo := &Metainfo{Info: *parsed}
+
+	tiers := make([][]string, 0, len(m.Trackers))
+	for _, tracker := range m.Trackers {
+		tiers = append(tiers, []string{tracker})
+	}
+	metainfo.AnnounceList = NewAnnounceList("", tiers)
+	if len(m.Trackers) > 0 {
+		metainfo.Announce = m.Trackers[0]
+	}
+	return metainfo, nil
+}
@@ -0,0 +1,155 @@
+package structure
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/stratospark/torro/bencoding"
+	"io/ioutil"
+	"testing"
+)
+
+func readInfoDict(filename string) []byte {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		panic(err)
+	}
+	lex := bencoding.BeginLexing(filename, string(data), bencoding.LexBegin)
+	root, err := bencoding.ParseContainer(bencoding.Collect(lex))
+	if err != nil {
+		panic(err)
+	}
+	return root.Dict["info"].Raw
+}
+
+func TestExtendedMessages(t *testing.T) {
+	Convey("Setting the extension protocol bit in the handshake", t, func() {
+		hs, _ := NewHandshake(InfoHash{}, make([]byte, 20))
+		So(hs.SupportsExtensions(), ShouldBeFalse)
+		hs.SetExtensions()
+		So(hs.SupportsExtensions(), ShouldBeTrue)
+		So(hs.ReservedExtension, ShouldResemble, []byte("\x00\x00\x00\x00\x00\x10\x00\x00"))
+	})
+
+	Convey("Reading an extended handshake", t, func() {
+		msg, err := NewExtendedHandshakeMessage(&ExtendedHandshake{
+			M:            map[string]int{UTMetadata: 3},
+			MetadataSize: 31235,
+		})
+		So(err, ShouldBeNil)
+		So(string(msg.Bytes()), ShouldEqual, "\x00\x00\x00\x31\x14\x00d1:md11:ut_metadatai3ee13:metadata_sizei31235ee")
+
+		m, err := ReadMessage(bytes.NewReader(msg.Bytes()))
+		So(err, ShouldBeNil)
+		ext, ok := m.(*ExtendedMessage)
+		So(ok, ShouldBeTrue)
+		So(ext.ExtendedID, ShouldEqual, 0)
+		h, err := ParseExtendedHandshake(ext.Data())
+		So(err, ShouldBeNil)
+		So(h.M[UTMetadata], ShouldEqual, 3)
+		So(h.MetadataSize, ShouldEqual, 31235)
+
+		_, err = ReadMessage(bytes.NewReader([]byte("\x00\x00\x00\x01\x14")))
+		So(err, ShouldEqual, ErrInvalidExtendedMessage)
+	})
+
+	Convey("Encoding ut_metadata messages", t, func() {
+		msg, err := (&MetadataMessage{Type: MetadataData, Piece: 1, TotalSize: 16389, Data: []byte("abcde")}).Message(3)
+		So(err, ShouldBeNil)
+		So(msg.ExtendedID, ShouldEqual, 3)
+		So(string(msg.Data()), ShouldEqual, "d8:msg_typei1e5:piecei1e10:total_sizei16389eeabcde")
+
+		mm, err := ParseMetadataMessage(msg.Data())
+		So(err, ShouldBeNil)
+		So(mm, ShouldResemble, &MetadataMessage{Type: MetadataData, Piece: 1, TotalSize: 16389, Data: []byte("abcde")})
+
+		mm, err = ParseMetadataMessage([]byte("d8:msg_typei0e5:piecei0ee"))
+		So(err, ShouldBeNil)
+		So(mm.Type, ShouldEqual, MetadataRequest)
+		So(mm.Data, ShouldBeNil)
+
+		_, err = ParseMetadataMessage([]byte("d8:msg_typei7e5:piecei0ee"))
+		So(err, ShouldEqual, ErrMetadataPiece)
+		_, err = ParseMetadataMessage([]byte("d8:msg_type"))
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestMetadataAssembler(t *testing.T) {
+	info := readInfoDict("../testfiles/ubuntu.torrent")
+
+	Convey("Assembling metadata pieces", t, func() {
+		a, err := NewMetadataAssembler(HashInfo(info), int64(len(info)))
+		So(err, ShouldBeNil)
+		So(a.NumPieces(), ShouldEqual, 3)
+		So(a.Missing(), ShouldResemble, []int{0, 1, 2})
+
+		So(a.Add(3, info[:MetadataPieceSize]), ShouldEqual, ErrMetadataPiece)
+		So(a.Add(0, info[:MetadataPieceSize-1]), ShouldEqual, ErrMetadataPiece)
+		So(a.Add(2, info[2*MetadataPieceSize:len(info)-1]), ShouldEqual, ErrMetadataPiece)
+
+		So(a.Add(2, info[2*MetadataPieceSize:]), ShouldBeNil)
+		So(a.Add(0, info[:MetadataPieceSize]), ShouldBeNil)
+		So(a.Complete(), ShouldBeFalse)
+		_, err = a.Bytes()
+		So(err, ShouldEqual, ErrMetadataPiece)
+
+		So(a.Add(1, info[MetadataPieceSize:2*MetadataPieceSize]), ShouldBeNil)
+		So(a.Complete(), ShouldBeTrue)
+		assembled, err := a.Bytes()
+		So(err, ShouldBeNil)
+		So(assembled, ShouldResemble, info)
+	})
+
+	Convey("Discarding metadata that does not match the info hash", t, func() {
+		a, err := NewMetadataAssembler(HashInfo(info), int64(len(info)))
+		So(err, ShouldBeNil)
+		So(a.Add(0, info[:MetadataPieceSize]), ShouldBeNil)
+		So(a.Add(1, info[:MetadataPieceSize]), ShouldBeNil)
+		So(a.Add(2, info[2*MetadataPieceSize:]), ShouldBeNil)
+		_, err = a.Bytes()
+		So(err, ShouldEqual, ErrMetadataHashMismatch)
+		So(a.Missing(), ShouldResemble, []int{0, 1, 2})
+	})
+
+	Convey("Refusing invalid metadata sizes", t, func() {
+		_, err := NewMetadataAssembler(HashInfo(info), 0)
+		So(err, ShouldEqual, ErrMetadataSize)
+		_, err = NewMetadataAssembler(HashInfo(info), MaxMetadataSize+1)
+		So(err, ShouldEqual, ErrMetadataSize)
+	})
+}
+
+func TestNewMetainfoFromInfo(t *testing.T) {
+	Convey("Building the metainfo of a magnet link", t, func() {
+		filename := "../testfiles/TheInternetsOwnBoyTheStoryOfAaronSwartz_archive.torrent"
+		info := readInfoDict(filename)
+		expected, err := NewMetainfo(filename)
+		So(err, ShouldBeNil)
+		m, err := ParseMagnet(expected.Magnet())
+		So(err, ShouldBeNil)
+		m.Trackers = []string{"http://tracker.example.com/announce", "udp://tracker.example.com:6969"}
+
+		metainfo, err := NewMetainfoFromInfo(info, m)
+		So(err, ShouldBeNil)
+		So(metainfo.Info, ShouldResemble, expected.Info)
+		So(metainfo.Announce, ShouldEqual, "http://tracker.example.com/announce")
+		So(metainfo.AnnounceList, ShouldResemble, AnnounceList{
+			[]string{"http://tracker.example.com/announce"},
+			[]string{"udp://tracker.example.com:6969"},
+		})
+
+		_, err = NewMetainfoFromInfo(info[1:], m)
+		So(err, ShouldEqual, ErrMetadataHashMismatch)
+	})
+
+	Convey("Rejecting a malformed info dictionary", t, func() {
+		info := []byte("d5:filesi1e4:name1:ae")
+		_, err := NewMetainfoFromInfo(info, &Magnet{InfoHash: HashInfo(info)})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "Missing Required Field: piece length")
+
+		info = []byte("li1ee")
+		_, err = NewMetainfoFromInfo(info, &Magnet{InfoHash: HashInfo(info)})
+		So(err, ShouldEqual, ErrInvalidInfoDict)
+	})
+}
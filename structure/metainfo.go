@@ -5,36 +5,124 @@ import (
 	"errors"
 	"fmt"
 	"github.com/stratospark/torro/bencoding"
+	"io"
 	"io/ioutil"
-	"net/url"
+	"math"
+	"os"
 	"strings"
 	"time"
 )
 
+var (
+	ErrNotDictionary      = errors.New("Torrent Is Not A Dictionary")
+	ErrInvalidPieceLength = errors.New("Piece Length Is Not A Power Of Two")
+	ErrInvalidPieces      = errors.New("Pieces Is Not A Multiple Of 20 Bytes")
+	ErrPieceCount         = errors.New("Number Of Pieces Does Not Match Length")
+	ErrTotalLength        = errors.New("Total Length Of Files Is Too Large")
+)
+
 type File struct {
-	Length int
+	Length int64
 	MD5sum string
 	Path   string
 }
 
-func NewFile(f interface{}) *File {
-	rawFile := f.(map[string]interface{})
-	file := &File{}
-	addIntField("length", &file.Length, rawFile["length"], true)
-	addStringField("md5sum", &file.MD5sum, rawFile["md5sum"], false)
-	addStringField("md5", &file.MD5sum, rawFile["md5"], false)
+/*
+rawFile, rawInfo and rawMetainfo mirror the dictionaries of a .torrent
+file for decoding. Required fields are pointers, so that missing ones
+can be told apart from zero values, and files are decoded only once
+the rest of the info dictionary has been checked.
+*/
+type rawFile struct {
+	Length *int64    `bencode:"length"`
+	MD5sum string    `bencode:"md5sum"`
+	MD5    string    `bencode:"md5"`
+	Path   *[]string `bencode:"path"`
+}
+
+type rawInfo struct {
+	PieceLength *int64                `bencode:"piece length"`
+	Pieces      *[]byte               `bencode:"pieces"`
+	Private     bool                  `bencode:"private"`
+	Source      string                `bencode:"source"`
+	Name        *string               `bencode:"name"`
+	Length      *int64                `bencode:"length"`
+	MD5Sum      string                `bencode:"md5sum"`
+	Files       *bencoding.RawMessage `bencode:"files"`
+}
+
+type rawMetainfo struct {
+	Info         bencoding.RawMessage `bencode:"info"`
+	Announce     string               `bencode:"announce"`
+	AnnounceList interface{}          `bencode:"announce-list"`
+	CreationDate *int64               `bencode:"creation date"`
+	Comment      string               `bencode:"comment"`
+	CreatedBy    string               `bencode:"created by"`
+	Encoding     string               `bencode:"encoding"`
+}
+
+/*
+fieldTypeError turns a type error from bencoding.Unmarshal into an
+error naming the innermost field, e.g. "path" for files[0].path[1].
+Values that are not in a field of their own are named after outer.
+*/
+func fieldTypeError(err error, outer string) error {
+	typeErr, ok := err.(*bencoding.UnmarshalTypeError)
+	if !ok {
+		return err
+	}
+	name := typeErr.Field[strings.LastIndex(typeErr.Field, ".")+1:]
+	if i := strings.Index(name, "["); i >= 0 {
+		name = name[:i]
+	}
+	if name == "" {
+		name = outer
+	}
+	return errors.New(fmt.Sprint("Invalid Field Type: ", name))
+}
 
-	paths := rawFile["path"].([]interface{})
+/*
+newFile checks a file of a multiple file torrent, making sure that
+its path does not escape the torrent's directory.
+*/
+func newFile(raw *rawFile) (*File, error) {
+	if raw.Length == nil {
+		return nil, errors.New("Missing Required Field: length")
+	}
+	file := &File{Length: *raw.Length, MD5sum: raw.MD5sum}
+	if file.Length < 0 {
+		return nil, errors.New(fmt.Sprint("Invalid File Length: ", file.Length))
+	}
+	if raw.MD5 != "" {
+		file.MD5sum = raw.MD5
+	}
 
-	pathStrings := make([]string, 0)
-	for _, path := range paths {
-		b, _ := path.([]uint8)
-		pathStrings = append(pathStrings, string(b))
+	if raw.Path == nil {
+		return nil, errors.New("Missing Required Field: path")
 	}
+	pathStrings := *raw.Path
 	fullPath := strings.Join(pathStrings, "/")
+	if len(pathStrings) == 0 {
+		return nil, errors.New("Invalid File Path: empty")
+	}
+	for _, component := range pathStrings {
+		if !validPathComponent(component) {
+			return nil, errors.New(fmt.Sprint("Invalid File Path: ", fullPath))
+		}
+	}
 	file.Path = fullPath
 
-	return file
+	return file, nil
+}
+
+/*
+validPathComponent reports whether a file or directory name is safe to
+join to the download directory, so that a torrent cannot write outside
+of it.
+*/
+func validPathComponent(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.ContainsAny(name, "/\\\x00")
 }
 
 type InfoMode int
@@ -46,148 +134,214 @@ const (
 
 type Info struct {
 	Mode        InfoMode
-	PieceLength int
-	Pieces      string
+	PieceLength int64
+	Pieces      [][sha1.Size]byte
 	Private     bool
+	Source      string
 	Name        string
-	Length      int
+	Length      int64
 	MD5Sum      string
 	Files       []File
-	Hash        string
-	TotalBytes  int
+	Hash        InfoHash
+	TotalBytes  int64
+}
+
+/*
+PieceHash returns the SHA1 hash of piece i, reporting false if there
+is no such piece.
+*/
+func (info *Info) PieceHash(i int) ([sha1.Size]byte, bool) {
+	if i < 0 || i >= len(info.Pieces) {
+		return [sha1.Size]byte{}, false
+	}
+	return info.Pieces[i], true
 }
 
 type Metainfo struct {
 	Info         Info
 	Announce     string
-	AnnounceList [][]string
+	AnnounceList AnnounceList
 	CreationDate time.Time
 	Comment      string
 	CreatedBy    string
 	Encoding     string
 }
 
-func addStringField(name string, s *string, val interface{}, required bool) error {
-	if val != nil {
-		b, _ := val.([]uint8)
-		*s = string(b)
-	} else {
-		if required {
-			return errors.New(fmt.Sprint("Missing Required Field: ", name))
-		}
+/*
+NewMetainfo reads and parses the .torrent file filename.
+*/
+func NewMetainfo(filename string) (*Metainfo, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	defer f.Close()
+	return LoadMetainfo(f)
 }
 
-func addIntField(name string, s *int, val interface{}, required bool) error {
-	if val != nil {
-		*s = val.(int)
-	} else {
-		if required {
-			return errors.New(fmt.Sprint("Missing Required Field: ", name))
-		}
+/*
+LoadMetainfo reads a .torrent file from r and parses it.
+*/
+func LoadMetainfo(r io.Reader) (*Metainfo, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return ParseMetainfo(data)
 }
 
-func addBoolField(name string, s *bool, val interface{}, required bool) error {
-	if val != nil {
-		x := val.(int)
-		if x == 0 {
-			*s = false
-		} else {
-			*s = true
-		}
-	} else {
-		if required {
-			return errors.New(fmt.Sprint("Missing Required Field: ", name))
+/*
+ParseMetainfo parses and validates the contents of a .torrent file.
+The announce URL is optional, since trackerless torrents find peers
+by other means.
+*/
+func ParseMetainfo(data []byte) (*Metainfo, error) {
+	raw := &rawMetainfo{}
+	if err := bencoding.Unmarshal(data, raw); err != nil {
+		if typeErr, ok := err.(*bencoding.UnmarshalTypeError); ok && typeErr.Field == "" {
+			return nil, ErrNotDictionary
 		}
+		return nil, fieldTypeError(err, "")
 	}
-	return nil
-}
 
-func getRightEncodedSHA1(b []byte) string {
-	h := sha1.New()
-	h.Write(b)
-	return strings.ToLower(url.QueryEscape(string(h.Sum(nil))))
-}
-
-func NewMetainfo(filename string) *Metainfo {
-	data, err := ioutil.ReadFile(filename)
+	// Required fields
+	if raw.Info == nil {
+		return nil, errors.New("Missing Required Field: info")
+	}
+	info, err := parseInfo(raw.Info)
+	if err == ErrInvalidInfoDict {
+		return nil, errors.New("Invalid Field Type: info")
+	}
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-
-	torrentStr := string(data)
-	lex := bencoding.BeginLexing(".torrent", torrentStr, bencoding.LexBegin)
-	tokens := bencoding.Collect(lex)
-
-	rawInfoVal := bencoding.GetBencodedInfo(tokens)
-
-	output := bencoding.Parse(tokens)
-	result := output.Output.(map[string]interface{})
-
-	metainfo := &Metainfo{}
-
-	// Required fields
-	if result["info"] != nil {
-		addInfoFields(metainfo, result["info"].(map[string]interface{}))
-		metainfo.Info.Hash = getRightEncodedSHA1(rawInfoVal)
-	} else {
-		panic("MISSING REQUIRED FIELD: info")
+	info.Hash = HashInfo(raw.Info)
+
+	metainfo := &Metainfo{
+		Info:      *info,
+		Announce:  raw.Announce,
+		Comment:   raw.Comment,
+		CreatedBy: raw.CreatedBy,
+		Encoding:  raw.Encoding,
 	}
 
-	addStringField("announce", &metainfo.Announce, result["announce"], true)
-
 	// Optional fields
-	if result["announce-list"] != nil {
-		// TODO: parse announce-list
+	if raw.AnnounceList != nil {
+		addAnnounceList(metainfo, raw.AnnounceList)
 	}
-
-	if result["creation date"] != nil {
-		creationDate := int64(result["creation date"].(int))
-		t := time.Unix(creationDate, 0)
-		metainfo.CreationDate = t
+	if raw.CreationDate != nil {
+		metainfo.CreationDate = time.Unix(*raw.CreationDate, 0)
 	}
 
-	addStringField("comment", &metainfo.Comment, result["comment"], false)
-	addStringField("created by", &metainfo.CreatedBy, result["created by"], false)
-	addStringField("encoding", &metainfo.Encoding, result["encoding"], false)
+	return metainfo, nil
+}
 
-	return metainfo
+/*
+addAnnounceList reads the tiers of tracker URLs, skipping anything
+that is not a list of strings.
+*/
+func addAnnounceList(metainfo *Metainfo, val interface{}) {
+	rawTiers, _ := val.([]interface{})
+	tiers := make([][]string, 0, len(rawTiers))
+	for _, rawTier := range rawTiers {
+		rawURLs, _ := rawTier.([]interface{})
+		tier := make([]string, 0, len(rawURLs))
+		for _, rawURL := range rawURLs {
+			if b, ok := rawURL.([]uint8); ok && len(b) > 0 {
+				tier = append(tier, string(b))
+			}
+		}
+		tiers = append(tiers, tier)
+	}
+	metainfo.AnnounceList = NewAnnounceList("", tiers)
 }
 
-func addInfoFields(metainfo *Metainfo, infoMap map[string]interface{}) {
-	info := &Info{}
+/*
+parseInfo decodes an info dictionary, checking that its fields are
+consistent and that no file path escapes the torrent's directory.
+The Hash of the result is left for the caller to fill in.
+*/
+func parseInfo(data []byte) (*Info, error) {
+	raw := &rawInfo{}
+	if err := bencoding.Unmarshal(data, raw); err != nil {
+		if typeErr, ok := err.(*bencoding.UnmarshalTypeError); ok && typeErr.Field == "" {
+			return nil, ErrInvalidInfoDict
+		}
+		return nil, fieldTypeError(err, "")
+	}
+	info := &Info{Private: raw.Private, Source: raw.Source}
+
+	if raw.PieceLength == nil {
+		return nil, errors.New("Missing Required Field: piece length")
+	}
+	info.PieceLength = *raw.PieceLength
+	if info.PieceLength <= 0 || info.PieceLength&(info.PieceLength-1) != 0 {
+		return nil, ErrInvalidPieceLength
+	}
 
-	addIntField("piece length", &info.PieceLength, infoMap["piece length"], true)
+	if raw.Pieces == nil {
+		return nil, errors.New("Missing Required Field: pieces")
+	}
+	pieces := *raw.Pieces
+	if len(pieces)%sha1.Size != 0 {
+		return nil, ErrInvalidPieces
+	}
+	info.Pieces = make([][sha1.Size]byte, len(pieces)/sha1.Size)
+	for i := range info.Pieces {
+		copy(info.Pieces[i][:], pieces[i*sha1.Size:])
+	}
 
-	// TODO: may need to keep this as byte array?
-	addStringField("pieces", &info.Pieces, infoMap["pieces"], true)
-	addBoolField("private", &info.Private, infoMap["private"], false)
-	addStringField("name", &info.Name, infoMap["name"], true)
+	if raw.Name == nil || *raw.Name == "" {
+		return nil, errors.New("Missing Required Field: name")
+	}
+	info.Name = *raw.Name
+	if !validPathComponent(info.Name) {
+		return nil, errors.New(fmt.Sprint("Invalid File Path: ", info.Name))
+	}
 
-	totalBytes := 0
+	totalBytes := int64(0)
 
 	// Check whether single or multiple file mode
-	if infoMap["files"] != nil {
+	if raw.Files != nil {
 		info.Mode = InfoModeMultiple
-		rawFiles := infoMap["files"].([]interface{})
-		files := make([]File, 0)
-		for _, rawFile := range rawFiles {
-			newFile := *NewFile(rawFile)
-			files = append(files, newFile)
-			totalBytes += newFile.Length
+		var rawFiles []rawFile
+		if err := bencoding.Unmarshal(*raw.Files, &rawFiles); err != nil {
+			return nil, fieldTypeError(err, "files")
+		}
+		files := make([]File, 0, len(rawFiles))
+		for i := range rawFiles {
+			file, err := newFile(&rawFiles[i])
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, *file)
+			if file.Length > math.MaxInt64-totalBytes {
+				return nil, ErrTotalLength
+			}
+			totalBytes += file.Length
 		}
 		info.Files = files
 	} else {
 		info.Mode = InfoModeSingle
-		addIntField("length", &info.Length, infoMap["length"], true)
-		addStringField("md5sum", &info.MD5Sum, infoMap["md5sum"], false)
+		if raw.Length == nil {
+			return nil, errors.New("Missing Required Field: length")
+		}
+		info.Length = *raw.Length
+		if info.Length < 0 {
+			return nil, errors.New(fmt.Sprint("Invalid File Length: ", info.Length))
+		}
+		info.MD5Sum = raw.MD5Sum
 		totalBytes = info.Length
 	}
 
 	info.TotalBytes = totalBytes
+	numPieces := totalBytes / info.PieceLength
+	if totalBytes%info.PieceLength != 0 {
+		numPieces++
+	}
+	if int64(len(info.Pieces)) != numPieces {
+		return nil, ErrPieceCount
+	}
 
-	metainfo.Info = *info
+	return info, nil
 }
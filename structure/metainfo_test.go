@@ -2,6 +2,10 @@ package structure
 
 import (
 	. "github.com/smartystreets/goconvey/convey"
+	"github.com/stratospark/torro/bencoding"
+	"math"
+	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -12,9 +16,14 @@ func TestMetainfo(t *testing.T) {
 
 		Convey("Given a Single File Mode torrent", func() {
 			filename := "../testfiles/ubuntu.torrent"
-			metainfo := NewMetainfo(filename)
+			metainfo, err := NewMetainfo(filename)
+			So(err, ShouldBeNil)
 			So(metainfo, ShouldNotBeNil)
 			So(metainfo.Announce, ShouldEqual, "http://torrent.ubuntu.com:6969/announce")
+			So(metainfo.AnnounceList, ShouldResemble, AnnounceList{
+				[]string{"http://torrent.ubuntu.com:6969/announce"},
+				[]string{"http://ipv6.torrent.ubuntu.com:6969/announce"},
+			})
 
 			loc, _ := time.LoadLocation("US/Pacific")
 			So(metainfo.CreationDate, ShouldHappenWithin, time.Duration(0), time.Date(2014, 7, 24, 16, 52, 15, 0, loc))
@@ -22,7 +31,12 @@ func TestMetainfo(t *testing.T) {
 			So(metainfo.Comment, ShouldEqual, "Ubuntu CD releases.ubuntu.com")
 
 			So(metainfo.Info.PieceLength, ShouldEqual, 524288)
-			So(len(metainfo.Info.Pieces), ShouldEqual, 39240)
+			So(metainfo.Info.Pieces, ShouldHaveLength, 1962)
+			piece, ok := metainfo.Info.PieceHash(1961)
+			So(ok, ShouldBeTrue)
+			So(piece, ShouldEqual, metainfo.Info.Pieces[1961])
+			_, ok = metainfo.Info.PieceHash(1962)
+			So(ok, ShouldBeFalse)
 			So(metainfo.Info.Mode, ShouldEqual, InfoModeSingle)
 
 			So(metainfo.Info.Name, ShouldEqual, "ubuntu-14.04.1-desktop-amd64.iso")
@@ -34,7 +48,8 @@ func TestMetainfo(t *testing.T) {
 
 		Convey("Given a Multiple File Mode torrent", func() {
 			filename := "../testfiles/TheInternetsOwnBoyTheStoryOfAaronSwartz_archive.torrent"
-			metainfo := NewMetainfo(filename)
+			metainfo, err := NewMetainfo(filename)
+			So(err, ShouldBeNil)
 			So(metainfo, ShouldNotBeNil)
 
 			So(metainfo.Info.Files, ShouldNotBeNil)
@@ -48,9 +63,9 @@ func TestMetainfo(t *testing.T) {
 			So(file1.Length, ShouldEqual, 4192838)
 			So(file1.Path, ShouldEqual, ".____padding_file/0")
 
-			So(metainfo.Info.Hash, ShouldEqual, "%29%eb%26%d6%ba%89d%9c%10%5d%c8%e2~%af%dc%0c.%f6%22%92")
+			So(metainfo.Info.Hash.Hex(), ShouldEqual, "29eb26d6ba89649c105dc8e27eafdc0c2ef62292")
 
-			totalBytes := 0
+			totalBytes := int64(0)
 			for _, file := range metainfo.Info.Files {
 				totalBytes += file.Length
 			}
@@ -58,3 +73,109 @@ func TestMetainfo(t *testing.T) {
 		})
 	})
 }
+
+func TestParseMetainfo(t *testing.T) {
+	validInfo := func() map[string]interface{} {
+		return map[string]interface{}{
+			"name":         "file.txt",
+			"piece length": 16384,
+			"pieces":       strings.Repeat("a", 40),
+			"length":       20000,
+		}
+	}
+	torrent := func(info map[string]interface{}) []byte {
+		data, err := bencoding.Marshal(map[string]interface{}{
+			"announce": "http://tracker.example.com/announce",
+			"info":     info,
+		})
+		if err != nil {
+			panic(err)
+		}
+		return data
+	}
+
+	Convey("Loading a torrent from a reader", t, func() {
+		f, err := os.Open("../testfiles/ubuntu.torrent")
+		So(err, ShouldBeNil)
+		defer f.Close()
+		metainfo, err := LoadMetainfo(f)
+		So(err, ShouldBeNil)
+		So(metainfo.Info.Name, ShouldEqual, "ubuntu-14.04.1-desktop-amd64.iso")
+
+		metainfo, err = ParseMetainfo(torrent(validInfo()))
+		So(err, ShouldBeNil)
+		So(metainfo.Info.TotalBytes, ShouldEqual, 20000)
+
+		_, err = NewMetainfo("../testfiles/missing.torrent")
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+
+	Convey("Rejecting invalid torrents", t, func() {
+		_, err := ParseMetainfo([]byte("li1ee"))
+		So(err, ShouldEqual, ErrNotDictionary)
+		_, err = ParseMetainfo([]byte("d8:announce3:urle"))
+		So(err.Error(), ShouldEqual, "Missing Required Field: info")
+		_, err = ParseMetainfo([]byte("d4:info"))
+		So(err, ShouldNotBeNil)
+		_, err = ParseMetainfo([]byte("d4:infoi1ee"))
+		So(err.Error(), ShouldEqual, "Invalid Field Type: info")
+
+		invalid := map[string]func(info map[string]interface{}){
+			"Missing Required Field: name":         func(info map[string]interface{}) { delete(info, "name") },
+			"Invalid Field Type: name":             func(info map[string]interface{}) { info["name"] = 1 },
+			"Missing Required Field: piece length": func(info map[string]interface{}) { delete(info, "piece length") },
+			ErrInvalidPieceLength.Error():          func(info map[string]interface{}) { info["piece length"] = 16000 },
+			ErrInvalidPieces.Error():               func(info map[string]interface{}) { info["pieces"] = strings.Repeat("a", 30) },
+			ErrPieceCount.Error():                  func(info map[string]interface{}) { info["pieces"] = strings.Repeat("a", 60) },
+			"Missing Required Field: length":       func(info map[string]interface{}) { delete(info, "length") },
+			"Invalid File Length: -1":              func(info map[string]interface{}) { info["length"] = -1 },
+			"Invalid File Path: ..":                func(info map[string]interface{}) { info["name"] = ".." },
+			"Invalid File Path: a/b":               func(info map[string]interface{}) { info["name"] = "a/b" },
+			"Invalid Field Type: files":            func(info map[string]interface{}) { info["files"] = 1 },
+			"Missing Required Field: path":         func(info map[string]interface{}) { info["files"] = []interface{}{map[string]interface{}{"length": 1}} },
+			"Invalid File Path: dir/../../etc/passwd": func(info map[string]interface{}) {
+				info["files"] = []interface{}{map[string]interface{}{"length": 20000, "path": []string{"dir", "..", "..", "etc", "passwd"}}}
+			},
+			"Invalid File Path: /etc/passwd": func(info map[string]interface{}) {
+				info["files"] = []interface{}{map[string]interface{}{"length": 20000, "path": []string{"", "etc", "passwd"}}}
+			},
+			"Invalid Field Type: path": func(info map[string]interface{}) {
+				info["files"] = []interface{}{map[string]interface{}{"length": 20000, "path": []interface{}{"a", 1}}}
+			},
+			"Invalid File Path: a\\b": func(info map[string]interface{}) {
+				info["files"] = []interface{}{map[string]interface{}{"length": 20000, "path": []string{"a\\b"}}}
+			},
+			// The lengths wrap around to 20000
+			ErrTotalLength.Error(): func(info map[string]interface{}) {
+				info["files"] = []interface{}{
+					map[string]interface{}{"length": int64(math.MaxInt64), "path": []string{"a"}},
+					map[string]interface{}{"length": int64(math.MaxInt64), "path": []string{"b"}},
+					map[string]interface{}{"length": 20002, "path": []string{"c"}},
+				}
+			},
+		}
+		for expected, modify := range invalid {
+			info := validInfo()
+			modify(info)
+			_, err := ParseMetainfo(torrent(info))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, expected)
+		}
+
+		// Counting the pieces of the longest file does not overflow
+		info := validInfo()
+		info["length"] = int64(math.MaxInt64)
+		_, err = ParseMetainfo(torrent(info))
+		So(err, ShouldEqual, ErrPieceCount)
+
+		// Files in subdirectories are allowed
+		info = validInfo()
+		info["files"] = []interface{}{
+			map[string]interface{}{"length": 10000, "path": []string{"dir", "a.txt"}},
+			map[string]interface{}{"length": 10000, "path": []string{"b.txt"}},
+		}
+		metainfo, err := ParseMetainfo(torrent(info))
+		So(err, ShouldBeNil)
+		So(metainfo.Info.Files[0].Path, ShouldEqual, "dir/a.txt")
+	})
+}
@@ -0,0 +1,150 @@
+package structure
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+/*
+PeerIDPrefix identifies torro in the Azureus style: the client code
+"TO" followed by the version 0.0.0.1.
+*/
+const PeerIDPrefix = "-TO0001-"
+
+const peerIDChars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+/*
+SessionPeerID is generated once when torro starts, and is used for
+every torrent in the session.
+*/
+var SessionPeerID = NewPeerID()
+
+/*
+NewPeerID returns a new random 20 byte peer ID starting with
+PeerIDPrefix.
+*/
+func NewPeerID() string {
+	id := make([]byte, 0, 20)
+	id = append(id, PeerIDPrefix...)
+	random := make([]byte, 20)
+	for len(id) < cap(id) {
+		if _, err := rand.Read(random); err != nil {
+			panic(err)
+		}
+		for _, b := range random {
+			if len(id) == cap(id) {
+				break
+			}
+			// Bytes past the last whole multiple of the alphabet size
+			// are skipped, so that every character is equally likely
+			if int(b) < 256-256%len(peerIDChars) {
+				id = append(id, peerIDChars[int(b)%len(peerIDChars)])
+			}
+		}
+	}
+	return string(id)
+}
+
+/*
+NewKey returns a random 32 bit key, as 8 hex digits, that lets a
+tracker recognize us if our IP address changes.
+*/
+func NewKey() string {
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%08x", binary.BigEndian.Uint32(random))
+}
+
+/*
+PeerClient is the client software and version identified from a peer
+ID.
+*/
+type PeerClient struct {
+	Name    string
+	Version string
+}
+
+func (pc PeerClient) String() string {
+	if pc.Version == "" {
+		return pc.Name
+	}
+	return pc.Name + " " + pc.Version
+}
+
+/*
+azureusClients maps the two letter client codes of Azureus style peer
+IDs to client names.
+*/
+var azureusClients = map[string]string{
+	"AZ": "Azureus",
+	"BC": "BitComet",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FW": "FrostWire",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"TO": "torro",
+	"TR": "Transmission",
+	"UT": "µTorrent",
+	"lt": "libTorrent",
+	"qB": "qBittorrent",
+}
+
+/*
+shadowClients maps the client letters of Shadow style peer IDs to
+client names.
+*/
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+/*
+ParsePeerClient identifies the client that generated peerID, from
+either an Azureus style ID such as "-TO0001-..." or a Shadow style ID
+such as "T03I-----...". Unknown Azureus client codes are returned as
+the name.
+*/
+func ParsePeerClient(peerID string) (PeerClient, bool) {
+	if len(peerID) != 20 {
+		return PeerClient{}, false
+	}
+
+	if peerID[0] == '-' && peerID[7] == '-' {
+		name, ok := azureusClients[peerID[1:3]]
+		if !ok {
+			name = peerID[1:3]
+		}
+		version := make([]string, 0, 4)
+		for _, c := range peerID[3:7] {
+			version = append(version, string(c))
+		}
+		return PeerClient{Name: name, Version: strings.Join(version, ".")}, true
+	}
+
+	if name, ok := shadowClients[peerID[0]]; ok && peerID[6:9] == "---" {
+		version := make([]string, 0, 5)
+		for _, c := range peerID[1:6] {
+			switch {
+			case c >= '0' && c <= '9':
+				version = append(version, string(c))
+			case c >= 'A' && c <= 'Z':
+				version = append(version, fmt.Sprint(c-'A'+10))
+			case c >= 'a' && c <= 'z':
+				version = append(version, fmt.Sprint(c-'a'+36))
+			}
+		}
+		return PeerClient{Name: name, Version: strings.Join(version, ".")}, true
+	}
+
+	return PeerClient{}, false
+}
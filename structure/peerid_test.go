@@ -0,0 +1,43 @@
+package structure
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestPeerID(t *testing.T) {
+	Convey("Generating peer IDs and keys", t, func() {
+		id := NewPeerID()
+		So(id, ShouldHaveLength, 20)
+		So(id, ShouldStartWith, "-TO0001-")
+		So(NewPeerID(), ShouldNotEqual, id)
+		So(SessionPeerID, ShouldHaveLength, 20)
+		for _, c := range id[len(PeerIDPrefix):] {
+			So(peerIDChars, ShouldContainSubstring, string(c))
+		}
+
+		key := NewKey()
+		So(key, ShouldHaveLength, 8)
+	})
+
+	Convey("Identifying clients from peer IDs", t, func() {
+		tests := map[string]PeerClient{
+			NewPeerID():            PeerClient{"torro", "0.0.0.1"},
+			"-TR2840-nj5ovtkoz2ed": PeerClient{"Transmission", "2.8.4.0"},
+			"-qB3230-u~QGMmUs~yXH": PeerClient{"qBittorrent", "3.2.3.0"},
+			"-XX1000-aaaaaaaaaaaa": PeerClient{"XX", "1.0.0.0"},
+			"T03I-----aaaaaaaaaaa": PeerClient{"BitTornado", "0.3.18"},
+		}
+		for id, expected := range tests {
+			pc, ok := ParsePeerClient(id)
+			So(ok, ShouldBeTrue)
+			So(pc, ShouldResemble, expected)
+		}
+		So(PeerClient{"Transmission", "2.8.4.0"}.String(), ShouldEqual, "Transmission 2.8.4.0")
+
+		_, ok := ParsePeerClient("aaaaaaaaaaaaaaaaaaaa")
+		So(ok, ShouldBeFalse)
+		_, ok = ParsePeerClient("-TR2840-")
+		So(ok, ShouldBeFalse)
+	})
+}
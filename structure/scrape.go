@@ -0,0 +1,98 @@
+package structure
+
+import (
+	"errors"
+	"github.com/stratospark/torro/bencoding"
+	"net/url"
+	"strings"
+)
+
+var ErrScrapeNotSupported = errors.New("Tracker Does Not Support Scrape")
+
+/*
+ScrapeFile holds a tracker's counts for a single torrent.
+*/
+type ScrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Incomplete int `bencode:"incomplete"`
+	Downloaded int `bencode:"downloaded"`
+}
+
+/*
+ScrapeURL derives the scrape URL of an HTTP tracker from its announce
+URL by replacing "announce" at the start of the last path segment
+with "scrape". Trackers whose URL does not follow that convention do
+not support scrape.
+*/
+func ScrapeURL(announceURL string) (string, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return "", err
+	}
+	i := strings.LastIndex(u.Path, "/")
+	if i < 0 || !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return "", ErrScrapeNotSupported
+	}
+	u.Path = u.Path[:i+1] + "scrape" + u.Path[i+1+len("announce"):]
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+/*
+GetScrapeURL returns the scrape URL asking for the given infohashes.
+*/
+func GetScrapeURL(announceURL string, infoHashes ...InfoHash) (string, error) {
+	scrapeURL, err := ScrapeURL(announceURL)
+	if err != nil {
+		return "", err
+	}
+	for i, hash := range infoHashes {
+		sep := "&"
+		if i == 0 && !strings.Contains(scrapeURL, "?") {
+			sep = "?"
+		}
+		scrapeURL += sep + "info_hash=" + hash.URLEscaped()
+	}
+	return scrapeURL, nil
+}
+
+type scrapeResponseDict struct {
+	FailureReason string                `bencode:"failure reason"`
+	Files         map[string]ScrapeFile `bencode:"files"`
+}
+
+/*
+NewScrapeResponse parses the bencoded response of an HTTP scrape.
+Files under a key that is not a 20 byte infohash are skipped.
+*/
+func NewScrapeResponse(responseStr string) (map[InfoHash]ScrapeFile, error) {
+	raw := &scrapeResponseDict{}
+	if err := bencoding.Unmarshal([]byte(responseStr), raw); err != nil {
+		return nil, err
+	}
+	if raw.FailureReason != "" {
+		return nil, errors.New("Tracker Scrape Failure: " + raw.FailureReason)
+	}
+	if raw.Files == nil {
+		return nil, errors.New("Missing Required Field: files")
+	}
+	files := make(map[InfoHash]ScrapeFile)
+	for key, file := range raw.Files {
+		if infoHash, err := NewInfoHash([]byte(key)); err == nil {
+			files[infoHash] = file
+		}
+	}
+	return files, nil
+}
+
+/*
+MarshalScrapeResponse returns the bencoded scrape response for files.
+*/
+func MarshalScrapeResponse(files map[InfoHash]ScrapeFile) ([]byte, error) {
+	// Dictionary keys are the raw bytes of each infohash
+	rawFiles := make(map[string]ScrapeFile)
+	for infoHash, file := range files {
+		rawFiles[string(infoHash[:])] = file
+	}
+	return bencoding.Marshal(map[string]interface{}{"files": rawFiles})
+}
@@ -0,0 +1,70 @@
+package structure
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+)
+
+func TestScrape(t *testing.T) {
+	Convey("Deriving the scrape URL from the announce URL", t, func() {
+		tests := map[string]string{
+			"http://example.com/announce":           "http://example.com/scrape",
+			"http://example.com/x/announce":         "http://example.com/x/scrape",
+			"http://example.com/announce.php":       "http://example.com/scrape.php",
+			"http://example.com/announce?x2%0644":   "http://example.com/scrape?x2%0644",
+			"http://example.com/x%064announce":      "http://example.com/x%064announce",
+			"http://example.com/a/announce/passkey": "http://example.com/a/announce/passkey",
+		}
+		for announce, scrape := range tests {
+			result, err := ScrapeURL(announce)
+			if announce == scrape {
+				So(err, ShouldEqual, ErrScrapeNotSupported)
+				continue
+			}
+			So(err, ShouldBeNil)
+			So(result, ShouldEqual, scrape)
+		}
+	})
+
+	Convey("Asking for many infohashes in one scrape", t, func() {
+		a := InfoHash{0xaa, 0xbb, '~'}
+		c := InfoHash{0xcc, 0xdd}
+		result, err := GetScrapeURL("http://example.com/announce", a, c)
+		So(err, ShouldBeNil)
+		So(result, ShouldEqual, "http://example.com/scrape?info_hash=%AA%BB~"+strings.Repeat("%00", 17)+
+			"&info_hash=%CC%DD"+strings.Repeat("%00", 18))
+
+		result, err = GetScrapeURL("http://example.com/announce?key=1", a)
+		So(err, ShouldBeNil)
+		So(result, ShouldStartWith, "http://example.com/scrape?key=1&info_hash=%AA%BB~%00")
+	})
+
+	Convey("Parsing a scrape response", t, func() {
+		files, err := NewScrapeResponse("d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei5e10:downloadedi50e10:incompletei10eeee")
+		So(err, ShouldBeNil)
+		infoHash, _ := NewInfoHash([]byte("aaaaaaaaaaaaaaaaaaaa"))
+		So(files, ShouldResemble, map[InfoHash]ScrapeFile{
+			infoHash: ScrapeFile{Complete: 5, Downloaded: 50, Incomplete: 10},
+		})
+
+		b, err := MarshalScrapeResponse(files)
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, "d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei5e10:downloadedi50e10:incompletei10eeee")
+		b, err = MarshalScrapeResponse(nil)
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, "d5:filesdee")
+
+		_, err = NewScrapeResponse("d14:failure reason8:an errore")
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "an error")
+
+		_, err = NewScrapeResponse("de")
+		So(err, ShouldNotBeNil)
+
+		// Keys that are not infohashes are skipped
+		files, err = NewScrapeResponse("d5:filesd5:shortd8:completei1eeee")
+		So(err, ShouldBeNil)
+		So(files, ShouldBeEmpty)
+	})
+}
@@ -5,18 +5,31 @@ import (
 	"errors"
 	"fmt"
 	"github.com/stratospark/torro/bencoding"
+	"math"
 	"net"
+	"net/url"
 	"strconv"
 	"strings"
 )
 
+/*
+TrackerRequest holds the parameters of an announce. AnnounceURL is the
+tracker to contact, falling back to Metainfo.Announce when empty, and
+Tiers is this request's own shuffled copy of the announce list.
+Remaining, when set, is the number of bytes left to download and takes
+precedence over the amount computed from Downloaded.
+*/
 type TrackerRequest struct {
-	Metainfo   *Metainfo
-	InfoHash   string
+	Metainfo    *Metainfo
+	AnnounceURL string
+	Tiers       AnnounceList
+
+	InfoHash   InfoHash
 	PeerID     string
 	Port       int
-	Uploaded   int
-	Downloaded int
+	Uploaded   int64
+	Downloaded int64
+	Remaining  *int64
 	Compact    bool
 	NoPeerID   bool
 	Event      string
@@ -28,14 +41,36 @@ type TrackerRequest struct {
 }
 
 func NewTrackerRequest(metainfo *Metainfo) *TrackerRequest {
+	tiers := NewAnnounceList(metainfo.Announce, metainfo.AnnounceList)
+	tiers.Shuffle()
+
 	return &TrackerRequest{
 		Metainfo: metainfo,
+		Tiers:    tiers,
 		InfoHash: metainfo.Info.Hash,
-		PeerID:   "-TR2840-nj5ovtkoz2ed8", // TODO: generate unique PeerID
+		PeerID:   SessionPeerID,
+		Key:      NewKey(),
+	}
+}
+
+/*
+Validate checks the fields that every tracker requires before the
+request is sent.
+*/
+func (request *TrackerRequest) Validate() error {
+	if request.InfoHash.IsZero() {
+		return ErrInvalidInfoHash
+	}
+	if len(request.PeerID) != 20 {
+		return errors.New(fmt.Sprintf("Invalid Peer ID, Must Be 20 Bytes: %q", request.PeerID))
 	}
+	return nil
 }
 
-func (request *TrackerRequest) Left() int {
+func (request *TrackerRequest) Left() int64 {
+	if request.Remaining != nil {
+		return *request.Remaining
+	}
 	return request.Metainfo.Info.TotalBytes - request.Downloaded
 }
 
@@ -47,36 +82,249 @@ func Btos(b bool) string {
 	return result
 }
 
-func (request *TrackerRequest) GetURL() string {
-	// TODO: handle AnnounceLists
+/*
+ParseTrackerQuery parses the query string of a request received by a
+tracker. Unlike url.ParseQuery, it does not turn '+' into a space or
+reject ';', since clients put raw bytes of the info hash and peer id
+in the query and only percent-encode some of them.
+*/
+func ParseTrackerQuery(rawQuery string) (url.Values, error) {
+	query := make(url.Values)
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		key, value := param, ""
+		if i := strings.Index(param, "="); i >= 0 {
+			key, value = param[:i], param[i+1:]
+		}
+		key, err := url.PathUnescape(key)
+		if err != nil {
+			return nil, err
+		}
+		value, err = url.PathUnescape(value)
+		if err != nil {
+			return nil, err
+		}
+		query[key] = append(query[key], value)
+	}
+	return query, nil
+}
+
+/*
+ParseTrackerRequest parses the query string of an announce received
+by a tracker. Remaining is set from left.
+*/
+func ParseTrackerRequest(rawQuery string) (*TrackerRequest, error) {
+	query, err := ParseTrackerQuery(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"info_hash", "peer_id", "port", "left"} {
+		if query.Get(name) == "" {
+			return nil, errors.New(fmt.Sprint("Missing Required Field: ", name))
+		}
+	}
+
+	infoHash, err := NewInfoHash([]byte(query.Get("info_hash")))
+	if err != nil {
+		return nil, err
+	}
+
+	request := &TrackerRequest{
+		InfoHash:  infoHash,
+		PeerID:    query.Get("peer_id"),
+		Compact:   query.Get("compact") == "1",
+		NoPeerID:  query.Get("no_peer_id") == "1",
+		Event:     query.Get("event"),
+		IP:        query.Get("ip"),
+		Key:       query.Get("key"),
+		TrackerID: query.Get("trackerid"),
+	}
+
+	var left int64
+	ints := []struct {
+		name string
+		min  int64
+		max  int64
+		dst  interface{}
+	}{
+		{"port", 1, 65535, &request.Port},
+		{"left", 0, math.MaxInt64, &left},
+		{"uploaded", 0, math.MaxInt64, &request.Uploaded},
+		{"downloaded", 0, math.MaxInt64, &request.Downloaded},
+		{"numwant", -1, math.MaxInt32, &request.NumWant},
+	}
+	for _, field := range ints {
+		value := query.Get(field.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < field.min || n > field.max {
+			return nil, errors.New(fmt.Sprintf("Invalid Field: %s=%q", field.name, value))
+		}
+		switch dst := field.dst.(type) {
+		case *int:
+			*dst = int(n)
+		case *int64:
+			*dst = n
+		}
+	}
+	request.Remaining = &left
+
+	if err := request.Validate(); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+/*
+escapeBinary percent-encodes every byte of s except the unreserved
+characters of RFC 3986, so that binary values such as the info hash
+and peer id survive the trip to the tracker unchanged.
+*/
+func escapeBinary(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&15])
+	}
+	return b.String()
+}
 
-	url := request.Metainfo.Announce
-	url += "?info_hash=" + request.Metainfo.Info.Hash +
-		"&peer_id=" + request.PeerID +
-		"&port=" + strconv.Itoa(request.Port) +
-		"&uploaded=" + strconv.Itoa(request.Uploaded) +
-		"&downloaded=" + strconv.Itoa(request.Downloaded) +
-		"&left=" + strconv.Itoa(request.Left()) +
-		"&compact=" + Btos(request.Compact) +
-		"&no_peer_id=" + Btos(request.NoPeerID) +
-		"&corrupt=" + Btos(request.Corrupt) +
-		"&numwant=" + strconv.Itoa(request.NumWant) +
-		"&event=" + request.Event
+/*
+GetURL returns the announce URL with the request's parameters added
+to any query the announce URL already has. Optional parameters are
+only sent when they are set.
+*/
+func (request *TrackerRequest) GetURL() (string, error) {
+	announceURL := request.AnnounceURL
+	if announceURL == "" {
+		announceURL = request.Metainfo.Announce
+	}
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return "", err
+	}
+	params := []string{
+		"info_hash=" + request.InfoHash.URLEscaped(),
+		"peer_id=" + escapeBinary(request.PeerID),
+		"port=" + strconv.Itoa(request.Port),
+		"uploaded=" + strconv.FormatInt(request.Uploaded, 10),
+		"downloaded=" + strconv.FormatInt(request.Downloaded, 10),
+		"left=" + strconv.FormatInt(request.Left(), 10),
+		"compact=" + Btos(request.Compact),
+	}
+	optional := []struct {
+		name  string
+		value string
+		set   bool
+	}{
+		{"no_peer_id", "1", request.NoPeerID},
+		{"corrupt", "1", request.Corrupt},
+		{"event", request.Event, request.Event != ""},
+		{"ip", request.IP, request.IP != ""},
+		{"numwant", strconv.Itoa(request.NumWant), request.NumWant > 0},
+		{"key", request.Key, request.Key != ""},
+		{"trackerid", request.TrackerID, request.TrackerID != ""},
+	}
+	for _, param := range optional {
+		if param.set {
+			params = append(params, param.name+"="+escapeBinary(param.value))
+		}
+	}
 
-	return url
+	query := strings.Join(params, "&")
+	if u.RawQuery != "" {
+		query = u.RawQuery + "&" + query
+	}
+	u.RawQuery = query
+	return u.String(), nil
 }
 
+/*
+Peer is a peer returned by a tracker. ID is only known when the
+tracker sent the dictionary peer model.
+*/
 type Peer struct {
 	IP   net.IP
 	Port uint16
+	ID   string
 }
 
 func (peer *Peer) String() string {
 	return fmt.Sprintf("%s:%d", peer.IP, peer.Port)
 }
 
+/*
+AddrString returns the address of the peer to dial, with IPv6
+addresses in brackets.
+*/
 func (peer *Peer) AddrString() string {
-	return fmt.Sprintf("\"%s\":%d", peer.IP, peer.Port)
+	return net.JoinHostPort(peer.IP.String(), strconv.Itoa(int(peer.Port)))
+}
+
+/*
+NewCompactPeers parses peers in the compact format, where each peer
+is an IP address of ipLen bytes followed by a 2 byte port, all in
+network byte order.
+*/
+func NewCompactPeers(b []byte, ipLen int) ([]Peer, error) {
+	size := ipLen + 2
+	if len(b)%size != 0 {
+		return nil, errors.New(fmt.Sprintf("Compact Peers Length %d Is Not A Multiple Of %d", len(b), size))
+	}
+	peers := make([]Peer, 0, len(b)/size)
+	for i := 0; i < len(b); i += size {
+		ip := make(net.IP, ipLen)
+		copy(ip, b[i:i+ipLen])
+		port := binary.BigEndian.Uint16(b[i+ipLen : i+size])
+		peers = append(peers, Peer{IP: ip, Port: port})
+	}
+	return peers, nil
+}
+
+/*
+peerDict is a single peer in the dictionary peer model.
+*/
+type peerDict struct {
+	PeerID string `bencode:"peer id,omitempty"`
+	IP     string `bencode:"ip"`
+	Port   *int   `bencode:"port"`
+}
+
+/*
+newDictPeers parses peers in the dictionary model, a list of
+dictionaries with "peer id", "ip" and "port" keys.
+*/
+func newDictPeers(dicts []peerDict) ([]Peer, error) {
+	peers := make([]Peer, 0, len(dicts))
+	for _, dict := range dicts {
+		ip := net.ParseIP(dict.IP)
+		if ip == nil {
+			return nil, errors.New("Invalid Peer IP: " + dict.IP)
+		}
+		if dict.Port == nil {
+			return nil, errors.New(fmt.Sprint("Missing Required Field: port"))
+		}
+		if *dict.Port < 0 || *dict.Port > 65535 {
+			return nil, errors.New(fmt.Sprint("Invalid Peer Port: ", *dict.Port))
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		peers = append(peers, Peer{IP: ip, Port: uint16(*dict.Port), ID: dict.PeerID})
+	}
+	return peers, nil
 }
 
 type TrackerResponse struct {
@@ -87,6 +335,12 @@ type TrackerResponse struct {
 	MinInterval int
 	Peers       []Peer
 
+	// TrackerID should be sent back on later announces to this tracker
+	TrackerID      string
+	WarningMessage string
+	// ExternalIP is our address as seen by the tracker, see BEP 24
+	ExternalIP net.IP
+
 	FailureReason string
 }
 
@@ -97,50 +351,179 @@ func (tr *TrackerResponse) String() string {
 	}
 	joinedPeers := strings.Join(peerList, ", ")
 
-	return fmt.Sprintf("Response [Complete: %d, Incomplete %d, Downloaded: %d, Interval: %d, MinInterval: %d, Peers: %q]",
-		tr.Complete, tr.Incomplete, tr.Downloaded, tr.Interval, tr.MinInterval, joinedPeers)
+	warning := ""
+	if tr.WarningMessage != "" {
+		warning = fmt.Sprintf(", Warning: %q", tr.WarningMessage)
+	}
+
+	return fmt.Sprintf("Response [Complete: %d, Incomplete %d, Downloaded: %d, Interval: %d, MinInterval: %d, Peers: %q%s]",
+		tr.Complete, tr.Incomplete, tr.Downloaded, tr.Interval, tr.MinInterval, joinedPeers, warning)
 }
 
-func NewTrackerResponse(responseStr string) (*TrackerResponse, error) {
-	lex := bencoding.BeginLexing("response", responseStr, bencoding.LexBegin)
-	tokens := bencoding.Collect(lex)
-	parser := bencoding.Parse(tokens)
-	o := parser.Output.(map[string]interface{})
+/*
+Marshal returns the bencoded response, with the peers in the compact
+format if compact is set, and without peer ids if noPeerID is set.
+In the compact format IPv6 peers are sent separately in peers6, see
+BEP 7, while the list of peer dictionaries holds peers of both kinds.
+*/
+func (tr *TrackerResponse) Marshal(compact, noPeerID bool) ([]byte, error) {
+	if tr.FailureReason != "" {
+		return bencoding.Marshal(map[string]string{"failure reason": tr.FailureReason})
+	}
 
-	// TODO: Handle required/optional fields
-	response := &TrackerResponse{}
+	dict := map[string]interface{}{
+		"complete":   tr.Complete,
+		"incomplete": tr.Incomplete,
+		"interval":   tr.Interval,
+	}
+	optional := []struct {
+		name  string
+		value interface{}
+		set   bool
+	}{
+		{"downloaded", tr.Downloaded, tr.Downloaded != 0},
+		{"min interval", tr.MinInterval, tr.MinInterval != 0},
+		{"tracker id", tr.TrackerID, tr.TrackerID != ""},
+		{"warning message", tr.WarningMessage, tr.WarningMessage != ""},
+		{"external ip", []byte(tr.ExternalIP), tr.ExternalIP != nil},
+	}
+	for _, field := range optional {
+		if field.set {
+			dict[field.name] = field.value
+		}
+	}
 
-	addStringField("failure reason", &response.FailureReason, o["failure reason"], false)
-	if response.FailureReason != "" {
-		return response, errors.New("Tracker Request Failure")
+	if compact {
+		peers, peers6 := []byte{}, []byte{}
+		for _, peer := range tr.Peers {
+			port := make([]byte, 2)
+			binary.BigEndian.PutUint16(port, peer.Port)
+			if ip := peer.IP.To4(); ip != nil {
+				peers = append(append(peers, ip...), port...)
+			} else {
+				peers6 = append(append(peers6, peer.IP.To16()...), port...)
+			}
+		}
+		dict["peers"] = peers
+		if len(peers6) > 0 {
+			dict["peers6"] = peers6
+		}
+	} else {
+		peers := make([]peerDict, 0, len(tr.Peers))
+		for _, peer := range tr.Peers {
+			port := int(peer.Port)
+			entry := peerDict{IP: peer.IP.String(), Port: &port}
+			if !noPeerID {
+				entry.PeerID = peer.ID
+			}
+			peers = append(peers, entry)
+		}
+		dict["peers"] = peers
 	}
 
-	err := addIntField("complete", &response.Complete, o["complete"], true)
-	if err != nil {
-		return response, err
+	return bencoding.Marshal(dict)
+}
+
+/*
+trackerResponseDict mirrors the bencoded tracker response. Required
+integer fields are pointers so that missing keys can be detected.
+*/
+type trackerResponseDict struct {
+	FailureReason string `bencode:"failure reason"`
+	Complete      *int   `bencode:"complete"`
+	Incomplete    *int   `bencode:"incomplete"`
+	Downloaded    int    `bencode:"downloaded"`
+	Interval      *int   `bencode:"interval"`
+	MinInterval   int    `bencode:"min interval"`
+
+	TrackerID      string `bencode:"tracker id"`
+	WarningMessage string `bencode:"warning message"`
+	ExternalIP     []byte `bencode:"external ip"`
+
+	// Peers is either a compact string or a list of dictionaries
+	Peers  bencoding.RawMessage `bencode:"peers"`
+	Peers6 []byte               `bencode:"peers6"`
+}
+
+/*
+peers decodes both the IPv4 and the IPv6 peer lists.
+*/
+func (raw *trackerResponseDict) peers() ([]Peer, error) {
+	peers := make([]Peer, 0)
+	if len(raw.Peers) > 0 && raw.Peers[0] == 'l' {
+		dicts := make([]peerDict, 0)
+		if err := bencoding.Unmarshal(raw.Peers, &dicts); err != nil {
+			return nil, err
+		}
+		dictPeers, err := newDictPeers(dicts)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, dictPeers...)
+	} else if raw.Peers != nil {
+		var b []byte
+		if err := bencoding.Unmarshal(raw.Peers, &b); err != nil {
+			return nil, err
+		}
+		compactPeers, err := NewCompactPeers(b, net.IPv4len)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, compactPeers...)
 	}
-	err = addIntField("incomplete", &response.Incomplete, o["incomplete"], true)
+
+	compactPeers, err := NewCompactPeers(raw.Peers6, net.IPv6len)
 	if err != nil {
-		return response, err
+		return nil, err
 	}
-	addIntField("downloaded", &response.Downloaded, o["downloaded"], false)
-	err = addIntField("interval", &response.Interval, o["interval"], true)
+	return append(peers, compactPeers...), nil
+}
+
+func NewTrackerResponse(responseStr string) (*TrackerResponse, error) {
+	response := &TrackerResponse{}
+
+	raw := &trackerResponseDict{}
+	err := bencoding.Unmarshal([]byte(responseStr), raw)
 	if err != nil {
 		return response, err
 	}
-	addIntField("min_interval", &response.MinInterval, o["min interval"], false)
 
-	// TODO: Handle dictionary vs binary peer models
-	peers := make([]Peer, 0)
-	if _, ok := o["peers"]; !ok {
-		return response, errors.New(fmt.Sprint("Missing Required Field: peers"))
+	response.FailureReason = raw.FailureReason
+	if response.FailureReason != "" {
+		return response, errors.New("Tracker Request Failure: " + response.FailureReason)
 	}
-	peerBytes := o["peers"].([]byte)
-	for i := 0; i < len(peerBytes); i += 6 {
-		ip := net.IPv4(peerBytes[i+3], peerBytes[i+2], peerBytes[i+1], peerBytes[i])
 
-		port := binary.BigEndian.Uint16(peerBytes[i+4 : i+6])
-		peers = append(peers, Peer{IP: ip, Port: port})
+	required := []struct {
+		name string
+		src  *int
+		dst  *int
+	}{
+		{"complete", raw.Complete, &response.Complete},
+		{"incomplete", raw.Incomplete, &response.Incomplete},
+		{"interval", raw.Interval, &response.Interval},
+	}
+	for _, field := range required {
+		if field.src == nil {
+			return response, errors.New(fmt.Sprint("Missing Required Field: ", field.name))
+		}
+		*field.dst = *field.src
+	}
+	response.Downloaded = raw.Downloaded
+	response.MinInterval = raw.MinInterval
+	response.TrackerID = raw.TrackerID
+	response.WarningMessage = raw.WarningMessage
+
+	// The external IP is a compact address, anything else is ignored
+	if len(raw.ExternalIP) == net.IPv4len || len(raw.ExternalIP) == net.IPv6len {
+		response.ExternalIP = net.IP(raw.ExternalIP)
+	}
+
+	if raw.Peers == nil && raw.Peers6 == nil {
+		return response, errors.New(fmt.Sprint("Missing Required Field: peers"))
+	}
+	peers, err := raw.peers()
+	if err != nil {
+		return response, err
 	}
 	response.Peers = peers
 
@@ -2,6 +2,8 @@ package structure
 
 import (
 	. "github.com/smartystreets/goconvey/convey"
+	"net"
+	"net/url"
 	"strconv"
 	"testing"
 )
@@ -9,11 +11,19 @@ import (
 func TestTrackerRequest(t *testing.T) {
 	Convey("Creating a Tracker Request struct", t, func() {
 		filename := "../testfiles/TheInternetsOwnBoyTheStoryOfAaronSwartz_archive.torrent"
-		metainfo := NewMetainfo(filename)
+		metainfo, _ := NewMetainfo(filename)
 		request := NewTrackerRequest(metainfo)
 		So(request, ShouldNotBeNil)
-		So(request.InfoHash, ShouldEqual, "%29%eb%26%d6%ba%89d%9c%10%5d%c8%e2~%af%dc%0c.%f6%22%92")
-		So(request.PeerID, ShouldEqual, "-TR2840-nj5ovtkoz2ed8")
+		So(request.InfoHash.Hex(), ShouldEqual, "29eb26d6ba89649c105dc8e27eafdc0c2ef62292")
+		So(request.PeerID, ShouldEqual, SessionPeerID)
+		So(request.Key, ShouldHaveLength, 8)
+		So(request.Validate(), ShouldBeNil)
+
+		request.PeerID = "-TR2840-nj5ovtkoz2ed8"
+		So(request.Validate(), ShouldNotBeNil)
+		request.PeerID = SessionPeerID
+		request.InfoHash = InfoHash{}
+		So(request.Validate(), ShouldEqual, ErrInvalidInfoHash)
 	})
 
 	Convey("Parsing many torrent files", t, func() {
@@ -24,7 +34,7 @@ func TestTrackerRequest(t *testing.T) {
 
 		for _, filename := range filenames {
 			Convey("Parsing "+filename, func() {
-				metainfo := NewMetainfo(filename)
+				metainfo, _ := NewMetainfo(filename)
 				request := NewTrackerRequest(metainfo)
 				So(request, ShouldNotBeNil)
 			})
@@ -33,40 +43,57 @@ func TestTrackerRequest(t *testing.T) {
 
 	Convey("Getting a GET /announce URL", t, func() {
 		filename := "../testfiles/kali-linux-2.0-i386.iso.torrent"
-		metainfo := NewMetainfo(filename)
+		metainfo, _ := NewMetainfo(filename)
 		request := NewTrackerRequest(metainfo)
 		request.Downloaded = 100
 		So(request, ShouldNotBeNil)
 
-		compactInt := 0
-		if request.Compact {
-			compactInt = 1
-		}
+		expected := metainfo.Announce +
+			"?info_hash=" + escapeBinary(string(metainfo.Info.Hash[:])) +
+			"&peer_id=" + request.PeerID +
+			"&port=" + strconv.Itoa(request.Port) +
+			"&uploaded=" + strconv.FormatInt(request.Uploaded, 10) +
+			"&downloaded=" + strconv.FormatInt(request.Downloaded, 10) +
+			"&left=" + strconv.FormatInt(metainfo.Info.TotalBytes-request.Downloaded, 10) +
+			"&compact=0" +
+			"&key=" + request.Key
 
-		noPeerInt := 0
-		if request.NoPeerID {
-			noPeerInt = 1
-		}
+		result, err := request.GetURL()
+		So(err, ShouldBeNil)
+		So(result, ShouldEqual, expected)
+	})
 
-		corruptInt := 0
-		if request.Corrupt {
-			corruptInt = 1
-		}
+	Convey("Escaping binary values and sending optional fields", t, func() {
+		filename := "../testfiles/kali-linux-2.0-i386.iso.torrent"
+		metainfo, _ := NewMetainfo(filename)
+		request := NewTrackerRequest(metainfo)
+		request.AnnounceURL = "http://example.com/announce?passkey=abc"
+		request.InfoHash, _ = NewInfoHash([]byte("\x00\xff +&=%~aaaaaaaaaaaa"))
+		request.PeerID = "-TO0001-\x01\x02 +/?aaaaaa"
+		request.Port = 6881
+		request.Compact = true
+		request.NoPeerID = true
+		request.Event = "started"
+		request.IP = "10.0.0.1"
+		request.NumWant = 50
+		request.Key = "deadbeef"
+		request.TrackerID = "a b"
 
-		url := metainfo.Announce +
-			"?info_hash=" + metainfo.Info.Hash +
-			"&peer_id=" + request.PeerID +
-			"&port=" + strconv.Itoa(request.Port) +
-			"&uploaded=" + strconv.Itoa(request.Uploaded) +
-			"&downloaded=" + strconv.Itoa(request.Downloaded) +
-			"&left=" + strconv.Itoa(metainfo.Info.TotalBytes-request.Downloaded) +
-			"&compact=" + strconv.Itoa(compactInt) +
-			"&no_peer_id=" + strconv.Itoa(noPeerInt) +
-			"&corrupt=" + strconv.Itoa(corruptInt) +
-			"&numwant=" + strconv.Itoa(request.NumWant) +
-			"&event=" + request.Event
-
-		So(request.GetURL(), ShouldEqual, url)
+		result, err := request.GetURL()
+		So(err, ShouldBeNil)
+		So(result, ShouldStartWith, "http://example.com/announce?passkey=abc&info_hash=%00%FF%20%2B%26%3D%25~aaaaaaaaaaaa&peer_id=-TO0001-%01%02%20%2B%2F%3Faaaaaa&")
+		So(result, ShouldEndWith, "&compact=1&no_peer_id=1&event=started&ip=10.0.0.1&numwant=50&key=deadbeef&trackerid=a%20b")
+
+		u, err := url.Parse(result)
+		So(err, ShouldBeNil)
+		query := u.Query()
+		So(query.Get("passkey"), ShouldEqual, "abc")
+		So(query.Get("info_hash"), ShouldEqual, "\x00\xff +&=%~aaaaaaaaaaaa")
+		So(query.Get("peer_id"), ShouldEqual, request.PeerID)
+
+		request.AnnounceURL = "http://example.com/%zz"
+		_, err = request.GetURL()
+		So(err, ShouldNotBeNil)
 	})
 }
 
@@ -86,3 +113,154 @@ func TestTrackerResponse(t *testing.T) {
 		So(len(r.Peers), ShouldEqual, 200)
 	})
 }
+
+func TestTrackerResponsePeers(t *testing.T) {
+	header := "d8:completei1e10:incompletei2e8:intervali1800e"
+
+	Convey("Parsing compact IPv4 peers in network byte order", t, func() {
+		r, err := NewTrackerResponse(header + "5:peers6:\x0a\x00\x00\x01\x1a\xe1e")
+		So(err, ShouldBeNil)
+		So(r.Peers, ShouldHaveLength, 1)
+		So(r.Peers[0].String(), ShouldEqual, "10.0.0.1:6881")
+	})
+
+	Convey("Parsing dictionary peers", t, func() {
+		r, err := NewTrackerResponse(header + "5:peersld2:ip8:10.0.0.27:peer id20:-TR2840-nj5ovtkoz2ed4:porti6881eed2:ip11:2001:db8::14:porti51413eeee")
+		So(err, ShouldBeNil)
+		So(r.Peers, ShouldHaveLength, 2)
+		So(r.Peers[0].String(), ShouldEqual, "10.0.0.2:6881")
+		So(r.Peers[0].ID, ShouldEqual, "-TR2840-nj5ovtkoz2ed")
+		So(r.Peers[1].String(), ShouldEqual, "2001:db8::1:51413")
+		So(r.Peers[1].ID, ShouldEqual, "")
+
+		_, err = NewTrackerResponse(header + "5:peersld2:ip7:unknownee")
+		So(err, ShouldNotBeNil)
+		_, err = NewTrackerResponse(header + "5:peersld2:ip8:10.0.0.2eee")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Parsing compact IPv6 peers", t, func() {
+		r, err := NewTrackerResponse(header + "5:peers0:6:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1e")
+		So(err, ShouldBeNil)
+		So(r.Peers, ShouldHaveLength, 1)
+		So(r.Peers[0].String(), ShouldEqual, "2001:db8::1:6881")
+
+		r, err = NewTrackerResponse(header + "6:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1e")
+		So(err, ShouldBeNil)
+		So(r.Peers, ShouldHaveLength, 1)
+	})
+
+	Convey("Rejecting truncated compact peers", t, func() {
+		_, err := NewTrackerResponse(header + "5:peers5:\x0a\x00\x00\x01\x1ae")
+		So(err, ShouldNotBeNil)
+		_, err = NewTrackerResponse(header + "5:peers0:6:peers617:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1ae")
+		So(err, ShouldNotBeNil)
+		_, err = NewTrackerResponse(header + "e")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestTrackerResponseOptionalFields(t *testing.T) {
+	Convey("Parsing tracker id, warning message and external ip", t, func() {
+		r, err := NewTrackerResponse("d8:completei1e11:external ip4:\x0a\x00\x00\x0910:incompletei2e8:intervali1800e12:min intervali900e5:peers0:10:tracker id3:abc15:warning message4:slowe")
+		So(err, ShouldBeNil)
+		So(r.MinInterval, ShouldEqual, 900)
+		So(r.TrackerID, ShouldEqual, "abc")
+		So(r.WarningMessage, ShouldEqual, "slow")
+		So(r.ExternalIP.String(), ShouldEqual, "10.0.0.9")
+		So(r.String(), ShouldContainSubstring, "Warning: \"slow\"")
+	})
+
+	Convey("Sending the tracker id back", t, func() {
+		metainfo, _ := NewMetainfo("../testfiles/kali-linux-2.0-i386.iso.torrent")
+		request := NewTrackerRequest(metainfo)
+		result, _ := request.GetURL()
+		So(result, ShouldNotContainSubstring, "trackerid")
+		request.TrackerID = "abc"
+		result, _ = request.GetURL()
+		So(result, ShouldEndWith, "&trackerid=abc")
+	})
+}
+
+func TestTrackerServerSide(t *testing.T) {
+	Convey("Parsing an announce received by a tracker", t, func() {
+		metainfo, _ := NewMetainfo("../testfiles/kali-linux-2.0-i386.iso.torrent")
+		request := NewTrackerRequest(metainfo)
+		request.Port = 6881
+		request.Uploaded = 10
+		request.Compact = true
+		request.Event = "started"
+		request.NumWant = 20
+		announceURL, err := request.GetURL()
+		So(err, ShouldBeNil)
+		u, _ := url.Parse(announceURL)
+
+		parsed, err := ParseTrackerRequest(u.RawQuery)
+		So(err, ShouldBeNil)
+		So(parsed.InfoHash, ShouldEqual, request.InfoHash)
+		So(parsed.PeerID, ShouldEqual, request.PeerID)
+		So(parsed.Port, ShouldEqual, 6881)
+		So(parsed.Uploaded, ShouldEqual, 10)
+		So(parsed.Left(), ShouldEqual, request.Left())
+		So(parsed.Compact, ShouldBeTrue)
+		So(parsed.Event, ShouldEqual, "started")
+		So(parsed.NumWant, ShouldEqual, 20)
+		So(parsed.Key, ShouldEqual, request.Key)
+
+		_, err = ParseTrackerRequest("info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=-TO0001-aaaaaaaaaaaa&port=6881")
+		So(err, ShouldNotBeNil)
+		_, err = ParseTrackerRequest("info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=-TO0001-aaaaaaaaaaaa&port=70000&left=0")
+		So(err, ShouldNotBeNil)
+		_, err = ParseTrackerRequest("info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=-TO0001-aaaaaaaaaaaa&port=0&left=0")
+		So(err, ShouldNotBeNil)
+		_, err = ParseTrackerRequest("info_hash=short&peer_id=-TO0001-aaaaaaaaaaaa&port=6881&left=0")
+		So(err, ShouldNotBeNil)
+
+		// '+' and ';' are raw bytes, not a space and a separator
+		parsed, err = ParseTrackerRequest("info_hash=aaaaaaaaaaaaaaaaa+;%2B&peer_id=-TO0001-aaaaaaaaa+aa&port=6881&left=0")
+		So(err, ShouldBeNil)
+		expected, _ := NewInfoHash([]byte("aaaaaaaaaaaaaaaaa+;+"))
+		So(parsed.InfoHash, ShouldEqual, expected)
+		So(parsed.PeerID, ShouldEqual, "-TO0001-aaaaaaaaa+aa")
+		_, err = ParseTrackerRequest("info_hash=aaaaaaaaaaaaaaaaaaa%zz&peer_id=-TO0001-aaaaaaaaaaaa&port=6881&left=0")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Encoding a tracker response", t, func() {
+		tr := &TrackerResponse{
+			Complete:   1,
+			Incomplete: 2,
+			Interval:   1800,
+			TrackerID:  "abc",
+			Peers: []Peer{
+				{IP: net.ParseIP("10.0.0.1").To4(), Port: 6881, ID: "-TO0001-aaaaaaaaaaaa"},
+				{IP: net.ParseIP("2001:db8::1"), Port: 6882},
+			},
+		}
+
+		b, err := tr.Marshal(true, false)
+		So(err, ShouldBeNil)
+		parsed, err := NewTrackerResponse(string(b))
+		So(err, ShouldBeNil)
+		So(parsed.TrackerID, ShouldEqual, "abc")
+		So(parsed.Peers, ShouldHaveLength, 2)
+		So(parsed.Peers[0].String(), ShouldEqual, "10.0.0.1:6881")
+		So(parsed.Peers[1].String(), ShouldEqual, "2001:db8::1:6882")
+
+		b, err = tr.Marshal(false, false)
+		So(err, ShouldBeNil)
+		So(string(b), ShouldNotContainSubstring, "peers6")
+		parsed, err = NewTrackerResponse(string(b))
+		So(err, ShouldBeNil)
+		So(parsed.Peers, ShouldResemble, tr.Peers)
+
+		b, err = tr.Marshal(false, true)
+		So(err, ShouldBeNil)
+		So(string(b), ShouldNotContainSubstring, "peer id")
+
+		tr.FailureReason = "an error"
+		b, err = tr.Marshal(true, false)
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, "d14:failure reason8:an errore")
+	})
+}
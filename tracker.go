@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/stratospark/torro/structure"
+	"github.com/stratospark/torro/tracker"
+	"io"
+	"os"
+	"strings"
+)
+
+/*
+trackerCommand implements "torro tracker", running an HTTP tracker,
+and a UDP tracker sharing the same swarms if -udp is given, until one
+of them fails. It returns the exit status.
+*/
+func trackerCommand(args []string, stderr io.Writer) int {
+	flags := flag.NewFlagSet("tracker", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	pListen := flags.String("listen", ":6969", "address to serve /announce and /scrape on")
+	pUDP := flags.String("udp", "", "address to serve the UDP tracker protocol on, e.g. :6969")
+	pInterval := flags.Duration("interval", 0, "announce interval sent to clients (default 30m)")
+	pWhitelist := flags.String("whitelist", "", "file of hex infohashes, one per line, that may be announced")
+	pAllowIP := flags.Bool("allow-ip", false, "use the address peers announce in the ip parameter instead of their connection's")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	t := tracker.NewTracker()
+	t.AllowClientIP = *pAllowIP
+	if *pInterval > 0 {
+		t.Interval = *pInterval
+		t.PeerTTL = *pInterval * 3 / 2
+	}
+	if *pWhitelist != "" {
+		whitelist, err := readWhitelist(*pWhitelist)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		t.Whitelist = whitelist
+	}
+
+	t.Start()
+	defer t.Stop()
+
+	errs := make(chan error, 2)
+	go func() {
+		errs <- t.ListenAndServe(*pListen)
+	}()
+	if *pUDP != "" {
+		go func() {
+			errs <- tracker.NewUDPServer(t).ListenAndServe(*pUDP)
+		}()
+	}
+
+	fmt.Fprintln(stderr, <-errs)
+	return 1
+}
+
+/*
+readWhitelist reads hex or base32 encoded infohashes, one per line,
+ignoring blank lines and lines starting with #.
+*/
+func readWhitelist(filename string) (map[structure.InfoHash]bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	whitelist := make(map[structure.InfoHash]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		infoHash, err := structure.ParseInfoHash(line)
+		if err != nil {
+			return nil, errors.New("Invalid Info Hash In Whitelist: " + line)
+		}
+		whitelist[infoHash] = true
+	}
+	return whitelist, scanner.Err()
+}
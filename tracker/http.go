@@ -0,0 +1,90 @@
+package tracker
+
+import (
+	"github.com/stratospark/torro/structure"
+	"log"
+	"net"
+	"net/http"
+)
+
+/*
+ServeHTTP answers announces on /announce and scrapes on /scrape.
+Errors are sent to the client as a failure reason, as clients expect.
+*/
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/announce":
+		t.serveAnnounce(w, r)
+	case "/scrape":
+		t.serveScrape(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+/*
+ListenAndServe serves the tracker over HTTP on addr.
+*/
+func (t *Tracker) ListenAndServe(addr string) error {
+	log.Println("[Tracker] Listening on", addr)
+	return http.ListenAndServe(addr, t)
+}
+
+func (t *Tracker) serveAnnounce(w http.ResponseWriter, r *http.Request) {
+	req, err := structure.ParseTrackerRequest(r.URL.RawQuery)
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+	tr, err := t.Announce(req, net.ParseIP(host))
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+
+	body, err := tr.Marshal(req.Compact, req.NoPeerID)
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(body)
+}
+
+func (t *Tracker) serveScrape(w http.ResponseWriter, r *http.Request) {
+	query, err := structure.ParseTrackerQuery(r.URL.RawQuery)
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+
+	infoHashes := make([]structure.InfoHash, 0, len(query["info_hash"]))
+	for _, raw := range query["info_hash"] {
+		infoHash, err := structure.NewInfoHash([]byte(raw))
+		if err != nil {
+			writeFailure(w, err)
+			return
+		}
+		infoHashes = append(infoHashes, infoHash)
+	}
+	body, err := structure.MarshalScrapeResponse(t.Scrape(infoHashes...))
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(body)
+}
+
+func writeFailure(w http.ResponseWriter, err error) {
+	tr := &structure.TrackerResponse{FailureReason: err.Error()}
+	body, _ := tr.Marshal(false, false)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(body)
+}
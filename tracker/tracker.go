@@ -0,0 +1,303 @@
+package tracker
+
+import (
+	"errors"
+	"github.com/stratospark/torro/structure"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTorrentNotAllowed = errors.New("Torrent Is Not Registered With This Tracker")
+	ErrInvalidPeerIP     = errors.New("Invalid Peer IP")
+	ErrInvalidPeerPort   = errors.New("Invalid Peer Port")
+	ErrInvalidInfoHash   = structure.ErrInvalidInfoHash
+)
+
+/*
+Tracker keeps the peers of each torrent announced to it. Peers that
+have not announced within PeerTTL are forgotten, and once Start is
+called they are also dropped every SweepInterval, along with the
+torrents left without peers.
+
+Whitelist, when not nil, holds the infohashes of the only torrents
+that may be announced. AllowClientIP honours the ip parameter of
+announces, which lets peers on the same LAN announce their local
+address but also lets anyone announce any address as a peer.
+*/
+type Tracker struct {
+	Interval    time.Duration
+	MinInterval time.Duration
+	PeerTTL     time.Duration
+	// NumWant is the number of peers sent when the client does not ask
+	// for a number, and MaxNumWant is the most that are ever sent
+	NumWant       int
+	MaxNumWant    int
+	Whitelist     map[structure.InfoHash]bool
+	AllowClientIP bool
+	SweepInterval time.Duration
+
+	mu       sync.Mutex
+	torrents map[structure.InfoHash]*swarm
+	now      func() time.Time
+
+	// runOnce makes sure that run is started at most once, and never
+	// after Stop
+	runOnce sync.Once
+	stopCh  chan bool
+	doneCh  chan bool
+}
+
+/*
+swarm holds the peers of a single torrent. Peer IDs are sent to other
+peers, so peers are keyed by peer ID and the address they announce
+from, and nobody can stop or move a peer by announcing its peer ID.
+*/
+type swarm struct {
+	peers      map[peerKey]*swarmPeer
+	downloaded int
+}
+
+type peerKey struct {
+	ID   string
+	Addr string
+}
+
+type swarmPeer struct {
+	Peer     structure.Peer
+	Left     int64
+	LastSeen time.Time
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		Interval:      30 * time.Minute,
+		MinInterval:   5 * time.Minute,
+		PeerTTL:       45 * time.Minute,
+		NumWant:       50,
+		MaxNumWant:    200,
+		SweepInterval: 5 * time.Minute,
+		torrents:      make(map[structure.InfoHash]*swarm),
+		now:           time.Now,
+		stopCh:        make(chan bool),
+		doneCh:        make(chan bool),
+	}
+}
+
+/*
+Start sweeps expired peers on a new goroutine until Stop is called.
+*/
+func (t *Tracker) Start() {
+	t.runOnce.Do(func() {
+		go t.run()
+	})
+}
+
+/*
+Stop stops the sweeping started by Start and waits for it to finish.
+If Start was never called, Stop just keeps it from starting.
+*/
+func (t *Tracker) Stop() {
+	t.runOnce.Do(func() {
+		close(t.doneCh)
+	})
+	select {
+	case t.stopCh <- true:
+		<-t.doneCh
+	case <-t.doneCh:
+	}
+}
+
+func (t *Tracker) run() {
+	defer close(t.doneCh)
+
+	ticker := time.NewTicker(t.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.Sweep()
+		case <-t.stopCh:
+			return
+		}
+	}
+}
+
+/*
+Sweep drops the peers that have not announced within PeerTTL and the
+torrents left without peers, so that torrents that are no longer
+announced do not stay in memory.
+*/
+func (t *Tracker) Sweep() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cutoff := t.now().Add(-t.PeerTTL)
+	for infoHash, s := range t.torrents {
+		s.expire(cutoff)
+		if len(s.peers) == 0 {
+			delete(t.torrents, infoHash)
+		}
+	}
+}
+
+/*
+Announce records the peer making req, connecting from addr, and
+returns some of the other peers of the torrent. The ip parameter of
+the request is only used instead of addr if AllowClientIP is set.
+*/
+func (t *Tracker) Announce(req *structure.TrackerRequest, addr net.IP) (*structure.TrackerResponse, error) {
+	infoHash := req.InfoHash
+	if t.Whitelist != nil && !t.Whitelist[infoHash] {
+		return nil, ErrTorrentNotAllowed
+	}
+
+	ip := addr
+	if t.AllowClientIP && req.IP != "" {
+		ip = net.ParseIP(req.IP)
+	}
+	if ip == nil {
+		return nil, ErrInvalidPeerIP
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if req.Port <= 0 || req.Port > 65535 {
+		return nil, ErrInvalidPeerPort
+	}
+	key := peerKey{ID: req.PeerID, Addr: addr.String()}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	s, ok := t.torrents[infoHash]
+	if !ok {
+		s = &swarm{peers: make(map[peerKey]*swarmPeer)}
+		t.torrents[infoHash] = s
+	}
+	s.expire(now.Add(-t.PeerTTL))
+
+	switch req.Event {
+	case "stopped":
+		delete(s.peers, key)
+	case "completed":
+		// Only count peers that were seen downloading, so that a peer
+		// cannot bump the count by announcing completed repeatedly
+		if peer, ok := s.peers[key]; ok && peer.Left > 0 {
+			s.downloaded++
+		}
+		fallthrough
+	default:
+		s.peers[key] = &swarmPeer{
+			Peer:     structure.Peer{IP: ip, Port: uint16(req.Port), ID: req.PeerID},
+			Left:     req.Left(),
+			LastSeen: now,
+		}
+	}
+
+	numWant := req.NumWant
+	if numWant <= 0 {
+		numWant = t.NumWant
+	}
+	if numWant > t.MaxNumWant {
+		numWant = t.MaxNumWant
+	}
+	if req.Event == "stopped" {
+		numWant = 0
+	}
+
+	complete, incomplete := s.counts()
+	tr := &structure.TrackerResponse{
+		Complete:    complete,
+		Incomplete:  incomplete,
+		Downloaded:  s.downloaded,
+		Interval:    int(t.Interval / time.Second),
+		MinInterval: int(t.MinInterval / time.Second),
+		Peers:       s.pick(key, numWant),
+	}
+
+	if len(s.peers) == 0 {
+		delete(t.torrents, infoHash)
+	}
+	return tr, nil
+}
+
+/*
+Scrape returns the counts of each of the given infohashes that the
+tracker knows, or of every torrent if none are given.
+*/
+func (t *Tracker) Scrape(infoHashes ...structure.InfoHash) map[structure.InfoHash]structure.ScrapeFile {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(infoHashes) == 0 {
+		for infoHash := range t.torrents {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+
+	cutoff := t.now().Add(-t.PeerTTL)
+	files := make(map[structure.InfoHash]structure.ScrapeFile)
+	for _, infoHash := range infoHashes {
+		s, ok := t.torrents[infoHash]
+		if !ok {
+			continue
+		}
+		s.expire(cutoff)
+		complete, incomplete := s.counts()
+		files[infoHash] = structure.ScrapeFile{
+			Complete:   complete,
+			Incomplete: incomplete,
+			Downloaded: s.downloaded,
+		}
+	}
+	return files
+}
+
+func (s *swarm) expire(cutoff time.Time) {
+	for key, peer := range s.peers {
+		if peer.LastSeen.Before(cutoff) {
+			delete(s.peers, key)
+		}
+	}
+}
+
+/*
+counts returns the number of seeders and leechers.
+*/
+func (s *swarm) counts() (complete, incomplete int) {
+	for _, peer := range s.peers {
+		if peer.Left == 0 {
+			complete++
+		} else {
+			incomplete++
+		}
+	}
+	return complete, incomplete
+}
+
+/*
+pick returns up to n random peers other than self. A seeder is not
+sent other seeders.
+*/
+func (s *swarm) pick(self peerKey, n int) []structure.Peer {
+	seeding := s.peers[self] != nil && s.peers[self].Left == 0
+
+	peers := make([]structure.Peer, 0)
+	for key, peer := range s.peers {
+		if key == self || seeding && peer.Left == 0 {
+			continue
+		}
+		peers = append(peers, peer.Peer)
+	}
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	if len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers
+}
@@ -0,0 +1,283 @@
+package tracker
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/stratospark/torro/client"
+	"github.com/stratospark/torro/structure"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var (
+	testInfoHash, _  = structure.NewInfoHash([]byte("aaaaaaaaaaaaaaaaaaaa"))
+	otherInfoHash, _ = structure.NewInfoHash([]byte("bbbbbbbbbbbbbbbbbbbb"))
+)
+
+func newTestRequest(peerID string, port int, left int64, event string) *structure.TrackerRequest {
+	return &structure.TrackerRequest{
+		InfoHash:  testInfoHash,
+		PeerID:    peerID,
+		Port:      port,
+		Remaining: &left,
+		Event:     event,
+	}
+}
+
+func TestTracker(t *testing.T) {
+	Convey("Announcing peers to a torrent", t, func() {
+		tr := NewTracker()
+		now := time.Now()
+		tr.now = func() time.Time { return now }
+		addr := net.ParseIP("10.0.0.1")
+
+		resp, err := tr.Announce(newTestRequest("-TO0001-aaaaaaaaaaaa", 6881, 100, "started"), addr)
+		So(err, ShouldBeNil)
+		So(resp.Peers, ShouldBeEmpty)
+		So(resp.Incomplete, ShouldEqual, 1)
+		So(resp.Interval, ShouldEqual, 1800)
+		So(resp.MinInterval, ShouldEqual, 300)
+
+		req := newTestRequest("-TO0001-bbbbbbbbbbbb", 6882, 0, "started")
+		req.IP = "192.168.1.2"
+		resp, err = tr.Announce(req, addr)
+		So(err, ShouldBeNil)
+		So(resp.Complete, ShouldEqual, 1)
+		So(resp.Incomplete, ShouldEqual, 1)
+		So(resp.Peers, ShouldHaveLength, 1)
+		So(resp.Peers[0].String(), ShouldEqual, "10.0.0.1:6881")
+		So(resp.Peers[0].ID, ShouldEqual, "-TO0001-aaaaaaaaaaaa")
+
+		resp, err = tr.Announce(newTestRequest("-TO0001-aaaaaaaaaaaa", 6881, 0, "completed"), addr)
+		So(err, ShouldBeNil)
+		So(resp.Complete, ShouldEqual, 2)
+		So(resp.Downloaded, ShouldEqual, 1)
+		// Seeders are not sent other seeders
+		So(resp.Peers, ShouldBeEmpty)
+
+		files := tr.Scrape()
+		So(files, ShouldResemble, map[structure.InfoHash]structure.ScrapeFile{
+			testInfoHash: structure.ScrapeFile{Complete: 2, Downloaded: 1},
+		})
+		So(tr.Scrape(otherInfoHash), ShouldBeEmpty)
+
+		resp, err = tr.Announce(newTestRequest("-TO0001-aaaaaaaaaaaa", 6881, 0, "stopped"), addr)
+		So(err, ShouldBeNil)
+		So(resp.Complete, ShouldEqual, 1)
+		So(resp.Peers, ShouldBeEmpty)
+
+		// Peers that stop announcing expire
+		now = now.Add(tr.PeerTTL + time.Second)
+		So(tr.Scrape()[testInfoHash].Complete, ShouldEqual, 0)
+		resp, err = tr.Announce(newTestRequest("-TO0001-cccccccccccc", 6883, 100, ""), addr)
+		So(err, ShouldBeNil)
+		So(resp.Peers, ShouldBeEmpty)
+		So(resp.Incomplete, ShouldEqual, 1)
+	})
+
+	Convey("Limiting the number of peers", t, func() {
+		tr := NewTracker()
+		tr.MaxNumWant = 3
+		addr := net.ParseIP("10.0.0.1")
+		for _, id := range []string{"a", "b", "c", "d", "e"} {
+			_, err := tr.Announce(newTestRequest("-TO0001-aaaaaaaaaaa"+id, 6881, 100, ""), addr)
+			So(err, ShouldBeNil)
+		}
+
+		req := newTestRequest("-TO0001-aaaaaaaaaaaa", 6881, 100, "")
+		resp, _ := tr.Announce(req, addr)
+		So(resp.Peers, ShouldHaveLength, 3)
+		req.NumWant = 2
+		resp, _ = tr.Announce(req, addr)
+		So(resp.Peers, ShouldHaveLength, 2)
+	})
+
+	Convey("Only using the announced ip when allowed", t, func() {
+		tr := NewTracker()
+		addr := net.ParseIP("10.0.0.1")
+		req := newTestRequest("-TO0001-aaaaaaaaaaaa", 6881, 100, "")
+		req.IP = "192.168.1.2"
+		_, err := tr.Announce(req, addr)
+		So(err, ShouldBeNil)
+
+		resp, _ := tr.Announce(newTestRequest("-TO0001-bbbbbbbbbbbb", 6882, 100, ""), addr)
+		So(resp.Peers, ShouldHaveLength, 1)
+		So(resp.Peers[0].String(), ShouldEqual, "10.0.0.1:6881")
+
+		tr.AllowClientIP = true
+		_, err = tr.Announce(req, addr)
+		So(err, ShouldBeNil)
+		resp, _ = tr.Announce(newTestRequest("-TO0001-bbbbbbbbbbbb", 6882, 100, ""), addr)
+		So(resp.Peers[0].String(), ShouldEqual, "192.168.1.2:6881")
+
+		req.IP = "not an ip"
+		_, err = tr.Announce(req, addr)
+		So(err, ShouldEqual, ErrInvalidPeerIP)
+	})
+
+	Convey("Not letting other addresses stop or move a peer", t, func() {
+		tr := NewTracker()
+		addr := net.ParseIP("10.0.0.1")
+		other := net.ParseIP("10.0.0.66")
+		_, err := tr.Announce(newTestRequest("-TO0001-aaaaaaaaaaaa", 6881, 100, "started"), addr)
+		So(err, ShouldBeNil)
+
+		_, err = tr.Announce(newTestRequest("-TO0001-aaaaaaaaaaaa", 6666, 100, "stopped"), other)
+		So(err, ShouldBeNil)
+		_, err = tr.Announce(newTestRequest("-TO0001-aaaaaaaaaaaa", 6666, 100, ""), other)
+		So(err, ShouldBeNil)
+
+		resp, err := tr.Announce(newTestRequest("-TO0001-bbbbbbbbbbbb", 6882, 100, ""), net.ParseIP("10.0.0.2"))
+		So(err, ShouldBeNil)
+		So(resp.Peers, ShouldHaveLength, 2)
+		addrs := []string{resp.Peers[0].String(), resp.Peers[1].String()}
+		So(addrs, ShouldContain, "10.0.0.1:6881")
+		So(addrs, ShouldContain, "10.0.0.66:6666")
+	})
+
+	Convey("Only counting downloads of peers seen downloading", t, func() {
+		tr := NewTracker()
+		addr := net.ParseIP("10.0.0.1")
+
+		resp, err := tr.Announce(newTestRequest("-TO0001-aaaaaaaaaaaa", 6881, 0, "completed"), addr)
+		So(err, ShouldBeNil)
+		So(resp.Downloaded, ShouldEqual, 0)
+
+		_, err = tr.Announce(newTestRequest("-TO0001-bbbbbbbbbbbb", 6882, 100, "started"), addr)
+		So(err, ShouldBeNil)
+		for i := 0; i < 3; i++ {
+			resp, err = tr.Announce(newTestRequest("-TO0001-bbbbbbbbbbbb", 6882, 0, "completed"), addr)
+			So(err, ShouldBeNil)
+			So(resp.Downloaded, ShouldEqual, 1)
+		}
+	})
+
+	Convey("Rejecting peers without a port", t, func() {
+		tr := NewTracker()
+		_, err := tr.Announce(newTestRequest("-TO0001-aaaaaaaaaaaa", 0, 100, ""), net.ParseIP("10.0.0.1"))
+		So(err, ShouldEqual, ErrInvalidPeerPort)
+		So(tr.Scrape(), ShouldBeEmpty)
+	})
+
+	Convey("Sweeping torrents that are no longer announced", t, func() {
+		tr := NewTracker()
+		now := time.Now()
+		tr.now = func() time.Time { return now }
+		addr := net.ParseIP("10.0.0.1")
+
+		_, err := tr.Announce(newTestRequest("-TO0001-aaaaaaaaaaaa", 6881, 100, ""), addr)
+		So(err, ShouldBeNil)
+		req := newTestRequest("-TO0001-bbbbbbbbbbbb", 6882, 100, "")
+		req.InfoHash = otherInfoHash
+		_, err = tr.Announce(req, addr)
+		So(err, ShouldBeNil)
+
+		now = now.Add(tr.PeerTTL / 2)
+		_, err = tr.Announce(req, addr)
+		So(err, ShouldBeNil)
+
+		now = now.Add(tr.PeerTTL/2 + time.Second)
+		tr.Sweep()
+		tr.mu.Lock()
+		So(tr.torrents, ShouldHaveLength, 1)
+		So(tr.torrents[otherInfoHash], ShouldNotBeNil)
+		tr.mu.Unlock()
+
+		tr.SweepInterval = time.Millisecond
+		now = now.Add(tr.PeerTTL)
+		tr.Start()
+		deadline := time.Now().Add(2 * time.Second)
+		for len(tr.Scrape()) > 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		tr.Stop()
+		tr.Stop()
+		So(tr.Scrape(), ShouldBeEmpty)
+	})
+
+	Convey("Stopping a tracker that was never started", t, func() {
+		tr := NewTracker()
+		tr.Stop()
+		tr.Stop()
+		tr.Start()
+		tr.Stop()
+	})
+
+	Convey("Only allowing whitelisted torrents", t, func() {
+		tr := NewTracker()
+		tr.Whitelist = map[structure.InfoHash]bool{otherInfoHash: true}
+		_, err := tr.Announce(newTestRequest("-TO0001-aaaaaaaaaaaa", 6881, 100, ""), net.ParseIP("10.0.0.1"))
+		So(err, ShouldEqual, ErrTorrentNotAllowed)
+	})
+}
+
+func TestTrackerHTTP(t *testing.T) {
+	Convey("Serving announces and scrapes to the tracker client", t, func() {
+		ts := httptest.NewServer(NewTracker())
+		defer ts.Close()
+
+		tc := client.NewTrackerClient()
+		tc.HTTP = &http.Client{}
+
+		metainfo, _ := structure.NewMetainfo("../testfiles/kali-linux-2.0-i386.iso.torrent")
+		seeder := structure.NewTrackerRequest(metainfo)
+		seeder.Tiers = structure.AnnounceList{[]string{ts.URL + "/announce"}}
+		seeder.PeerID = "-TO0001-aaaaaaaaaaaa"
+		seeder.Port = 6881
+		seeder.Downloaded = metainfo.Info.TotalBytes
+		seeder.Compact = true
+		resp, err := tc.Announce(seeder, client.TrackerRequestStarted)
+		So(err, ShouldBeNil)
+		So(resp.Complete, ShouldEqual, 1)
+
+		leecher := structure.NewTrackerRequest(metainfo)
+		leecher.Tiers = structure.AnnounceList{[]string{ts.URL + "/announce"}}
+		leecher.PeerID = "-TO0001-bbbbbbbbbbbb"
+		leecher.Port = 6882
+		resp, err = tc.Announce(leecher, client.TrackerRequestStarted)
+		So(err, ShouldBeNil)
+		So(resp.Incomplete, ShouldEqual, 1)
+		So(resp.Peers, ShouldHaveLength, 1)
+		So(resp.Peers[0].String(), ShouldEqual, "127.0.0.1:6881")
+		So(resp.Peers[0].ID, ShouldEqual, "-TO0001-aaaaaaaaaaaa")
+
+		resp, err = tc.Announce(seeder, "")
+		So(err, ShouldBeNil)
+		So(resp.Peers, ShouldHaveLength, 1)
+		So(resp.Peers[0].String(), ShouldEqual, "127.0.0.1:6882")
+		So(resp.Peers[0].ID, ShouldEqual, "")
+
+		files, err := tc.Scrape(ts.URL+"/announce", seeder.InfoHash)
+		So(err, ShouldBeNil)
+		So(files[seeder.InfoHash], ShouldResemble, structure.ScrapeFile{Complete: 1, Incomplete: 1})
+	})
+
+	Convey("Sending failures as a failure reason", t, func() {
+		tr := NewTracker()
+		tr.Whitelist = map[structure.InfoHash]bool{}
+		ts := httptest.NewServer(tr)
+		defer ts.Close()
+
+		tc := client.NewTrackerClient()
+		tc.HTTP = &http.Client{}
+		metainfo, _ := structure.NewMetainfo("../testfiles/kali-linux-2.0-i386.iso.torrent")
+		req := structure.NewTrackerRequest(metainfo)
+		req.Tiers = structure.AnnounceList{[]string{ts.URL + "/announce"}}
+		req.Port = 6881
+		resp, err := tc.Announce(req, client.TrackerRequestStarted)
+		So(err, ShouldNotBeNil)
+		So(resp.FailureReason, ShouldEqual, ErrTorrentNotAllowed.Error())
+
+		httpResp, err := (&http.Client{}).Get(ts.URL + "/announce?info_hash=short")
+		So(err, ShouldBeNil)
+		httpResp.Body.Close()
+		So(httpResp.StatusCode, ShouldEqual, http.StatusOK)
+
+		httpResp, err = (&http.Client{}).Get(ts.URL + "/other")
+		So(err, ShouldBeNil)
+		httpResp.Body.Close()
+		So(httpResp.StatusCode, ShouldEqual, http.StatusNotFound)
+	})
+}
@@ -0,0 +1,307 @@
+package tracker
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/stratospark/torro/structure"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+UDP tracker protocol constants, see BEP 15.
+*/
+const (
+	udpProtocolID int64 = 0x41727101980
+
+	udpActionConnect  uint32 = 0
+	udpActionAnnounce uint32 = 1
+	udpActionScrape   uint32 = 2
+	udpActionError    uint32 = 3
+
+	udpAnnounceSize    = 98
+	udpMaxScrapeHashes = 74
+	udpMaxPacketSize   = 2048
+
+	// Connection IDs are issued per minute and accepted for the
+	// current and the previous minute
+	udpConnectionIDPeriod = time.Minute
+)
+
+var (
+	ErrUDPInvalidConnectionID = errors.New("Invalid Connection ID")
+	ErrUDPInvalidPacket       = errors.New("Invalid Packet")
+)
+
+var udpEvents = map[uint32]string{
+	0: "",
+	1: "completed",
+	2: "started",
+	3: "stopped",
+}
+
+/*
+UDPServer serves a Tracker over the UDP tracker protocol. Connection
+IDs are an HMAC of the client's address and the current minute, so
+they can be checked without keeping any state per client.
+
+Each source IP may send Rate packets per second on average, in bursts
+of up to Burst packets. Packets over the limit are dropped without an
+answer, so that the tracker cannot be used to amplify traffic.
+*/
+type UDPServer struct {
+	Tracker *Tracker
+	Rate    float64
+	Burst   int
+
+	secret []byte
+	now    func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	Tokens float64
+	Last   time.Time
+}
+
+func NewUDPServer(t *Tracker) *UDPServer {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return &UDPServer{
+		Tracker: t,
+		Rate:    5,
+		Burst:   20,
+		secret:  secret,
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+/*
+ListenAndServe serves the tracker over UDP on addr.
+*/
+func (s *UDPServer) ListenAndServe(addr string) error {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return err
+	}
+	log.Println("[UDPTracker] Listening on", conn.LocalAddr())
+	return s.Serve(conn)
+}
+
+/*
+Serve answers requests on conn until it is closed.
+*/
+func (s *UDPServer) Serve(conn *net.UDPConn) error {
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		if !s.allow(addr.IP) {
+			continue
+		}
+		if resp := s.handle(buf[:n], addr); resp != nil {
+			conn.WriteToUDP(resp, addr)
+		}
+	}
+}
+
+/*
+handle returns the response to a single packet, or nil if the packet
+should be ignored.
+*/
+func (s *UDPServer) handle(packet []byte, addr *net.UDPAddr) []byte {
+	if len(packet) < 16 {
+		return nil
+	}
+	connectionID := int64(binary.BigEndian.Uint64(packet[0:8]))
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionID := packet[12:16]
+
+	resp := &bytes.Buffer{}
+	binary.Write(resp, binary.BigEndian, action)
+	resp.Write(transactionID)
+
+	if action == udpActionConnect {
+		if connectionID != udpProtocolID {
+			return nil
+		}
+		binary.Write(resp, binary.BigEndian, s.connectionID(addr.IP, s.now()))
+		return resp.Bytes()
+	}
+
+	if !s.validConnectionID(connectionID, addr.IP) {
+		return udpError(transactionID, ErrUDPInvalidConnectionID)
+	}
+
+	var err error
+	switch action {
+	case udpActionAnnounce:
+		err = s.announce(resp, packet[16:], addr)
+	case udpActionScrape:
+		err = s.scrape(resp, packet[16:])
+	default:
+		err = ErrUDPInvalidPacket
+	}
+	if err != nil {
+		return udpError(transactionID, err)
+	}
+	return resp.Bytes()
+}
+
+func (s *UDPServer) announce(resp *bytes.Buffer, payload []byte, addr *net.UDPAddr) error {
+	if len(payload) < udpAnnounceSize-16 {
+		return ErrUDPInvalidPacket
+	}
+	event, ok := udpEvents[binary.BigEndian.Uint32(payload[64:68])]
+	if !ok {
+		return ErrUDPInvalidPacket
+	}
+	left := int64(binary.BigEndian.Uint64(payload[48:56]))
+	infoHash, _ := structure.NewInfoHash(payload[0:20])
+	req := &structure.TrackerRequest{
+		InfoHash:   infoHash,
+		PeerID:     string(payload[20:40]),
+		Downloaded: int64(binary.BigEndian.Uint64(payload[40:48])),
+		Remaining:  &left,
+		Uploaded:   int64(binary.BigEndian.Uint64(payload[56:64])),
+		Event:      event,
+		Key:        strconv.FormatUint(uint64(binary.BigEndian.Uint32(payload[72:76])), 16),
+		NumWant:    int(int32(binary.BigEndian.Uint32(payload[76:80]))),
+		Port:       int(binary.BigEndian.Uint16(payload[80:82])),
+	}
+	if ip := payload[68:72]; addr.IP.To4() != nil && !bytes.Equal(ip, []byte{0, 0, 0, 0}) {
+		req.IP = net.IP(ip).String()
+	}
+
+	tr, err := s.Tracker.Announce(req, addr.IP)
+	if err != nil {
+		return err
+	}
+
+	binary.Write(resp, binary.BigEndian, uint32(tr.Interval))
+	binary.Write(resp, binary.BigEndian, uint32(tr.Incomplete))
+	binary.Write(resp, binary.BigEndian, uint32(tr.Complete))
+
+	// Only peers of the same address family as the request are sent
+	ipv4 := addr.IP.To4() != nil
+	for _, peer := range tr.Peers {
+		ip := peer.IP.To4()
+		if !ipv4 {
+			if ip != nil {
+				continue
+			}
+			ip = peer.IP.To16()
+		}
+		if ip == nil {
+			continue
+		}
+		resp.Write(ip)
+		binary.Write(resp, binary.BigEndian, peer.Port)
+	}
+	return nil
+}
+
+func (s *UDPServer) scrape(resp *bytes.Buffer, payload []byte) error {
+	if len(payload) == 0 || len(payload)%20 != 0 || len(payload)/20 > udpMaxScrapeHashes {
+		return ErrUDPInvalidPacket
+	}
+	infoHashes := make([]structure.InfoHash, 0, len(payload)/20)
+	for i := 0; i < len(payload); i += 20 {
+		infoHash, _ := structure.NewInfoHash(payload[i : i+20])
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	files := s.Tracker.Scrape(infoHashes...)
+	for _, infoHash := range infoHashes {
+		file := files[infoHash]
+		binary.Write(resp, binary.BigEndian, uint32(file.Complete))
+		binary.Write(resp, binary.BigEndian, uint32(file.Downloaded))
+		binary.Write(resp, binary.BigEndian, uint32(file.Incomplete))
+	}
+	return nil
+}
+
+func udpError(transactionID []byte, err error) []byte {
+	resp := &bytes.Buffer{}
+	binary.Write(resp, binary.BigEndian, udpActionError)
+	resp.Write(transactionID)
+	resp.WriteString(err.Error())
+	return resp.Bytes()
+}
+
+/*
+connectionID returns the connection ID issued to ip during the period
+that contains t.
+*/
+func (s *UDPServer) connectionID(ip net.IP, t time.Time) int64 {
+	period := make([]byte, 8)
+	binary.BigEndian.PutUint64(period, uint64(t.UnixNano()/int64(udpConnectionIDPeriod)))
+
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(ip.To16())
+	mac.Write(period)
+	return int64(binary.BigEndian.Uint64(mac.Sum(nil)))
+}
+
+func (s *UDPServer) validConnectionID(id int64, ip net.IP) bool {
+	now := s.now()
+	return id == s.connectionID(ip, now) || id == s.connectionID(ip, now.Add(-udpConnectionIDPeriod))
+}
+
+/*
+allow takes a token from the bucket of ip, reporting false when the
+bucket is empty. Full buckets are dropped every minute.
+*/
+func (s *UDPServer) allow(ip net.IP) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.swept) > time.Minute {
+		for key, bucket := range s.buckets {
+			if bucket.refill(now, s.Rate, s.Burst) >= float64(s.Burst) {
+				delete(s.buckets, key)
+			}
+		}
+		s.swept = now
+	}
+
+	bucket, ok := s.buckets[string(ip.To16())]
+	if !ok {
+		bucket = &tokenBucket{Tokens: float64(s.Burst), Last: now}
+		s.buckets[string(ip.To16())] = bucket
+	}
+	if bucket.refill(now, s.Rate, s.Burst) < 1 {
+		return false
+	}
+	bucket.Tokens--
+	return true
+}
+
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) float64 {
+	b.Tokens += now.Sub(b.Last).Seconds() * rate
+	if b.Tokens > float64(burst) {
+		b.Tokens = float64(burst)
+	}
+	b.Last = now
+	return b.Tokens
+}
@@ -0,0 +1,153 @@
+package tracker
+
+import (
+	"bytes"
+	"encoding/binary"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/stratospark/torro/client"
+	"github.com/stratospark/torro/structure"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestUDPServer() (*UDPServer, *net.UDPConn, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewUDPServer(NewTracker()), conn, nil
+}
+
+func newTestUDPClient() *client.TrackerClient {
+	tc := client.NewTrackerClient()
+	tc.UDP.Timeout = 100 * time.Millisecond
+	tc.UDP.MaxRetries = 2
+	return tc
+}
+
+func udpPacket(connectionID int64, action uint32, payload []byte) []byte {
+	packet := &bytes.Buffer{}
+	binary.Write(packet, binary.BigEndian, connectionID)
+	binary.Write(packet, binary.BigEndian, action)
+	binary.Write(packet, binary.BigEndian, uint32(0xcafe))
+	packet.Write(payload)
+	return packet.Bytes()
+}
+
+func TestUDPServer(t *testing.T) {
+	Convey("Serving announces and scrapes to the UDP tracker client", t, func() {
+		s, conn, err := newTestUDPServer()
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		go s.Serve(conn)
+		announceURL := "udp://" + conn.LocalAddr().String() + "/announce"
+
+		tc := newTestUDPClient()
+		metainfo, _ := structure.NewMetainfo("../testfiles/kali-linux-2.0-i386.iso.torrent")
+		seeder := structure.NewTrackerRequest(metainfo)
+		seeder.Tiers = structure.AnnounceList{[]string{announceURL}}
+		seeder.PeerID = "-TO0001-aaaaaaaaaaaa"
+		seeder.Port = 6881
+		seeder.Downloaded = metainfo.Info.TotalBytes
+		resp, err := tc.Announce(seeder, client.TrackerRequestStarted)
+		So(err, ShouldBeNil)
+		So(resp.Complete, ShouldEqual, 1)
+		So(resp.Interval, ShouldEqual, 1800)
+
+		leecher := structure.NewTrackerRequest(metainfo)
+		leecher.Tiers = structure.AnnounceList{[]string{announceURL}}
+		leecher.PeerID = "-TO0001-bbbbbbbbbbbb"
+		leecher.Port = 6882
+		resp, err = tc.Announce(leecher, client.TrackerRequestStarted)
+		So(err, ShouldBeNil)
+		So(resp.Complete, ShouldEqual, 1)
+		So(resp.Incomplete, ShouldEqual, 1)
+		So(resp.Peers, ShouldHaveLength, 1)
+		So(resp.Peers[0].String(), ShouldEqual, "127.0.0.1:6881")
+
+		files, err := tc.Scrape(announceURL, seeder.InfoHash, otherInfoHash)
+		So(err, ShouldBeNil)
+		So(files[seeder.InfoHash], ShouldResemble, structure.ScrapeFile{Complete: 1, Incomplete: 1})
+		So(files[otherInfoHash], ShouldResemble, structure.ScrapeFile{})
+
+		_, err = tc.Announce(seeder, client.TrackerRequestStopped)
+		So(err, ShouldBeNil)
+		files, err = tc.Scrape(announceURL, seeder.InfoHash)
+		So(err, ShouldBeNil)
+		So(files[seeder.InfoHash].Complete, ShouldEqual, 0)
+	})
+
+	Convey("Sending tracker errors to the client", t, func() {
+		s, conn, err := newTestUDPServer()
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		s.Tracker.Whitelist = map[structure.InfoHash]bool{}
+		go s.Serve(conn)
+
+		tc := newTestUDPClient()
+		metainfo, _ := structure.NewMetainfo("../testfiles/kali-linux-2.0-i386.iso.torrent")
+		req := structure.NewTrackerRequest(metainfo)
+		req.Tiers = structure.AnnounceList{[]string{"udp://" + conn.LocalAddr().String()}}
+		_, err = tc.Announce(req, client.TrackerRequestStarted)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, ErrTorrentNotAllowed.Error())
+	})
+
+	Convey("Validating connection IDs", t, func() {
+		s := NewUDPServer(NewTracker())
+		now := time.Now()
+		s.now = func() time.Time { return now }
+		addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+
+		resp := s.handle(udpPacket(udpProtocolID, udpActionConnect, nil), addr)
+		So(resp, ShouldHaveLength, 16)
+		connectionID := int64(binary.BigEndian.Uint64(resp[8:16]))
+
+		scrape := udpPacket(connectionID, udpActionScrape, []byte("aaaaaaaaaaaaaaaaaaaa"))
+		resp = s.handle(scrape, addr)
+		So(binary.BigEndian.Uint32(resp[0:4]), ShouldEqual, udpActionScrape)
+		So(resp, ShouldHaveLength, 20)
+
+		// The ID is tied to the address it was issued to
+		other := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+		resp = s.handle(scrape, other)
+		So(binary.BigEndian.Uint32(resp[0:4]), ShouldEqual, udpActionError)
+		So(string(resp[8:]), ShouldEqual, ErrUDPInvalidConnectionID.Error())
+
+		// and expires after one to two minutes
+		now = now.Add(udpConnectionIDPeriod)
+		resp = s.handle(scrape, addr)
+		So(binary.BigEndian.Uint32(resp[0:4]), ShouldEqual, udpActionScrape)
+		now = now.Add(udpConnectionIDPeriod)
+		resp = s.handle(scrape, addr)
+		So(binary.BigEndian.Uint32(resp[0:4]), ShouldEqual, udpActionError)
+
+		// A connect without the protocol ID is ignored
+		So(s.handle(udpPacket(connectionID, udpActionConnect, nil), addr), ShouldBeNil)
+		So(s.handle([]byte("short"), addr), ShouldBeNil)
+	})
+
+	Convey("Rate limiting each source IP", t, func() {
+		s := NewUDPServer(NewTracker())
+		now := time.Now()
+		s.now = func() time.Time { return now }
+		s.Rate = 1
+		s.Burst = 2
+		ip := net.IPv4(10, 0, 0, 1)
+
+		So(s.allow(ip), ShouldBeTrue)
+		So(s.allow(ip), ShouldBeTrue)
+		So(s.allow(ip), ShouldBeFalse)
+		So(s.allow(net.IPv4(10, 0, 0, 2)), ShouldBeTrue)
+
+		now = now.Add(time.Second)
+		So(s.allow(ip), ShouldBeTrue)
+		So(s.allow(ip), ShouldBeFalse)
+
+		// Idle sources are forgotten
+		now = now.Add(2 * time.Minute)
+		So(s.allow(net.IPv4(10, 0, 0, 3)), ShouldBeTrue)
+		So(s.buckets, ShouldHaveLength, 1)
+	})
+}